@@ -1,9 +1,92 @@
 // IMAP server backend interface.
 package backend
 
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/emersion/go-imap/scram"
+)
+
 // An IMAP server backend.
 // A backend operation always deals with users.
 type Backend interface {
 	// Authenticate a user.
 	Login(username, password string) (User, error)
 }
+
+// Information about a client connection.
+type ConnInfo struct {
+	// The client's address.
+	RemoteAddr net.Addr
+	// The server's address the client is connected to.
+	LocalAddr net.Addr
+	// The TLS connection state, nil if the connection isn't encrypted. It
+	// contains the client certificates, if any, and the server name requested
+	// with SNI.
+	TLS *tls.ConnectionState
+	// The authentication mechanism used by the client, e.g. "PLAIN". It is
+	// "LOGIN" when the LOGIN command or the LOGIN mechanism is used.
+	Mechanism string
+}
+
+// A Backend that implements ConnLoginBackend receives information about the
+// client connection when a user logs in, e.g. to enforce per-network policies
+// or to bind sessions to client certificates.
+type ConnLoginBackend interface {
+	Backend
+
+	// Authenticate a user. If implemented, it is called instead of Login.
+	LoginConn(conn *ConnInfo, username, password string) (User, error)
+}
+
+// A Backend that implements ExternalBackend supports the EXTERNAL
+// authentication mechanism, which authenticates clients with their TLS
+// certificate.
+type ExternalBackend interface {
+	Backend
+
+	// Authenticate a user with a verified TLS client certificate, available in
+	// conn.TLS. identity is the authorization identity requested by the client,
+	// it is empty if the client wants to act as the identity associated with
+	// the certificate.
+	LoginExternal(conn *ConnInfo, identity string) (User, error)
+}
+
+// A Backend that implements OAuthBackend supports the OAUTHBEARER and XOAUTH2
+// authentication mechanisms, which authenticate clients with an OAuth 2.0
+// bearer token.
+type OAuthBackend interface {
+	Backend
+
+	// Authenticate a user with a bearer token. username is the user the client
+	// wants to act as, it can be empty with OAUTHBEARER in which case the user is
+	// identified by the token. If the token is rejected, the returned error can
+	// be a *sasl.OAuthBearerError, which is then sent to the client.
+	LoginOAuth(conn *ConnInfo, username, token string) (User, error)
+}
+
+// A Backend that implements ScramBackend supports the SCRAM-SHA-1 and
+// SCRAM-SHA-256 authentication mechanisms, which don't require the server to
+// know the user's password.
+type ScramBackend interface {
+	Backend
+
+	// Get the stored credentials of a user for mechanism, scram.SHA1 or
+	// scram.SHA256. They can be created with scram.NewCredentials.
+	ScramCredentials(conn *ConnInfo, username, mechanism string) (*scram.Credentials, error)
+	// Get a user whose credentials have been checked by the server.
+	LoginVerified(conn *ConnInfo, username string) (User, error)
+}
+
+// A Backend that implements CramMD5Backend supports the CRAM-MD5
+// authentication mechanism.
+type CramMD5Backend interface {
+	Backend
+
+	// Get the secret shared with a user. Note that it's equivalent to a
+	// password.
+	CramMD5Secret(conn *ConnInfo, username string) ([]byte, error)
+	// Get a user whose credentials have been checked by the server.
+	LoginVerified(conn *ConnInfo, username string) (User, error)
+}
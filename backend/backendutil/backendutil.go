@@ -0,0 +1,114 @@
+// Utilities to implement IMAP backends.
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// Split a message into its header and its body. The header includes the empty
+// line that separates it from the body.
+func splitMessage(b []byte) (header, body []byte) {
+	for i := 0; i < len(b); {
+		end := len(b)
+		if j := bytes.IndexByte(b[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+
+		line := b[i:end]
+		if len(line) == 1 || (len(line) == 2 && line[0] == '\r') {
+			return b[:end], b[end:]
+		}
+
+		i = end
+	}
+
+	// The message only contains a header
+	return b, nil
+}
+
+// Parse a raw header.
+func readHeader(header []byte) textproto.MIMEHeader {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(header)))
+
+	// Errors are ignored, because we want to be able to get as much information
+	// as possible out of malformed headers
+	h, _ := r.ReadMIMEHeader()
+	if h == nil {
+		h = textproto.MIMEHeader{}
+	}
+	return h
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+// Decode a header value that may contain RFC 2047 encoded-words.
+func decodeHeader(s string) string {
+	if dec, err := wordDecoder.DecodeHeader(s); err == nil {
+		return dec
+	}
+	return s
+}
+
+// Iterate over the raw fields of a header. Folded fields are returned as a
+// single field, including the line breaks.
+func headerFields(header []byte, f func(name string, field []byte)) {
+	var name string
+	var field []byte
+	for i := 0; i < len(header); {
+		end := len(header)
+		if j := bytes.IndexByte(header[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		line := header[i:end]
+		i = end
+
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// Continuation of the previous field
+			field = append(field, line...)
+			continue
+		}
+
+		if field != nil {
+			f(name, field)
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			// End of the header
+			field = nil
+			break
+		}
+
+		name = ""
+		if j := bytes.IndexByte(line, ':'); j >= 0 {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(string(line[:j])))
+		}
+		field = append([]byte(nil), line...)
+	}
+
+	if field != nil {
+		f(name, field)
+	}
+}
+
+// Return a header containing only the specified fields, or all fields except
+// the specified ones if not is set to true. The returned header always ends
+// with an empty line.
+func filterHeader(header []byte, names []string, not bool) []byte {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+
+	var b bytes.Buffer
+	headerFields(header, func(name string, field []byte) {
+		if wanted[name] != not {
+			b.Write(field)
+		}
+	})
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
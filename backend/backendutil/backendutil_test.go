@@ -0,0 +1,384 @@
+package backendutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/common"
+)
+
+var testMessage = strings.Replace(`From: Mitsuha Miyamizu <mitsuha.miyamizu@example.org>
+To: Taki Tachibana <taki.tachibana@example.org>
+Subject: =?utf-8?q?Your_Name=2E?=
+Date: Wed, 11 May 2016 14:31:59 +0000
+Message-Id: <42@example.org>
+Content-Type: multipart/mixed; boundary=message-boundary
+
+--message-boundary
+Content-Type: text/plain
+
+Who are you?
+--message-boundary
+Content-Type: message/rfc822
+Content-Disposition: attachment
+
+Subject: Inner
+Content-Type: text/html
+
+<p>Hi</p>
+--message-boundary--
+`, "\n", "\r\n", -1)
+
+var bodySectionTests = []struct{
+	section string
+	body string
+}{
+	{"BODY[1]", "Who are you?"},
+	{"BODY[1.MIME]", "Content-Type: text/plain\r\n\r\n"},
+	{"BODY[2.HEADER]", "Subject: Inner\r\nContent-Type: text/html\r\n\r\n"},
+	{"BODY[2.TEXT]", "<p>Hi</p>"},
+	{"BODY[2.1]", "<p>Hi</p>"},
+	{"BODY[HEADER.FIELDS (Subject To)]", "To: Taki Tachibana <taki.tachibana@example.org>\r\nSubject: =?utf-8?q?Your_Name=2E?=\r\n\r\n"},
+}
+
+func TestFetchBodySection(t *testing.T) {
+	for _, test := range bodySectionTests {
+		section, err := common.NewBodySectionName(test.section)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := backendutil.FetchBodySection([]byte(testMessage), section)
+		if err != nil {
+			t.Errorf("Cannot fetch %v: %v", test.section, err)
+		} else if string(body) != test.body {
+			t.Errorf("Invalid body for %v: got %q, want %q", test.section, body, test.body)
+		}
+	}
+
+	section, _ := common.NewBodySectionName("BODY[3]")
+	if _, err := backendutil.FetchBodySection([]byte(testMessage), section); err == nil {
+		t.Error("Expected an error when fetching a non-existing part")
+	}
+}
+
+func TestFetchEnvelope(t *testing.T) {
+	env := backendutil.FetchEnvelope([]byte(testMessage))
+
+	if env.Subject != "Your Name." {
+		t.Errorf("Invalid subject: %q", env.Subject)
+	}
+	if len(env.From) != 1 || env.From[0].PersonalName != "Mitsuha Miyamizu" || env.From[0].String() != "mitsuha.miyamizu@example.org" {
+		t.Errorf("Invalid From: %+v", env.From)
+	}
+	if !reflect.DeepEqual(env.Sender, env.From) || !reflect.DeepEqual(env.ReplyTo, env.From) {
+		t.Error("Sender and Reply-To should default to From")
+	}
+	if env.MessageId != "<42@example.org>" {
+		t.Errorf("Invalid Message-Id: %q", env.MessageId)
+	}
+	if env.Date == nil || !env.Date.Equal(time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)) {
+		t.Errorf("Invalid date: %v", env.Date)
+	}
+}
+
+func TestFetchBodyStructure(t *testing.T) {
+	bs := backendutil.FetchBodyStructure([]byte(testMessage), true)
+
+	if bs.MimeType != "multipart" || bs.MimeSubType != "mixed" || len(bs.Parts) != 2 {
+		t.Fatalf("Invalid body structure: %+v", bs)
+	}
+	if text := bs.Parts[0]; text.MimeType != "text" || text.Size != 12 || text.Lines != 0 {
+		t.Errorf("Invalid text part: %+v", text)
+	}
+	msg := bs.Parts[1]
+	if msg.MimeType != "message" || msg.Disposition != "attachment" || msg.Envelope == nil || msg.Envelope.Subject != "Inner" {
+		t.Errorf("Invalid message part: %+v", msg)
+	}
+	if msg.BodyStructure == nil || msg.BodyStructure.MimeSubType != "html" {
+		t.Errorf("Invalid encapsulated body structure: %+v", msg.BodyStructure)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	date := time.Date(2016, 5, 12, 10, 0, 0, 0, time.UTC)
+	msg := &common.Message{
+		SeqNum: 2,
+		Uid: 42,
+		Flags: []string{common.SeenFlag, "$Important"},
+		InternalDate: &date,
+	}
+
+	since := time.Date(2016, 5, 12, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2016, 5, 12, 0, 0, 0, 0, time.UTC)
+	uids, _ := common.NewSeqSet("40:*")
+
+	tests := []struct{
+		criteria *common.SearchCriteria
+		match bool
+		body bool
+	}{
+		{&common.SearchCriteria{}, true, false},
+		{&common.SearchCriteria{Seen: true, Keyword: "$important"}, true, false},
+		{&common.SearchCriteria{Unseen: true}, false, false},
+		{&common.SearchCriteria{From: "MITSUHA"}, true, true},
+		{&common.SearchCriteria{Subject: "your name"}, true, true},
+		{&common.SearchCriteria{Body: "who are you"}, true, true},
+		{&common.SearchCriteria{Body: "Subject: Your"}, false, true},
+		{&common.SearchCriteria{Header: [2]string{"message-id", "42@"}}, true, true},
+		{&common.SearchCriteria{Since: &since}, true, false},
+		{&common.SearchCriteria{Before: &before}, false, false},
+		{&common.SearchCriteria{SentBefore: &before}, true, true},
+		{&common.SearchCriteria{Uid: uids}, true, false},
+		{&common.SearchCriteria{Not: &common.SearchCriteria{Seen: true}}, false, false},
+		{&common.SearchCriteria{Or: [2]*common.SearchCriteria{{Deleted: true}, {Larger: 10}}}, true, true},
+	}
+
+	for i, test := range tests {
+		if ok := backendutil.Match(msg, []byte(testMessage), 2, 42, test.criteria); ok != test.match {
+			t.Errorf("Test #%v: expected match to be %v, got %v", i, test.match, ok)
+		}
+
+		if body := backendutil.MatchNeedsBody(test.criteria); body != test.body {
+			t.Errorf("Test #%v: expected criteria to need the body: %v, got %v", i, test.body, body)
+		} else if !body {
+			if ok := backendutil.Match(msg, nil, 2, 42, test.criteria); ok != test.match {
+				t.Errorf("Test #%v: expected match without body to be %v, got %v", i, test.match, ok)
+			}
+		}
+	}
+}
+
+func TestFetchNeedsBody(t *testing.T) {
+	tests := []struct{
+		items []string
+		body bool
+	}{
+		{[]string{"UID"}, false},
+		{[]string{"UID", "FLAGS", "INTERNALDATE"}, false},
+		{[]string{"UID", "RFC822.SIZE"}, true},
+		{[]string{"ENVELOPE"}, true},
+		{[]string{"BODY.PEEK[HEADER]"}, true},
+	}
+
+	for _, test := range tests {
+		if body := backendutil.FetchNeedsBody(test.items); body != test.body {
+			t.Errorf("Expected %v to need the body: %v, got %v", test.items, test.body, body)
+		}
+	}
+}
+
+func TestUpdateFlags(t *testing.T) {
+	current := []string{common.RecentFlag, common.SeenFlag}
+
+	tests := []struct{
+		op common.FlagsOp
+		flags []string
+		expected []string
+	}{
+		{common.SetFlags, []string{common.DeletedFlag, common.DeletedFlag}, []string{common.RecentFlag, common.DeletedFlag}},
+		{common.AddFlags, []string{common.SeenFlag, common.DraftFlag}, []string{common.RecentFlag, common.SeenFlag, common.DraftFlag}},
+		{common.RemoveFlags, []string{common.SeenFlag, common.RecentFlag}, []string{common.RecentFlag}},
+	}
+
+	for _, test := range tests {
+		updated := backendutil.UpdateFlags(current, test.op, test.flags)
+		if !reflect.DeepEqual(updated, test.expected) {
+			t.Errorf("Invalid flags after %v %v: got %v, want %v", test.op, test.flags, updated, test.expected)
+		}
+	}
+}
+
+func TestDiffMessages(t *testing.T) {
+	u := backend.Update{Username: "username", Mailbox: "INBOX"}
+
+	old := []backendutil.MessageState{
+		{1, []string{common.SeenFlag}},
+		{2, nil},
+		{3, nil},
+		{4, []string{common.DeletedFlag}},
+	}
+	current := []backendutil.MessageState{
+		{1, []string{common.SeenFlag}},
+		{3, []string{common.FlaggedFlag}},
+		{5, nil},
+	}
+
+	updates := backendutil.DiffMessages(u, old, current)
+	if len(updates) != 3 {
+		t.Fatalf("Expected 3 updates, got %v", len(updates))
+	}
+
+	if update, ok := updates[0].(*backend.UidExpungeUpdate); !ok || !reflect.DeepEqual(update.Uids, []uint32{2, 4}) || update.Update != u {
+		t.Errorf("Expected expunge of messages 2 and 4, got %+v", updates[0])
+	}
+	if update, ok := updates[1].(*backend.FlagsUpdate); !ok || update.Uid != 3 || !reflect.DeepEqual(update.Flags, []string{common.FlaggedFlag}) {
+		t.Errorf("Expected flags update of message 3, got %+v", updates[1])
+	}
+	if update, ok := updates[2].(*backend.AddedUpdate); !ok || !reflect.DeepEqual(update.Uids, []uint32{5}) {
+		t.Errorf("Expected message 5 to be added, got %+v", updates[2])
+	}
+
+	if updates := backendutil.DiffMessages(u, current, current); len(updates) != 0 {
+		t.Errorf("Expected no update for an unchanged mailbox, got %v", updates)
+	}
+}
+
+func TestUpdateQueue(t *testing.T) {
+	updates := &backend.Updates{
+		Expunges: make(chan *backend.ExpungeUpdate),
+		Mailboxes: make(chan *backend.MailboxUpdate),
+	}
+	q := backendutil.NewUpdateQueue(updates)
+
+	// Pushing must not block even if nobody reads updates
+	done := make(chan struct{})
+	go (func() {
+		for i := uint32(1); i <= 10; i++ {
+			q.Push(&backend.ExpungeUpdate{SeqNum: i})
+		}
+		// Channels left nil are ignored
+		q.Push(&backend.FlagsUpdate{Uid: 42})
+		q.Push(&backend.MailboxUpdate{})
+		close(done)
+	})()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Pushing updates blocks")
+	}
+
+	for i := uint32(1); i <= 10; i++ {
+		if update := <-updates.Expunges; update.SeqNum != i {
+			t.Fatalf("Expected update #%v, got #%v", i, update.SeqNum)
+		}
+	}
+
+	select {
+	case <-updates.Mailboxes:
+	case <-time.After(time.Second):
+		t.Fatal("Mailbox update not sent")
+	}
+}
+
+func TestUpdateQueue_Flush(t *testing.T) {
+	updates := &backend.Updates{
+		Expunges: make(chan *backend.ExpungeUpdate),
+	}
+	q := backendutil.NewUpdateQueue(updates)
+
+	// Flushing an empty queue returns immediately
+	q.Flush()
+
+	q.Push(&backend.ExpungeUpdate{SeqNum: 2}, &backend.ExpungeUpdate{SeqNum: 1})
+
+	done := make(chan struct{})
+	go (func() {
+		q.Flush()
+		close(done)
+	})()
+
+	<-updates.Expunges
+	select {
+	case <-done:
+		t.Fatal("Flush returned before all updates were sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-updates.Expunges
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Flush doesn't return once all updates are sent")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-backendutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	for _, contents := range []string{"first", "second"} {
+		if err := backendutil.WriteFileAtomic(path, []byte(contents)); err != nil {
+			t.Fatal("Cannot write file:", err)
+		}
+
+		if b, err := ioutil.ReadFile(path); err != nil {
+			t.Fatal(err)
+		} else if string(b) != contents {
+			t.Errorf("Bad file contents: got %q, want %q", b, contents)
+		}
+	}
+
+	// Temporary files must be removed, even when the rename fails
+	if err := backendutil.WriteFileAtomic(filepath.Join(dir, "nonexistent", "file"), nil); err == nil {
+		t.Error("Expected an error when writing to a missing directory")
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := backendutil.WriteFileAtomic(filepath.Join(dir, "dir"), nil); err == nil {
+		t.Error("Expected an error when replacing a directory")
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	if len(names) != 0 {
+		t.Errorf("Temporary files left behind: %v", names)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-backendutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mbox")
+	unlock, err := backendutil.LockFile(path)
+	if err != nil {
+		t.Fatal("Cannot lock file:", err)
+	}
+
+	locked := make(chan func())
+	go (func() {
+		unlock, err := backendutil.LockFile(path)
+		if err != nil {
+			t.Error("Cannot lock file:", err)
+		}
+		locked <- unlock
+	})()
+
+	select {
+	case <-locked:
+		t.Fatal("File locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	(<-locked)()
+
+	// A stale lock left by a crashed process is removed
+	if err := ioutil.WriteFile(path + ".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path + ".lock", old, old)
+
+	unlock, err = backendutil.LockFile(path)
+	if err != nil {
+		t.Fatal("Cannot lock file with a stale lock:", err)
+	}
+	unlock()
+}
@@ -0,0 +1,67 @@
+package backendutil
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-imap/common"
+)
+
+func bodyStructure(e *entity, extended bool) *common.BodyStructure {
+	h := readHeader(e.header)
+	t, params := e.mediaType()
+	types := strings.SplitN(t, "/", 2)
+
+	bs := &common.BodyStructure{
+		MimeType: types[0],
+		MimeSubType: types[1],
+		Params: params,
+		Id: h.Get("Content-Id"),
+		Description: decodeHeader(h.Get("Content-Description")),
+		Encoding: strings.ToUpper(h.Get("Content-Transfer-Encoding")),
+		Size: uint32(len(e.body)),
+		Extended: extended,
+	}
+
+	if bs.Encoding == "" {
+		bs.Encoding = "7BIT"
+	}
+
+	switch {
+	case bs.MimeType == "multipart":
+		for _, child := range e.children() {
+			bs.Parts = append(bs.Parts, bodyStructure(child, extended))
+		}
+	case t == "message/rfc822":
+		inner := newEntity(e.body)
+		bs.Envelope = envelope(readHeader(inner.header))
+		bs.BodyStructure = bodyStructure(inner, extended)
+		bs.Lines = uint32(bytes.Count(e.body, []byte("\n")))
+	case bs.MimeType == "text":
+		bs.Lines = uint32(bytes.Count(e.body, []byte("\n")))
+	}
+
+	if extended {
+		if disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+			bs.Disposition = disp
+		}
+		for _, lang := range strings.Split(h.Get("Content-Language"), ",") {
+			if lang = strings.TrimSpace(lang); lang != "" {
+				bs.Language = append(bs.Language, lang)
+			}
+		}
+		if location := h.Get("Content-Location"); location != "" {
+			bs.Location = []string{location}
+		}
+		bs.Md5 = h.Get("Content-Md5")
+	}
+
+	return bs
+}
+
+// Get the body structure of a message. b is the whole message. If extended is
+// set to true, extension data is included (BODYSTRUCTURE instead of BODY).
+func FetchBodyStructure(b []byte, extended bool) *common.BodyStructure {
+	return bodyStructure(newEntity(b), extended)
+}
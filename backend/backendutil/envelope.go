@@ -0,0 +1,81 @@
+package backendutil
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-imap/common"
+)
+
+func parseAddress(addr *mail.Address) *common.Address {
+	mailbox, host := addr.Address, ""
+	if i := strings.LastIndex(addr.Address, "@"); i >= 0 {
+		mailbox, host = addr.Address[:i], addr.Address[i+1:]
+	}
+
+	return &common.Address{
+		PersonalName: addr.Name,
+		MailboxName: mailbox,
+		HostName: host,
+	}
+}
+
+// Parse an address list header. Invalid addresses are skipped.
+func parseAddressList(s string) (addrs []*common.Address) {
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+
+	list, err := mail.ParseAddressList(s)
+	if err != nil {
+		// Try to parse each address on its own, so that a single malformed
+		// address doesn't discard the whole list
+		for _, part := range strings.Split(s, ",") {
+			if addr, err := mail.ParseAddress(part); err == nil {
+				list = append(list, addr)
+			}
+		}
+	}
+
+	for _, addr := range list {
+		addrs = append(addrs, parseAddress(addr))
+	}
+	return
+}
+
+func envelope(h textproto.MIMEHeader) *common.Envelope {
+	env := &common.Envelope{
+		Subject: decodeHeader(h.Get("Subject")),
+		From: parseAddressList(h.Get("From")),
+		Sender: parseAddressList(h.Get("Sender")),
+		ReplyTo: parseAddressList(h.Get("Reply-To")),
+		To: parseAddressList(h.Get("To")),
+		Cc: parseAddressList(h.Get("Cc")),
+		Bcc: parseAddressList(h.Get("Bcc")),
+		InReplyTo: h.Get("In-Reply-To"),
+		MessageId: h.Get("Message-Id"),
+	}
+
+	if date, err := mail.ParseDate(h.Get("Date")); err == nil {
+		env.Date = &date
+	}
+
+	// See RFC 3501 page 77: if the Sender or Reply-To lines are absent in the
+	// header, or are present but empty, the server sets the corresponding
+	// member of the envelope to be the same value as the from member
+	if len(env.Sender) == 0 {
+		env.Sender = env.From
+	}
+	if len(env.ReplyTo) == 0 {
+		env.ReplyTo = env.From
+	}
+
+	return env
+}
+
+// Get the envelope of a message. b is the whole message.
+func FetchEnvelope(b []byte) *common.Envelope {
+	header, _ := splitMessage(b)
+	return envelope(readHeader(header))
+}
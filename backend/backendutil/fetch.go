@@ -0,0 +1,66 @@
+package backendutil
+
+import (
+	"github.com/emersion/go-imap/common"
+)
+
+// Check if fetching items requires the message's contents. UID, FLAGS and
+// INTERNALDATE don't.
+func FetchNeedsBody(items []string) bool {
+	for _, item := range items {
+		switch item {
+		case "UID", "FLAGS", "INTERNALDATE":
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch the requested items of a message. msg must have its SeqNum, Uid, Flags
+// and InternalDate fields set, b is the whole message.
+//
+// Body sections that cannot be found are set to nil.
+func FetchMessage(msg *common.Message, b []byte, items []string) *common.Message {
+	fetched := &common.Message{
+		SeqNum: msg.SeqNum,
+		Body: map[*common.BodySectionName]*common.Literal{},
+	}
+
+	for _, item := range items {
+		switch item {
+		case "ENVELOPE":
+			fetched.Envelope = FetchEnvelope(b)
+		case "BODYSTRUCTURE":
+			fetched.BodyStructure = FetchBodyStructure(b, true)
+		case "BODY":
+			fetched.BodyStructure = FetchBodyStructure(b, false)
+		case "FLAGS":
+			fetched.Flags = msg.Flags
+		case "INTERNALDATE":
+			fetched.InternalDate = msg.InternalDate
+		case "RFC822.SIZE":
+			fetched.Size = uint32(len(b))
+		case "UID":
+			fetched.Uid = msg.Uid
+		default:
+			section, err := common.NewBodySectionName(item)
+			item = ""
+			if err != nil {
+				break
+			}
+
+			var literal *common.Literal
+			if body, err := FetchBodySection(b, section); err == nil {
+				literal = common.NewLiteral(section.ExtractPartial(body))
+			}
+			fetched.Body[section] = literal
+		}
+
+		if item != "" {
+			fetched.Items = append(fetched.Items, item)
+		}
+	}
+
+	return fetched
+}
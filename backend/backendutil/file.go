@@ -0,0 +1,72 @@
+package backendutil
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Atomically replace a file: readers either see the old contents or the new
+// ones, never a partially written file.
+func WriteFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	// Make sure the contents are on disk before the rename, otherwise a crash
+	// could leave an empty file behind
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// How long to wait for a lock, and after how long a lock is considered stale.
+const (
+	lockTimeout = 10 * time.Second
+	lockStale = 2 * time.Minute
+)
+
+// Acquire a dotlock on a file, so that other processes don't modify it at the
+// same time. The lock file is path with a ".lock" suffix, as used by most mail
+// delivery agents.
+func LockFile(path string) (unlock func(), err error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.WriteString(strconv.Itoa(os.Getpid()))
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > lockStale {
+			os.Remove(lock)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timeout while waiting for lock " + lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
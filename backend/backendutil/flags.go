@@ -0,0 +1,53 @@
+package backendutil
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// Check if a flag is in a list of flags. Flags are case-insensitive.
+func HasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply a STORE operation to a list of flags and return the new list. current
+// is left untouched. \Recent cannot be altered by clients: it is kept if it is
+// present and never added.
+func UpdateFlags(current []string, op common.FlagsOp, flags []string) []string {
+	var updated []string
+
+	switch op {
+	case common.SetFlags:
+		if HasFlag(current, common.RecentFlag) {
+			updated = append(updated, common.RecentFlag)
+		}
+		for _, flag := range flags {
+			if !HasFlag(updated, flag) && !strings.EqualFold(flag, common.RecentFlag) {
+				updated = append(updated, flag)
+			}
+		}
+	case common.AddFlags:
+		updated = append(updated, current...)
+		for _, flag := range flags {
+			if !HasFlag(updated, flag) && !strings.EqualFold(flag, common.RecentFlag) {
+				updated = append(updated, flag)
+			}
+		}
+	case common.RemoveFlags:
+		for _, flag := range current {
+			if !HasFlag(flags, flag) || strings.EqualFold(flag, common.RecentFlag) {
+				updated = append(updated, flag)
+			}
+		}
+	default:
+		updated = append(updated, current...)
+	}
+
+	return updated
+}
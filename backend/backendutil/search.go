@@ -0,0 +1,193 @@
+package backendutil
+
+import (
+	"bytes"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// Truncate a time to a date, ignoring the time and the timezone.
+func truncateDate(t *time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Check if a message matches some search criteria. msg must have its SeqNum,
+// Uid, Flags and InternalDate fields set, b is the whole message. max and
+// maxUid are the largest sequence number and UID in the mailbox, they are used
+// to resolve "*".
+func Match(msg *common.Message, b []byte, max, maxUid uint32, c *common.SearchCriteria) bool {
+	if c.SeqSet != nil && !SeqSetContains(c.SeqSet, msg.SeqNum, max) {
+		return false
+	}
+	if c.Uid != nil && !SeqSetContains(c.Uid, msg.Uid, maxUid) {
+		return false
+	}
+
+	if !matchFlags(msg.Flags, c) {
+		return false
+	}
+
+	if c.Larger != 0 && uint32(len(b)) <= c.Larger {
+		return false
+	}
+	if c.Smaller != 0 && uint32(len(b)) >= c.Smaller {
+		return false
+	}
+
+	if c.Before != nil || c.On != nil || c.Since != nil {
+		if msg.InternalDate == nil {
+			return false
+		}
+
+		date := truncateDate(msg.InternalDate)
+		if c.Before != nil && !date.Before(truncateDate(c.Before)) {
+			return false
+		}
+		if c.On != nil && !date.Equal(truncateDate(c.On)) {
+			return false
+		}
+		if c.Since != nil && date.Before(truncateDate(c.Since)) {
+			return false
+		}
+	}
+
+	header, body := splitMessage(b)
+	if !matchHeader(header, c) {
+		return false
+	}
+
+	if c.Body != "" && !bytes.Contains(bytes.ToLower(body), []byte(strings.ToLower(c.Body))) {
+		return false
+	}
+	if c.Text != "" && !bytes.Contains(bytes.ToLower(b), []byte(strings.ToLower(c.Text))) {
+		return false
+	}
+
+	if c.Not != nil && Match(msg, b, max, maxUid, c.Not) {
+		return false
+	}
+	if c.Or[0] != nil && c.Or[1] != nil {
+		if !Match(msg, b, max, maxUid, c.Or[0]) && !Match(msg, b, max, maxUid, c.Or[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Check if matching criteria requires the message's contents. If not, Match
+// can be called with a nil message.
+func MatchNeedsBody(c *common.SearchCriteria) bool {
+	if c.Larger != 0 || c.Smaller != 0 || c.Body != "" || c.Text != "" {
+		return true
+	}
+	if c.Bcc != "" || c.Cc != "" || c.From != "" || c.Subject != "" || c.To != "" || c.Header[0] != "" {
+		return true
+	}
+	if c.SentBefore != nil || c.SentOn != nil || c.SentSince != nil {
+		return true
+	}
+
+	if c.Not != nil && MatchNeedsBody(c.Not) {
+		return true
+	}
+	for _, or := range c.Or {
+		if or != nil && MatchNeedsBody(or) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchFlags(flags []string, c *common.SearchCriteria) bool {
+	has := func(flag string) bool {
+		return HasFlag(flags, flag)
+	}
+
+	checks := []struct{
+		set bool
+		ok bool
+	}{
+		{c.Answered, has(common.AnsweredFlag)},
+		{c.Deleted, has(common.DeletedFlag)},
+		{c.Draft, has(common.DraftFlag)},
+		{c.Flagged, has(common.FlaggedFlag)},
+		{c.Recent, has(common.RecentFlag)},
+		{c.Seen, has(common.SeenFlag)},
+		{c.New, has(common.RecentFlag) && !has(common.SeenFlag)},
+		{c.Old, !has(common.RecentFlag)},
+		{c.Unanswered, !has(common.AnsweredFlag)},
+		{c.Undeleted, !has(common.DeletedFlag)},
+		{c.Undraft, !has(common.DraftFlag)},
+		{c.Unflagged, !has(common.FlaggedFlag)},
+		{c.Unseen, !has(common.SeenFlag)},
+		{c.Keyword != "", has(c.Keyword)},
+		{c.Unkeyword != "", !has(c.Unkeyword)},
+	}
+
+	for _, check := range checks {
+		if check.set && !check.ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHeader(header []byte, c *common.SearchCriteria) bool {
+	h := readHeader(header)
+
+	fields := []struct{
+		name string
+		value string
+	}{
+		{"Bcc", c.Bcc},
+		{"Cc", c.Cc},
+		{"From", c.From},
+		{"Subject", c.Subject},
+		{"To", c.To},
+	}
+	for _, f := range fields {
+		if f.value != "" && !containsFold(decodeHeader(strings.Join(h[f.name], ", ")), f.value) {
+			return false
+		}
+	}
+
+	if c.Header[0] != "" {
+		values, ok := h[textproto.CanonicalMIMEHeaderKey(c.Header[0])]
+		if !ok {
+			return false
+		}
+		if c.Header[1] != "" && !containsFold(decodeHeader(strings.Join(values, ", ")), c.Header[1]) {
+			return false
+		}
+	}
+
+	if c.SentBefore != nil || c.SentOn != nil || c.SentSince != nil {
+		t, err := mail.ParseDate(h.Get("Date"))
+		if err != nil {
+			return false
+		}
+
+		date := truncateDate(&t)
+		if c.SentBefore != nil && !date.Before(truncateDate(c.SentBefore)) {
+			return false
+		}
+		if c.SentOn != nil && !date.Equal(truncateDate(c.SentOn)) {
+			return false
+		}
+		if c.SentSince != nil && date.Before(truncateDate(c.SentSince)) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,177 @@
+package backendutil
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-imap/common"
+)
+
+var errNoSuchPart = errors.New("backendutil: no such message body part")
+
+// A message entity: either the whole message or one of its MIME parts.
+type entity struct {
+	header []byte
+	body []byte
+}
+
+func newEntity(b []byte) *entity {
+	header, body := splitMessage(b)
+	return &entity{header, body}
+}
+
+// Get this entity's media type and parameters. If the entity doesn't have a
+// valid Content-Type header, text/plain is assumed, as stated in RFC 2045
+// section 5.2.
+func (e *entity) mediaType() (string, map[string]string) {
+	h := readHeader(e.header)
+
+	t, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.Contains(t, "/") {
+		return "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	return t, params
+}
+
+func (e *entity) isMultipart() bool {
+	t, _ := e.mediaType()
+	return strings.HasPrefix(t, "multipart/")
+}
+
+func (e *entity) isMessage() bool {
+	t, _ := e.mediaType()
+	return t == "message/rfc822"
+}
+
+// Get the children of a multipart entity.
+func (e *entity) children() []*entity {
+	_, params := e.mediaType()
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil
+	}
+
+	delim := []byte("--" + boundary)
+	var children []*entity
+	start := -1
+	for i := 0; i < len(e.body); {
+		end := len(e.body)
+		if j := bytes.IndexByte(e.body[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+
+		line := bytes.TrimRight(e.body[i:end], " \t\r\n")
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			closing := bytes.Equal(rest, []byte("--"))
+			if len(rest) == 0 || closing {
+				if start >= 0 {
+					// The line break preceding the delimiter is part of it
+					children = append(children, newEntity(trimNewline(e.body[start:i])))
+				}
+				if closing {
+					break
+				}
+				start = end
+			}
+		}
+
+		i = end
+	}
+
+	return children
+}
+
+func trimNewline(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		return b[:len(b)-2]
+	}
+	if bytes.HasSuffix(b, []byte("\n")) {
+		return b[:len(b)-1]
+	}
+	return b
+}
+
+// Get the child of an entity with the specified index. Indexes start at 1.
+func (e *entity) child(index int) (*entity, error) {
+	if e.isMultipart() {
+		children := e.children()
+		if index < 1 || index > len(children) {
+			return nil, errNoSuchPart
+		}
+		return children[index-1], nil
+	}
+
+	// A non-multipart entity has only one part: itself
+	if index == 1 {
+		return e, nil
+	}
+	return nil, errNoSuchPart
+}
+
+// Get the entity with the specified path. See RFC 3501 page 56.
+func (e *entity) part(path []int) (*entity, error) {
+	var err error
+	for i, index := range path {
+		if i > 0 && e.isMessage() {
+			// Parts of a message/rfc822 part are the parts of the encapsulated
+			// message
+			e = newEntity(e.body)
+		}
+
+		if e, err = e.child(index); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// Fetch a body section of a message. b is the whole message. The partial
+// specified in the section name is not applied.
+func FetchBodySection(b []byte, section *common.BodySectionName) ([]byte, error) {
+	e := newEntity(b)
+
+	var part *common.BodyPartName
+	if section.BodyPartName != nil {
+		part = section.BodyPartName
+	} else {
+		part = &common.BodyPartName{}
+	}
+
+	if len(part.Path) > 0 {
+		var err error
+		if e, err = e.part(part.Path); err != nil {
+			return nil, err
+		}
+
+		switch part.Specifier {
+		case common.EntireSpecifier:
+			return e.body, nil
+		case common.MimeSpecifier:
+			return e.header, nil
+		}
+
+		// HEADER and TEXT refer to the encapsulated message of a message/rfc822
+		// part
+		if !e.isMessage() {
+			return nil, errNoSuchPart
+		}
+		e = newEntity(e.body)
+	}
+
+	switch part.Specifier {
+	case common.EntireSpecifier:
+		return b, nil
+	case common.HeaderSpecifier:
+		if len(part.Fields) > 0 {
+			return filterHeader(e.header, part.Fields, part.NotFields), nil
+		}
+		return e.header, nil
+	case common.TextSpecifier:
+		return e.body, nil
+	}
+
+	return nil, errors.New("backendutil: unsupported body section specifier: " + part.Specifier)
+}
@@ -0,0 +1,31 @@
+package backendutil
+
+import (
+	"github.com/emersion/go-imap/common"
+)
+
+// Check if a sequence number or a UID is in a sequence set. max is the largest
+// sequence number or UID in the mailbox, it is used to resolve "*".
+func SeqSetContains(seqset *common.SeqSet, id, max uint32) bool {
+	if id == 0 {
+		return false
+	}
+
+	for _, seq := range seqset.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+
+		if id >= start && id <= stop {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package backendutil
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// A message as seen by clients.
+type MessageState struct {
+	Uid uint32
+	Flags []string
+}
+
+func equalFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	set := map[string]bool{}
+	for _, flag := range a {
+		set[flag] = true
+	}
+	for _, flag := range b {
+		if !set[flag] {
+			return false
+		}
+	}
+	return true
+}
+
+// Compute the updates to send to clients when the messages of a mailbox change
+// from old to current. Both lists must be sorted by UID. u is the user and the
+// mailbox targeted by the updates. Messages are addressed by UID, see
+// backend.Updates.
+func DiffMessages(u backend.Update, old, current []MessageState) []interface{} {
+	var updates []interface{}
+
+	byUid := map[uint32]MessageState{}
+	for _, msg := range old {
+		byUid[msg.Uid] = msg
+	}
+
+	kept := map[uint32]bool{}
+	var flags []interface{}
+	var added []uint32
+	for _, msg := range current {
+		prev, ok := byUid[msg.Uid]
+		if !ok {
+			added = append(added, msg.Uid)
+			continue
+		}
+
+		kept[msg.Uid] = true
+		if !equalFlags(prev.Flags, msg.Flags) {
+			flags = append(flags, &backend.FlagsUpdate{
+				Update: u,
+				Uid: msg.Uid,
+				Flags: msg.Flags,
+			})
+		}
+	}
+
+	var expunged []uint32
+	for _, msg := range old {
+		if !kept[msg.Uid] {
+			expunged = append(expunged, msg.Uid)
+		}
+	}
+
+	if len(expunged) > 0 {
+		updates = append(updates, &backend.UidExpungeUpdate{Update: u, Uids: expunged})
+	}
+	updates = append(updates, flags...)
+	if len(added) > 0 {
+		updates = append(updates, &backend.AddedUpdate{Update: u, Uids: added})
+	}
+
+	return updates
+}
+
+// An UpdateQueue sends backend updates in order, without blocking the caller.
+// Backends can push updates while holding locks, and call Flush once they're
+// released: updates are then sent without blocking other operations.
+type UpdateQueue struct {
+	updates *backend.Updates
+
+	locker sync.Mutex
+	pending []interface{}
+	sending bool
+	// The number of updates pushed and sent so far
+	pushed, sent uint64
+	// Signaled when updates are sent
+	cond *sync.Cond
+}
+
+// Create a new queue sending updates to the channels of updates.
+func NewUpdateQueue(updates *backend.Updates) *UpdateQueue {
+	q := &UpdateQueue{updates: updates}
+	q.cond = sync.NewCond(&q.locker)
+	return q
+}
+
+// Queue updates. Each update must be a pointer to one of the update types of
+// package backend, e.g. *backend.FlagsUpdate.
+func (q *UpdateQueue) Push(updates ...interface{}) {
+	if len(updates) == 0 {
+		return
+	}
+
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	q.pending = append(q.pending, updates...)
+	q.pushed += uint64(len(updates))
+	if !q.sending {
+		q.sending = true
+		go q.send()
+	}
+}
+
+func (q *UpdateQueue) send() {
+	for {
+		q.locker.Lock()
+		if len(q.pending) == 0 {
+			q.sending = false
+			q.locker.Unlock()
+			return
+		}
+		update := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.locker.Unlock()
+
+		q.sendUpdate(update)
+
+		q.locker.Lock()
+		q.sent++
+		q.cond.Broadcast()
+		q.locker.Unlock()
+	}
+}
+
+// Flush waits for all updates pushed so far to be sent. The server must
+// receive the updates caused by a command before the command completes, so
+// backends call Flush before returning, after releasing their locks.
+func (q *UpdateQueue) Flush() {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	pushed := q.pushed
+	for q.sent < pushed {
+		q.cond.Wait()
+	}
+}
+
+func (q *UpdateQueue) sendUpdate(update interface{}) {
+	updates := q.updates
+
+	switch update := update.(type) {
+	case *backend.StatusUpdate:
+		if updates.Statuses != nil {
+			updates.Statuses <- update
+		}
+	case *backend.MailboxUpdate:
+		if updates.Mailboxes != nil {
+			updates.Mailboxes <- update
+		}
+	case *backend.MessageUpdate:
+		if updates.Messages != nil {
+			updates.Messages <- update
+		}
+	case *backend.ExpungeUpdate:
+		if updates.Expunges != nil {
+			updates.Expunges <- update
+		}
+	case *backend.FlagsUpdate:
+		if updates.Flags != nil {
+			updates.Flags <- update
+		}
+	case *backend.AddedUpdate:
+		if updates.Added != nil {
+			updates.Added <- update
+		}
+	case *backend.UidExpungeUpdate:
+		if updates.UidExpunges != nil {
+			updates.UidExpunges <- update
+		}
+	case *backend.RenameUpdate:
+		if updates.Renames != nil {
+			updates.Renames <- update
+		}
+	case *backend.DeleteUpdate:
+		if updates.Deletes != nil {
+			updates.Deletes <- update
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// A backend storing users, mailboxes and messages in a bbolt database.
+//
+// All changes are done in transactions, so the database is always left in a
+// consistent state, even if the process crashes. Message bodies are stored
+// once and shared between copies.
+package bolt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The hierarchy delimiter.
+const Delimiter = "/"
+
+type Backend struct {
+	db *bbolt.DB
+	updates *backend.Updates
+}
+
+func (bkd *Backend) Login(username, password string) (backend.User, error) {
+	var hash []byte
+	err := bkd.db.View(func(tx *bbolt.Tx) error {
+		u, err := userBucket(tx, username)
+		if err != nil {
+			return err
+		}
+
+		hash = append(hash, u.Get(passwordKey)...)
+		return nil
+	})
+	if err == errNoSuchUser {
+		return nil, errors.New("Bad username or password")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return nil, errors.New("Bad username or password")
+	}
+
+	return &User{username: username, backend: bkd}, nil
+}
+
+func (bkd *Backend) Updates() *backend.Updates {
+	return bkd.updates
+}
+
+// Create a new user with an empty INBOX.
+func (bkd *Backend) CreateUser(username, password string) error {
+	if username == "" {
+		return errors.New("Invalid username")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return bkd.db.Update(func(tx *bbolt.Tx) error {
+		u, err := tx.Bucket(usersBucket).CreateBucket([]byte(username))
+		if err == bbolt.ErrBucketExists {
+			return errors.New("User already exists")
+		} else if err != nil {
+			return err
+		}
+
+		if err := u.Put(passwordKey, hash); err != nil {
+			return err
+		}
+
+		mailboxes, err := u.CreateBucket(mailboxesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = createMailbox(tx, mailboxes, "INBOX")
+		return err
+	})
+}
+
+// Change a user's password.
+func (bkd *Backend) SetPassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return bkd.db.Update(func(tx *bbolt.Tx) error {
+		u, err := userBucket(tx, username)
+		if err != nil {
+			return err
+		}
+		return u.Put(passwordKey, hash)
+	})
+}
+
+// Delete a user and all their mailboxes.
+func (bkd *Backend) DeleteUser(username string) error {
+	return bkd.db.Update(func(tx *bbolt.Tx) error {
+		u, err := userBucket(tx, username)
+		if err != nil {
+			return err
+		}
+
+		mailboxes := u.Bucket(mailboxesBucket)
+		err = mailboxes.ForEach(func(name, v []byte) error {
+			return releaseMailbox(tx, mailboxes.Bucket(name))
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(usersBucket).DeleteBucket([]byte(username))
+	})
+}
+
+// Close the database.
+func (bkd *Backend) Close() error {
+	return bkd.db.Close()
+}
+
+// Open a database, creating it if it doesn't exist. The database file is
+// locked, it cannot be used by other processes until the backend is closed.
+func Open(path string) (*Backend, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		buckets := [][]byte{metaBucket, blobsBucket, refsBucket, usersBucket}
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Backend{
+		db: db,
+		updates: &backend.Updates{
+			Statuses: make(chan *backend.StatusUpdate),
+			Mailboxes: make(chan *backend.MailboxUpdate),
+			Messages: make(chan *backend.MessageUpdate),
+			Expunges: make(chan *backend.ExpungeUpdate),
+			Flags: make(chan *backend.FlagsUpdate),
+			Added: make(chan *backend.AddedUpdate),
+			UidExpunges: make(chan *backend.UidExpungeUpdate),
+			Renames: make(chan *backend.RenameUpdate),
+			Deletes: make(chan *backend.DeleteUpdate),
+		},
+	}, nil
+}
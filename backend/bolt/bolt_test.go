@@ -0,0 +1,263 @@
+package bolt_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/bolt"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/internal"
+)
+
+type testBackend struct {
+	*bolt.Backend
+	done chan struct{}
+}
+
+func openBackend(t *testing.T, path string) *testBackend {
+	bkd, err := bolt.Open(path)
+	if err != nil {
+		t.Fatal("Cannot open database:", err)
+	}
+
+	done := make(chan struct{})
+	go internal.DiscardUpdates(bkd.Updates(), done)
+	return &testBackend{bkd, done}
+}
+
+func (bkd *testBackend) Close() error {
+	close(bkd.done)
+	return bkd.Backend.Close()
+}
+
+func bodies(t *testing.T, mbox backend.Mailbox) []string {
+	var bodies []string
+	for _, msg := range internal.ListMessages(t, mbox, []string{"BODY[]"}) {
+		for _, literal := range msg.Body {
+			if literal == nil {
+				t.Fatal("Missing message body")
+			}
+			bodies = append(bodies, literal.String())
+		}
+	}
+	return bodies
+}
+
+func tempPath(t *testing.T) (path string, dir string) {
+	dir = internal.TempDir(t, "go-imap-bolt")
+	return filepath.Join(dir, "imap.db"), dir
+}
+
+func TestBackend_reopen(t *testing.T) {
+	path, dir := tempPath(t)
+	defer os.RemoveAll(dir)
+
+	bkd := openBackend(t, path)
+	if err := bkd.CreateUser("username", "password"); err != nil {
+		t.Fatal("Cannot create user:", err)
+	}
+
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	for _, body := range []string{"Subject: first\r\n\r\n", "Subject: second\r\n\r\n", "Subject: third\r\n\r\n"} {
+		if err := mbox.CreateMessage(nil, nil, []byte(body)); err != nil {
+			t.Fatal("Cannot create message:", err)
+		}
+	}
+
+	seqset, _ := common.NewSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(false, seqset, common.AddFlags, []string{common.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := mbox.Status([]string{common.MailboxUidValidity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validity := status.UidValidity
+
+	if err := bkd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bkd = openBackend(t, path)
+	defer bkd.Close()
+
+	mbox = internal.GetMailbox(t, bkd, "INBOX")
+	if uids := internal.ListUids(t, mbox); !reflect.DeepEqual(uids, []uint32{1, 3}) {
+		t.Errorf("Bad UIDs after reopening: got %v, want [1 3]", uids)
+	}
+	if b := bodies(t, mbox); !reflect.DeepEqual(b, []string{"Subject: first\r\n\r\n", "Subject: third\r\n\r\n"}) {
+		t.Errorf("Bad bodies after reopening: %q", b)
+	}
+
+	status, err = mbox.Status([]string{common.MailboxUidValidity, common.MailboxUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UidValidity != validity {
+		t.Errorf("UIDVALIDITY changed: got %v, want %v", status.UidValidity, validity)
+	}
+	if status.UidNext != 4 {
+		t.Errorf("Bad UIDNEXT: got %v, want 4", status.UidNext)
+	}
+}
+
+func TestMailbox_CopyMessages(t *testing.T) {
+	path, dir := tempPath(t)
+	defer os.RemoveAll(dir)
+
+	bkd := openBackend(t, path)
+	defer bkd.Close()
+
+	if err := bkd.CreateUser("username", "password"); err != nil {
+		t.Fatal("Cannot create user:", err)
+	}
+	u, _ := bkd.Login("username", "password")
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	inbox := internal.GetMailbox(t, bkd, "INBOX")
+	body := "Subject: Shared\r\n\r\nHi"
+	inbox.CreateMessage([]string{common.SeenFlag}, nil, []byte(body))
+
+	// A failed copy must not leave any message behind
+	seqset, _ := common.NewSeqSet("1:*")
+	if err := inbox.CopyMessages(false, seqset, "Nonexistent"); err == nil {
+		t.Error("Expected an error when copying to a nonexistent mailbox")
+	}
+
+	if err := inbox.CopyMessages(false, seqset, "Archive"); err != nil {
+		t.Fatal("Cannot copy messages:", err)
+	}
+
+	// The body is shared between copies, it must be kept until the last one is
+	// expunged
+	inbox.UpdateMessagesFlags(false, seqset, common.AddFlags, []string{common.DeletedFlag})
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	if uids := internal.ListUids(t, inbox); len(uids) != 0 {
+		t.Errorf("Messages not expunged: %v", uids)
+	}
+
+	archive := internal.GetMailbox(t, bkd, "Archive")
+	if b := bodies(t, archive); !reflect.DeepEqual(b, []string{body}) {
+		t.Errorf("Bad bodies in copy: %q", b)
+	}
+	messages := internal.ListMessages(t, archive, []string{"UID", "FLAGS"})
+	if len(messages) != 1 || messages[0].Uid != 1 || !reflect.DeepEqual(messages[0].Flags, []string{common.SeenFlag}) {
+		t.Errorf("Bad copied message: %+v", messages)
+	}
+}
+
+func TestBackend_locked(t *testing.T) {
+	path, dir := tempPath(t)
+	defer os.RemoveAll(dir)
+
+	bkd := openBackend(t, path)
+	defer bkd.Close()
+
+	// The database can only be used by one process at a time
+	if other, err := bolt.Open(path); err == nil {
+		other.Close()
+		t.Error("Expected an error when opening a database already in use")
+	}
+}
+
+func TestUser_RenameMailbox_rollback(t *testing.T) {
+	path, dir := tempPath(t)
+	defer os.RemoveAll(dir)
+
+	bkd := openBackend(t, path)
+	defer bkd.Close()
+
+	if err := bkd.CreateUser("username", "password"); err != nil {
+		t.Fatal("Cannot create user:", err)
+	}
+	u, _ := bkd.Login("username", "password")
+	for _, name := range []string{"Work/Projects", "Archive/Projects"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	work := internal.GetMailbox(t, bkd, "Work")
+	body := "Subject: Hi\r\n\r\n"
+	if err := work.CreateMessage(nil, nil, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Work is renamed before Work/Projects fails to be renamed, since
+	// Archive/Projects exists: nothing must be changed
+	if err := u.RenameMailbox("Work", "Archive"); err == nil {
+		t.Fatal("Expected an error when renaming to an existing inferior")
+	}
+
+	list, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range list {
+		names = append(names, m.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"Archive/Projects", "INBOX", "Work", "Work/Projects"}) {
+		t.Errorf("Bad mailboxes after a failed rename: %v", names)
+	}
+
+	work = internal.GetMailbox(t, bkd, "Work")
+	if b := bodies(t, work); !reflect.DeepEqual(b, []string{body}) {
+		t.Errorf("Bad bodies after a failed rename: %q", b)
+	}
+}
+
+func TestBackend_crash(t *testing.T) {
+	path, dir := tempPath(t)
+	defer os.RemoveAll(dir)
+
+	bkd := openBackend(t, path)
+	defer bkd.Close()
+
+	if err := bkd.CreateUser("username", "password"); err != nil {
+		t.Fatal("Cannot create user:", err)
+	}
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	body := "Subject: Hi\r\n\r\n"
+	if err := mbox.CreateMessage([]string{common.SeenFlag}, nil, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Committed operations are written to disk, the database is usable without
+	// being closed, as if the process had crashed
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed := filepath.Join(dir, "crashed.db")
+	if err := ioutil.WriteFile(crashed, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	other := openBackend(t, crashed)
+	defer other.Close()
+
+	mbox = internal.GetMailbox(t, other, "INBOX")
+	if b := bodies(t, mbox); !reflect.DeepEqual(b, []string{body}) {
+		t.Errorf("Bad bodies after a crash: %q", b)
+	}
+	messages := internal.ListMessages(t, mbox, []string{"UID", "FLAGS"})
+	if len(messages) != 1 || messages[0].Uid != 1 || !reflect.DeepEqual(messages[0].Flags, []string{common.SeenFlag}) {
+		t.Errorf("Bad message after a crash: %+v", messages)
+	}
+}
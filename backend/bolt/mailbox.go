@@ -0,0 +1,451 @@
+package bolt
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/common"
+	"go.etcd.io/bbolt"
+)
+
+var systemFlags = []string{
+	common.AnsweredFlag,
+	common.FlaggedFlag,
+	common.DeletedFlag,
+	common.SeenFlag,
+	common.DraftFlag,
+}
+
+type Mailbox struct {
+	name string
+	user *User
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*common.MailboxInfo, error) {
+	info := &common.MailboxInfo{
+		Delimiter: Delimiter,
+		Name: mbox.name,
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) update() backend.Update {
+	return backend.Update{Username: mbox.user.username, Mailbox: mbox.name}
+}
+
+func (mbox *Mailbox) view(f func(tx *bbolt.Tx, b *bbolt.Bucket) error) error {
+	return mbox.user.backend.db.View(func(tx *bbolt.Tx) error {
+		b, err := mailboxBucket(tx, mbox.user.username, mbox.name)
+		if err != nil {
+			return err
+		}
+		return f(tx, b)
+	})
+}
+
+func (mbox *Mailbox) updateTx(f func(tx *bbolt.Tx, b *bbolt.Bucket) error) error {
+	return mbox.user.backend.db.Update(func(tx *bbolt.Tx) error {
+		b, err := mailboxBucket(tx, mbox.user.username, mbox.name)
+		if err != nil {
+			return err
+		}
+		return f(tx, b)
+	})
+}
+
+func countMessages(messages *bbolt.Bucket) uint32 {
+	var n uint32
+	c := messages.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+// Iterate over the messages matching a sequence set. f is called with each
+// message's sequence number, UID and record.
+func forEachMessage(messages *bbolt.Bucket, uid bool, seqset *common.SeqSet, f func(seqNum, uid uint32, rec *messageRecord) error) error {
+	var max uint32
+	if uid {
+		k, _ := messages.Cursor().Last()
+		max = btoi(k)
+	} else {
+		max = countMessages(messages)
+	}
+
+	var seqNum uint32
+	return messages.ForEach(func(k, v []byte) error {
+		seqNum++
+
+		id := seqNum
+		if uid {
+			id = btoi(k)
+		}
+		if !backendutil.SeqSetContains(seqset, id, max) {
+			return nil
+		}
+
+		rec, err := getRecord(v)
+		if err != nil {
+			return err
+		}
+		return f(seqNum, btoi(k), rec)
+	})
+}
+
+func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
+	status := &common.MailboxStatus{
+		Items: items,
+		Name: mbox.name,
+		Flags: systemFlags,
+		PermanentFlags: append(append([]string(nil), systemFlags...), "\\*"),
+	}
+
+	err := mbox.view(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		messages := b.Bucket(messagesBucket)
+
+		for _, name := range items {
+			switch name {
+			case common.MailboxMessages:
+				status.Messages = countMessages(messages)
+			case common.MailboxUidNext:
+				status.UidNext = btoi(b.Get(uidNextKey))
+			case common.MailboxUidValidity:
+				status.UidValidity = btoi(b.Get(uidValidityKey))
+			case common.MailboxRecent:
+				status.Recent = 0
+			case common.MailboxUnseen:
+				status.Unseen = 0
+				err := messages.ForEach(func(k, v []byte) error {
+					rec, err := getRecord(v)
+					if err != nil {
+						return err
+					}
+					if !backendutil.HasFlag(rec.Flags, common.SeenFlag) {
+						status.Unseen++
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+func (mbox *Mailbox) setSubscribed(subscribed bool) error {
+	return mbox.updateTx(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		if subscribed {
+			return b.Put(subscribedKey, []byte{1})
+		}
+		return b.Delete(subscribedKey)
+	})
+}
+
+func (mbox *Mailbox) Subscribe() error {
+	return mbox.setSubscribed(true)
+}
+
+func (mbox *Mailbox) Unsubscribe() error {
+	return mbox.setSubscribed(false)
+}
+
+func (mbox *Mailbox) Check() error {
+	return nil
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	defer close(ch)
+
+	// Messages are sent once the transaction is closed, so that slow clients
+	// don't keep it open
+	var messages []*common.Message
+	err := mbox.view(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		return forEachMessage(b.Bucket(messagesBucket), uid, seqset, func(seqNum, uid uint32, rec *messageRecord) error {
+			msg := &common.Message{
+				SeqNum: seqNum,
+				Body: map[*common.BodySectionName]*common.Literal{},
+			}
+
+			for _, item := range items {
+				switch item {
+				case "ENVELOPE":
+					msg.Envelope = rec.Envelope
+				case "BODYSTRUCTURE", "BODY":
+					msg.BodyStructure = rec.BodyStructure
+				case "FLAGS":
+					msg.Flags = rec.Flags
+				case "INTERNALDATE":
+					msg.InternalDate = &rec.InternalDate
+				case "RFC822.SIZE":
+					msg.Size = rec.Size
+				case "UID":
+					msg.Uid = uid
+				default:
+					section, err := common.NewBodySectionName(item)
+					item = ""
+					if err != nil {
+						break
+					}
+
+					// If part doesn't exist, set the literal to nil
+					var literal *common.Literal
+					if body, err := backendutil.FetchBodySection(getBlob(tx, rec.Blob), section); err == nil {
+						// The blob is only valid during the transaction
+						body = append([]byte(nil), section.ExtractPartial(body)...)
+						literal = common.NewLiteral(body)
+					}
+					msg.Body[section] = literal
+				}
+
+				if item != "" {
+					msg.Items = append(msg.Items, item)
+				}
+			}
+
+			messages = append(messages, msg)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		ch <- msg
+	}
+	return nil
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *common.SearchCriteria) (ids []uint32, err error) {
+	err = mbox.view(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		messages := b.Bucket(messagesBucket)
+
+		max := countMessages(messages)
+		k, _ := messages.Cursor().Last()
+		maxUid := btoi(k)
+
+		var seqNum uint32
+		return messages.ForEach(func(k, v []byte) error {
+			seqNum++
+
+			rec, err := getRecord(v)
+			if err != nil {
+				return err
+			}
+
+			msgUid := btoi(k)
+			msg := &common.Message{
+				SeqNum: seqNum,
+				Uid: msgUid,
+				Flags: rec.Flags,
+				InternalDate: &rec.InternalDate,
+			}
+			if !backendutil.Match(msg, getBlob(tx, rec.Blob), max, maxUid, criteria) {
+				return nil
+			}
+
+			if uid {
+				ids = append(ids, msgUid)
+			} else {
+				ids = append(ids, seqNum)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// Append a message to a mailbox, and return its UID.
+func appendMessage(tx *bbolt.Tx, b *bbolt.Bucket, rec *messageRecord) (uint32, error) {
+	messages := b.Bucket(messagesBucket)
+
+	uid := btoi(b.Get(uidNextKey))
+	if err := b.Put(uidNextKey, itob(uid + 1)); err != nil {
+		return 0, err
+	}
+	if err := putRecord(messages, uid, rec); err != nil {
+		return 0, err
+	}
+
+	return uid, nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date *time.Time, body []byte) error {
+	if date == nil {
+		now := time.Now()
+		date = &now
+	}
+
+	rec := &messageRecord{
+		Flags: backendutil.UpdateFlags(nil, common.SetFlags, flags),
+		InternalDate: *date,
+		Size: uint32(len(body)),
+		Envelope: backendutil.FetchEnvelope(body),
+		BodyStructure: backendutil.FetchBodyStructure(body, true),
+	}
+
+	var uid uint32
+	err := mbox.updateTx(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		var err error
+		if rec.Blob, err = putBlob(tx, body); err != nil {
+			return err
+		}
+
+		uid, err = appendMessage(tx, b, rec)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	mbox.user.backend.updates.Added <- &backend.AddedUpdate{
+		Update: mbox.update(),
+		Uids: []uint32{uid},
+	}
+	return nil
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op common.FlagsOp, flags []string) error {
+	var updated []*backend.FlagsUpdate
+	err := mbox.updateTx(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		messages := b.Bucket(messagesBucket)
+
+		type change struct {
+			uid uint32
+			rec *messageRecord
+		}
+
+		// Buckets must not be modified while iterating over them
+		var changes []change
+		err := forEachMessage(messages, uid, seqset, func(seqNum, uid uint32, rec *messageRecord) error {
+			rec.Flags = backendutil.UpdateFlags(rec.Flags, op, flags)
+			changes = append(changes, change{uid, rec})
+
+			updated = append(updated, &backend.FlagsUpdate{
+				Update: mbox.update(),
+				Uid: uid,
+				Flags: rec.Flags,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, c := range changes {
+			if err := putRecord(messages, c.uid, c.rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, update := range updated {
+		mbox.user.backend.updates.Flags <- update
+	}
+	return nil
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *common.SeqSet, destName string) error {
+	dest := mbox.user.mailbox(destName)
+
+	var uids []uint32
+	err := mbox.updateTx(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		destBucket, err := mailboxBucket(tx, mbox.user.username, dest.name)
+		if err == errNoSuchMailbox {
+			return errors.New("Destination mailbox doesn't exist")
+		} else if err != nil {
+			return err
+		}
+
+		var records []*messageRecord
+		err = forEachMessage(b.Bucket(messagesBucket), uid, seqset, func(seqNum, uid uint32, rec *messageRecord) error {
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, rec := range records {
+			if err := refBlob(tx, rec.Blob); err != nil {
+				return err
+			}
+			uid, err := appendMessage(tx, destBucket, rec)
+			if err != nil {
+				return err
+			}
+			uids = append(uids, uid)
+		}
+		return nil
+	})
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+
+	mbox.user.backend.updates.Added <- &backend.AddedUpdate{
+		Update: dest.update(),
+		Uids: uids,
+	}
+	return nil
+}
+
+func (mbox *Mailbox) Expunge() error {
+	var uids []uint32
+	err := mbox.updateTx(func(tx *bbolt.Tx, b *bbolt.Bucket) error {
+		messages := b.Bucket(messagesBucket)
+
+		err := messages.ForEach(func(k, v []byte) error {
+			rec, err := getRecord(v)
+			if err != nil {
+				return err
+			}
+			if !backendutil.HasFlag(rec.Flags, common.DeletedFlag) {
+				return nil
+			}
+
+			if err := releaseBlob(tx, rec.Blob); err != nil {
+				return err
+			}
+			uids = append(uids, btoi(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, uid := range uids {
+			if err := messages.Delete(itob(uid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+
+	mbox.user.backend.updates.UidExpunges <- &backend.UidExpungeUpdate{
+		Update: mbox.update(),
+		Uids: uids,
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package bolt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+	"go.etcd.io/bbolt"
+)
+
+// The database layout:
+//
+//	meta/
+//		uidvalidity: the last UIDVALIDITY value
+//	blobs/
+//		<sha256>: a message body
+//	refs/
+//		<sha256>: the number of messages referencing a blob
+//	users/
+//		<username>/
+//			password: the bcrypt hash of the user's password
+//			mailboxes/
+//				<name>/
+//					uidvalidity, uidnext, subscribed
+//					messages/
+//						<uid>: a JSON-encoded messageRecord
+//
+// Integers are stored in big endian, so that messages are sorted by UID.
+var (
+	metaBucket = []byte("meta")
+	blobsBucket = []byte("blobs")
+	refsBucket = []byte("refs")
+	usersBucket = []byte("users")
+	mailboxesBucket = []byte("mailboxes")
+	messagesBucket = []byte("messages")
+
+	uidValidityKey = []byte("uidvalidity")
+	uidNextKey = []byte("uidnext")
+	subscribedKey = []byte("subscribed")
+	passwordKey = []byte("password")
+)
+
+var (
+	errNoSuchUser = errors.New("No such user")
+	errNoSuchMailbox = errors.New("No such mailbox")
+)
+
+// A message's metadata. The body is stored separately, so that copies share
+// it.
+type messageRecord struct {
+	Flags []string
+	InternalDate time.Time
+	Size uint32
+	Blob string
+	Envelope *common.Envelope
+	BodyStructure *common.BodyStructure
+}
+
+func itob(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func btoi(b []byte) uint32 {
+	if len(b) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func getRecord(b []byte) (*messageRecord, error) {
+	rec := &messageRecord{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func putRecord(messages *bbolt.Bucket, uid uint32, rec *messageRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return messages.Put(itob(uid), b)
+}
+
+// Store a message body, or increment its reference count if it's already
+// stored. The blob key is returned.
+func putBlob(tx *bbolt.Tx, body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	key := []byte(hex.EncodeToString(sum[:]))
+
+	refs := tx.Bucket(refsBucket)
+	n := btoi(refs.Get(key))
+	if n == 0 {
+		if err := tx.Bucket(blobsBucket).Put(key, body); err != nil {
+			return "", err
+		}
+	}
+
+	return string(key), refs.Put(key, itob(n + 1))
+}
+
+// Get a message body. The returned slice is only valid during the transaction.
+func getBlob(tx *bbolt.Tx, key string) []byte {
+	return tx.Bucket(blobsBucket).Get([]byte(key))
+}
+
+// Add a reference to an existing blob.
+func refBlob(tx *bbolt.Tx, key string) error {
+	refs := tx.Bucket(refsBucket)
+	return refs.Put([]byte(key), itob(btoi(refs.Get([]byte(key))) + 1))
+}
+
+// Remove a reference to a blob, and delete it if it's not referenced anymore.
+func releaseBlob(tx *bbolt.Tx, key string) error {
+	refs := tx.Bucket(refsBucket)
+
+	n := btoi(refs.Get([]byte(key)))
+	if n > 1 {
+		return refs.Put([]byte(key), itob(n - 1))
+	}
+
+	if err := refs.Delete([]byte(key)); err != nil {
+		return err
+	}
+	return tx.Bucket(blobsBucket).Delete([]byte(key))
+}
+
+// Release the blobs of all messages in a mailbox.
+func releaseMailbox(tx *bbolt.Tx, mbox *bbolt.Bucket) error {
+	return mbox.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+		rec, err := getRecord(v)
+		if err != nil {
+			return err
+		}
+		return releaseBlob(tx, rec.Blob)
+	})
+}
+
+// Generate a new UIDVALIDITY value. Values are strictly increasing, so that a
+// mailbox deleted and created again never gets the same one.
+func newUidValidity(tx *bbolt.Tx) (uint32, error) {
+	meta := tx.Bucket(metaBucket)
+
+	v := uint32(time.Now().Unix())
+	if last := btoi(meta.Get(uidValidityKey)); v <= last {
+		v = last + 1
+	}
+
+	return v, meta.Put(uidValidityKey, itob(v))
+}
+
+func userBucket(tx *bbolt.Tx, username string) (*bbolt.Bucket, error) {
+	u := tx.Bucket(usersBucket).Bucket([]byte(username))
+	if u == nil {
+		return nil, errNoSuchUser
+	}
+	return u, nil
+}
+
+func mailboxBucket(tx *bbolt.Tx, username, name string) (*bbolt.Bucket, error) {
+	u, err := userBucket(tx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox := u.Bucket(mailboxesBucket).Bucket([]byte(name))
+	if mbox == nil {
+		return nil, errNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+// Create a mailbox bucket.
+func createMailbox(tx *bbolt.Tx, mailboxes *bbolt.Bucket, name string) (*bbolt.Bucket, error) {
+	mbox, err := mailboxes.CreateBucket([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+
+	uidValidity, err := newUidValidity(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := mbox.Put(uidValidityKey, itob(uidValidity)); err != nil {
+		return nil, err
+	}
+	if err := mbox.Put(uidNextKey, itob(1)); err != nil {
+		return nil, err
+	}
+
+	if _, err := mbox.CreateBucket(messagesBucket); err != nil {
+		return nil, err
+	}
+	return mbox, nil
+}
+
+// Recursively copy a bucket's contents.
+func copyBucket(dst, src *bbolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, src.Bucket(k))
+	})
+}
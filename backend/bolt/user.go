@@ -0,0 +1,232 @@
+package bolt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+	"go.etcd.io/bbolt"
+)
+
+type User struct {
+	username string
+	backend *Backend
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+func (u *User) mailbox(name string) *Mailbox {
+	if isInbox(name) {
+		name = "INBOX"
+	}
+	return &Mailbox{name: name, user: u}
+}
+
+func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
+	err = u.backend.db.View(func(tx *bbolt.Tx) error {
+		user, err := userBucket(tx, u.username)
+		if err != nil {
+			return err
+		}
+
+		mboxes := user.Bucket(mailboxesBucket)
+		return mboxes.ForEach(func(name, v []byte) error {
+			if subscribed && mboxes.Bucket(name).Get(subscribedKey) == nil {
+				return nil
+			}
+
+			mailboxes = append(mailboxes, u.mailbox(string(name)))
+			return nil
+		})
+	})
+	return
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox := u.mailbox(name)
+
+	err := u.backend.db.View(func(tx *bbolt.Tx) error {
+		_, err := mailboxBucket(tx, u.username, mbox.name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return mbox, nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	// A trailing delimiter only declares that the client intends to create
+	// mailbox names under this name
+	name = strings.TrimSuffix(name, Delimiter)
+
+	if name == "" || isInbox(name) {
+		return errors.New("Mailbox already exists")
+	}
+
+	return u.backend.db.Update(func(tx *bbolt.Tx) error {
+		user, err := userBucket(tx, u.username)
+		if err != nil {
+			return err
+		}
+		mailboxes := user.Bucket(mailboxesBucket)
+
+		if mailboxes.Bucket([]byte(name)) != nil {
+			return errors.New("Mailbox already exists")
+		}
+
+		// Create superiors if they don't exist
+		parts := strings.Split(name, Delimiter)
+		for i := range parts {
+			superior := strings.Join(parts[:i+1], Delimiter)
+			if mailboxes.Bucket([]byte(superior)) != nil {
+				continue
+			}
+
+			if _, err := createMailbox(tx, mailboxes, superior); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if isInbox(name) {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	err := u.backend.db.Update(func(tx *bbolt.Tx) error {
+		mbox, err := mailboxBucket(tx, u.username, name)
+		if err != nil {
+			return err
+		}
+
+		if err := releaseMailbox(tx, mbox); err != nil {
+			return err
+		}
+
+		user, _ := userBucket(tx, u.username)
+		return user.Bucket(mailboxesBucket).DeleteBucket([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+
+	u.backend.updates.Deletes <- &backend.DeleteUpdate{
+		Update: backend.Update{Username: u.username, Mailbox: name},
+	}
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	if isInbox(existingName) {
+		existingName = "INBOX"
+	}
+	if isInbox(newName) {
+		return errors.New("Mailbox already exists")
+	}
+
+	// Messages moved out of INBOX, and renamed mailboxes
+	var moved []uint32
+	renamed := map[string]string{}
+
+	err := u.backend.db.Update(func(tx *bbolt.Tx) error {
+		user, err := userBucket(tx, u.username)
+		if err != nil {
+			return err
+		}
+		mailboxes := user.Bucket(mailboxesBucket)
+
+		if mailboxes.Bucket([]byte(existingName)) == nil {
+			return errNoSuchMailbox
+		}
+		if mailboxes.Bucket([]byte(newName)) != nil {
+			return errors.New("Mailbox already exists")
+		}
+
+		// Renaming INBOX moves all its messages to a new mailbox, and leaves
+		// INBOX empty. Its inferiors are not renamed.
+		if existingName == "INBOX" {
+			inbox := mailboxes.Bucket([]byte("INBOX"))
+
+			dest, err := createMailbox(tx, mailboxes, newName)
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(dest.Bucket(messagesBucket), inbox.Bucket(messagesBucket)); err != nil {
+				return err
+			}
+			err = inbox.Bucket(messagesBucket).ForEach(func(k, v []byte) error {
+				moved = append(moved, btoi(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if err := dest.Put(uidNextKey, inbox.Get(uidNextKey)); err != nil {
+				return err
+			}
+
+			if err := inbox.DeleteBucket(messagesBucket); err != nil {
+				return err
+			}
+			_, err = inbox.CreateBucket(messagesBucket)
+			return err
+		}
+
+		// Rename the mailbox and its inferiors
+		var names []string
+		err = mailboxes.ForEach(func(name, v []byte) error {
+			if s := string(name); s == existingName || strings.HasPrefix(s, existingName + Delimiter) {
+				names = append(names, s)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			renamed[name] = newName + strings.TrimPrefix(name, existingName)
+
+			dest, err := mailboxes.CreateBucket([]byte(renamed[name]))
+			if err != nil {
+				return err
+			}
+			if err := copyBucket(dest, mailboxes.Bucket([]byte(name))); err != nil {
+				return err
+			}
+			if err := mailboxes.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(moved) > 0 {
+		u.backend.updates.UidExpunges <- &backend.UidExpungeUpdate{
+			Update: backend.Update{Username: u.username, Mailbox: "INBOX"},
+			Uids: moved,
+		}
+	}
+	for name, newName := range renamed {
+		u.backend.updates.Renames <- &backend.RenameUpdate{
+			Update: backend.Update{Username: u.username, Mailbox: name},
+			NewName: newName,
+		}
+	}
+	return nil
+}
@@ -8,6 +8,9 @@ import (
 
 // Mailbox represents a mailbox belonging to a user in the mail storage system.
 // A mailbox operation always deals with messages.
+//
+// Read-only operations, such as ListMessages, SearchMessages and Status, can be
+// called concurrently by a connection and must be safe for concurrent use.
 type Mailbox interface {
 	// Get this mailbox name.
 	Name() string
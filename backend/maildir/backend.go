@@ -0,0 +1,155 @@
+// A Maildir++ backend.
+//
+// Each user has a Maildir++ directory in the backend's root directory: the
+// user's directory itself is INBOX, other mailboxes are stored in
+// subdirectories named after the mailbox, prefixed with a dot. The hierarchy
+// delimiter is a dot. See http://www.courier-mta.org/imap/README.maildirquota.html
+package maildir
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// The hierarchy delimiter.
+const Delimiter = "."
+
+// A function that checks a user's credentials. It must return an error if the
+// credentials are invalid.
+type AuthFunc func(username, password string) error
+
+type Backend struct {
+	root string
+	auth AuthFunc
+	updates *backend.Updates
+	queue *backendutil.UpdateQueue
+
+	locker sync.Mutex
+	// Maildirs that have been opened, indexed by path. They are shared between
+	// all mailboxes so that changes are only detected once.
+	folders map[string]*folder
+	lastUidValidity uint32
+}
+
+// Check if a username can be safely used as a directory name.
+func validUsername(username string) bool {
+	return username != "" && username != "." && username != ".." &&
+		!strings.ContainsAny(username, "/\\\x00") && !strings.HasPrefix(username, ".")
+}
+
+func (bkd *Backend) Login(username, password string) (backend.User, error) {
+	if !validUsername(username) {
+		return nil, errors.New("Invalid username")
+	}
+	if err := bkd.auth(username, password); err != nil {
+		return nil, err
+	}
+
+	u := &User{
+		username: username,
+		root: filepath.Join(bkd.root, username),
+		backend: bkd,
+	}
+
+	// Create INBOX if it doesn't exist yet
+	if err := maildir(u.root).create(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (bkd *Backend) Updates() *backend.Updates {
+	return bkd.updates
+}
+
+// Generate a new UIDVALIDITY value. Values are strictly increasing, so that a
+// mailbox deleted and created again never gets the same one.
+func (bkd *Backend) newUidValidity() uint32 {
+	bkd.locker.Lock()
+	defer bkd.locker.Unlock()
+
+	v := uint32(time.Now().Unix())
+	if v <= bkd.lastUidValidity {
+		v = bkd.lastUidValidity + 1
+	}
+	bkd.lastUidValidity = v
+	return v
+}
+
+// Record a UIDVALIDITY value read from disk, so that new values are always
+// greater.
+func (bkd *Backend) seenUidValidity(v uint32) {
+	bkd.locker.Lock()
+	defer bkd.locker.Unlock()
+
+	if v > bkd.lastUidValidity {
+		bkd.lastUidValidity = v
+	}
+}
+
+// Get the shared state of a maildir.
+func (bkd *Backend) folder(u *User, name, path string) *folder {
+	bkd.locker.Lock()
+	defer bkd.locker.Unlock()
+
+	f, ok := bkd.folders[path]
+	if !ok {
+		f = &folder{
+			backend: bkd,
+			username: u.username,
+			name: name,
+			dir: maildir(path),
+		}
+		bkd.folders[path] = f
+	}
+	return f
+}
+
+// Forget about maildirs that have been removed or renamed. Mailboxes still
+// referencing them will return errors.
+func (bkd *Backend) forgetFolders(paths ...string) {
+	var removed []*folder
+
+	bkd.locker.Lock()
+	for _, path := range paths {
+		if f, ok := bkd.folders[path]; ok {
+			removed = append(removed, f)
+			delete(bkd.folders, path)
+		}
+	}
+	bkd.locker.Unlock()
+
+	// Folders lock the backend to generate UIDVALIDITY values, so they must not
+	// be locked while the backend is
+	for _, f := range removed {
+		f.locker.Lock()
+		f.removed = true
+		f.locker.Unlock()
+	}
+}
+
+// Create a new Maildir++ backend. Users' maildirs are stored in root, auth is
+// used to check users' credentials.
+func New(root string, auth AuthFunc) *Backend {
+	updates := &backend.Updates{
+		Statuses: make(chan *backend.StatusUpdate),
+		Flags: make(chan *backend.FlagsUpdate),
+		Added: make(chan *backend.AddedUpdate),
+		UidExpunges: make(chan *backend.UidExpungeUpdate),
+	}
+
+	return &Backend{
+		root: root,
+		auth: auth,
+		updates: updates,
+		queue: backendutil.NewUpdateQueue(updates),
+		folders: map[string]*folder{},
+	}
+}
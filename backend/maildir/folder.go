@@ -0,0 +1,218 @@
+package maildir
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/common"
+)
+
+var errMailboxRemoved = errors.New("Mailbox has been deleted or renamed")
+
+// A message stored in a maildir.
+type message struct {
+	uid uint32
+	// The message unique name, which doesn't change when flags are updated.
+	key string
+	// The message filename in cur.
+	filename string
+	flags []string
+	// Info letters that cannot be converted to IMAP flags.
+	extra string
+}
+
+// Copy messages, so that they can be used once the folder is unlocked.
+func copyMessages(messages []*message) []*message {
+	copies := make([]*message, len(messages))
+	for i, msg := range messages {
+		copied := *msg
+		copied.flags = append([]string(nil), msg.flags...)
+		copies[i] = &copied
+	}
+	return copies
+}
+
+// The state of a maildir, shared between all Mailbox values referencing it.
+type folder struct {
+	backend *Backend
+	username string
+	name string
+	dir maildir
+
+	// Protects all fields below. It must be held while reading or writing
+	// files.
+	locker sync.Mutex
+	removed bool
+	// Set to true after the first synchronization. Before, clients can't know
+	// anything about the maildir's contents and no updates are sent.
+	synced bool
+	uidValidity uint32
+	uidNext uint32
+	keywords []string
+	// Messages sorted by UID, as seen by clients.
+	messages []*message
+}
+
+func (f *folder) path(name string) string {
+	return filepath.Join(string(f.dir), name)
+}
+
+func (f *folder) messagePath(msg *message) string {
+	return filepath.Join(string(f.dir), "cur", msg.filename)
+}
+
+// Read a message's internal date, and its contents if body is true.
+func (f *folder) readMessage(msg *message, body bool) ([]byte, *common.Message, error) {
+	path := f.messagePath(msg)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	date := info.ModTime()
+
+	var b []byte
+	if body {
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return b, &common.Message{
+		Uid: msg.uid,
+		Flags: msg.flags,
+		InternalDate: &date,
+	}, nil
+}
+
+func (f *folder) saveKeywords(keywords []string) error {
+	if len(keywords) == len(f.keywords) {
+		return nil
+	}
+
+	if err := writeKeywords(f.path(keywordsFile), keywords); err != nil {
+		return err
+	}
+	f.keywords = keywords
+	return nil
+}
+
+// Scan the maildir and assign UIDs to new messages.
+func (f *folder) scan() ([]*message, error) {
+	if f.removed || !f.dir.exists() {
+		return nil, errMailboxRemoved
+	}
+
+	if err := f.dir.moveNew(); err != nil {
+		return nil, err
+	}
+
+	keywords, err := readKeywords(f.path(keywordsFile))
+	if err != nil {
+		return nil, err
+	}
+	f.keywords = keywords
+
+	unlock, err := backendutil.LockFile(f.path(uidListFile))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// The maildir must be read after the UID list has been locked, otherwise a
+	// message delivered by another process in the meantime could be assigned
+	// two different UIDs
+	names, err := readDirNames(f.path("cur"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	// A new UID list must be written even if the maildir is empty, otherwise
+	// UIDVALIDITY would change each time the maildir is scanned
+	created := false
+	list, err := readUidList(f.path(uidListFile))
+	if os.IsNotExist(err) {
+		list = &uidList{
+			uidValidity: f.backend.newUidValidity(),
+			uidNext: 1,
+			uids: map[string]uint32{},
+		}
+		created = true
+	} else if err != nil {
+		return nil, err
+	} else {
+		f.backend.seenUidValidity(list.uidValidity)
+	}
+
+	changed := created || len(list.uids) != len(names)
+	messages := make([]*message, 0, len(names))
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, info := parseFilename(name)
+
+		uid, ok := list.uids[key]
+		if !ok {
+			uid = list.uidNext
+			list.uidNext++
+			list.uids[key] = uid
+			changed = true
+		}
+
+		msg := &message{uid: uid, key: key, filename: name}
+		msg.flags, msg.extra = parseInfo(info, f.keywords)
+		messages = append(messages, msg)
+		keys = append(keys, key)
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].uid < messages[j].uid })
+	sort.Slice(keys, func(i, j int) bool { return list.uids[keys[i]] < list.uids[keys[j]] })
+
+	if changed {
+		if err := list.write(f.path(uidListFile), keys); err != nil {
+			return nil, err
+		}
+	}
+
+	f.uidValidity = list.uidValidity
+	f.uidNext = list.uidNext
+	return messages, nil
+}
+
+func (f *folder) update() backend.Update {
+	return backend.Update{Username: f.username, Mailbox: f.name}
+}
+
+// Synchronize the clients' view of the maildir with its contents, and queue
+// updates for changes.
+func (f *folder) sync() error {
+	messages, err := f.scan()
+	if err != nil {
+		return err
+	}
+
+	if !f.synced {
+		f.messages = messages
+		f.synced = true
+		return nil
+	}
+
+	f.backend.queue.Push(backendutil.DiffMessages(f.update(), states(f.messages), states(messages))...)
+
+	f.messages = messages
+	return nil
+}
+
+func states(messages []*message) []backendutil.MessageState {
+	states := make([]backendutil.MessageState, len(messages))
+	for i, msg := range messages {
+		states[i] = backendutil.MessageState{Uid: msg.uid, Flags: msg.flags}
+	}
+	return states
+}
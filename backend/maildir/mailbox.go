@@ -0,0 +1,367 @@
+package maildir
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/common"
+)
+
+var systemFlags = []string{
+	common.AnsweredFlag,
+	common.FlaggedFlag,
+	common.DeletedFlag,
+	common.SeenFlag,
+	common.DraftFlag,
+}
+
+type Mailbox struct {
+	name string
+	user *User
+	folder *folder
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*common.MailboxInfo, error) {
+	info := &common.MailboxInfo{
+		Delimiter: Delimiter,
+		Name: mbox.name,
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
+	f := mbox.folder
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if err := f.sync(); err != nil {
+		return nil, err
+	}
+
+	flags := append([]string(nil), systemFlags...)
+	for _, kw := range f.keywords {
+		if kw != "" {
+			flags = append(flags, kw)
+		}
+	}
+
+	status := &common.MailboxStatus{
+		Items: items,
+		Name: mbox.name,
+		Flags: flags,
+		PermanentFlags: append(append([]string(nil), flags...), "\\*"),
+	}
+
+	for _, name := range items {
+		switch name {
+		case common.MailboxMessages:
+			status.Messages = uint32(len(f.messages))
+		case common.MailboxUidNext:
+			status.UidNext = f.uidNext
+		case common.MailboxUidValidity:
+			status.UidValidity = f.uidValidity
+		case common.MailboxRecent:
+			status.Recent = 0
+		case common.MailboxUnseen:
+			status.Unseen = 0
+			for _, msg := range f.messages {
+				if !backendutil.HasFlag(msg.flags, common.SeenFlag) {
+					status.Unseen++
+				}
+			}
+		}
+	}
+
+	return status, nil
+}
+
+func (mbox *Mailbox) Subscribe() error {
+	return mbox.user.setSubscribed(mbox.name, true)
+}
+
+func (mbox *Mailbox) Unsubscribe() error {
+	return mbox.user.setSubscribed(mbox.name, false)
+}
+
+func (mbox *Mailbox) Check() error {
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	return f.sync()
+}
+
+// Poll checks the maildir for changes made by other processes, e.g. messages
+// delivered by an MDA.
+func (mbox *Mailbox) Poll() error {
+	return mbox.Check()
+}
+
+// Get the messages matching a sequence set, along with their sequence numbers.
+// The folder must be locked.
+func (mbox *Mailbox) messages(uid bool, seqset *common.SeqSet) (seqNums []uint32, messages []*message) {
+	f := mbox.folder
+
+	var max uint32
+	if n := len(f.messages); n > 0 {
+		if uid {
+			max = f.messages[n-1].uid
+		} else {
+			max = uint32(n)
+		}
+	}
+
+	for i, msg := range f.messages {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !backendutil.SeqSetContains(seqset, id, max) {
+			continue
+		}
+
+		seqNums = append(seqNums, seqNum)
+		messages = append(messages, msg)
+	}
+
+	return
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	defer close(ch)
+
+	f := mbox.folder
+	f.locker.Lock()
+	if !f.synced {
+		if err := f.sync(); err != nil {
+			f.locker.Unlock()
+			return err
+		}
+	}
+	seqNums, messages := mbox.messages(uid, seqset)
+	messages = copyMessages(messages)
+	f.locker.Unlock()
+
+	// Message files are read and sent without holding the lock, the receiver
+	// may use the mailbox
+	body := backendutil.FetchNeedsBody(items)
+	for i, msg := range messages {
+		b, m, err := f.readMessage(msg, body)
+		if os.IsNotExist(err) {
+			// The message has been removed by another process, it will be
+			// expunged during the next synchronization
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		m.SeqNum = seqNums[i]
+		ch <- backendutil.FetchMessage(m, b, items)
+	}
+
+	return nil
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *common.SearchCriteria) (ids []uint32, err error) {
+	f := mbox.folder
+	f.locker.Lock()
+	if !f.synced {
+		if err = f.sync(); err != nil {
+			f.locker.Unlock()
+			return
+		}
+	}
+	messages := copyMessages(f.messages)
+	f.locker.Unlock()
+
+	var maxUid uint32
+	if n := len(messages); n > 0 {
+		maxUid = messages[n-1].uid
+	}
+
+	body := backendutil.MatchNeedsBody(criteria)
+	for i, msg := range messages {
+		b, m, err := f.readMessage(msg, body)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		m.SeqNum = uint32(i + 1)
+		if !backendutil.Match(m, b, uint32(len(messages)), maxUid, criteria) {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, m.SeqNum)
+		}
+	}
+
+	return
+}
+
+// Store a new message in a folder. The folder must be locked.
+func (f *folder) deliver(flags []string, date time.Time, body []byte) error {
+	if _, err := f.scan(); err != nil {
+		return err
+	}
+
+	info, keywords, err := formatInfo(flags, "", f.keywords)
+	if err != nil {
+		return err
+	}
+	if err := f.saveKeywords(keywords); err != nil {
+		return err
+	}
+
+	_, err = f.dir.deliver(body, info, date)
+	return err
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date *time.Time, body []byte) error {
+	if date == nil {
+		now := time.Now()
+		date = &now
+	}
+
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if err := f.deliver(flags, *date, body); err != nil {
+		return err
+	}
+
+	return f.sync()
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op common.FlagsOp, flags []string) error {
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	scanned, err := f.scan()
+	if err != nil {
+		return err
+	}
+
+	// Flags may have been changed by another process since the last
+	// synchronization, start from the current ones
+	current := map[uint32]*message{}
+	for _, msg := range scanned {
+		current[msg.uid] = msg
+	}
+
+	_, messages := mbox.messages(uid, seqset)
+	for _, msg := range messages {
+		msg, ok := current[msg.uid]
+		if !ok {
+			continue
+		}
+
+		updated := backendutil.UpdateFlags(msg.flags, op, flags)
+
+		info, keywords, err := formatInfo(updated, msg.extra, f.keywords)
+		if err != nil {
+			return err
+		}
+		if err := f.saveKeywords(keywords); err != nil {
+			return err
+		}
+
+		filename := msg.key + infoSep + info
+		if filename == msg.filename {
+			continue
+		}
+
+		err = os.Rename(f.messagePath(msg), filepath.Join(string(f.dir), "cur", filename))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return f.sync()
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *common.SeqSet, destName string) error {
+	dest, err := mbox.user.mailbox(destName)
+	if err != nil {
+		return err
+	}
+
+	type copied struct {
+		body []byte
+		flags []string
+		date time.Time
+	}
+
+	// Read messages first, so that the source and the destination are never
+	// locked at the same time
+	var toCopy []copied
+	f := mbox.folder
+	f.locker.Lock()
+	_, messages := mbox.messages(uid, seqset)
+	for _, msg := range messages {
+		b, m, err := f.readMessage(msg, true)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			f.locker.Unlock()
+			return err
+		}
+
+		toCopy = append(toCopy, copied{b, m.Flags, *m.InternalDate})
+	}
+	f.locker.Unlock()
+
+	df := dest.folder
+	defer df.backend.queue.Flush()
+	df.locker.Lock()
+	defer df.locker.Unlock()
+
+	for _, c := range toCopy {
+		if err := df.deliver(c.flags, c.date, c.body); err != nil {
+			return err
+		}
+	}
+
+	return df.sync()
+}
+
+func (mbox *Mailbox) Expunge() error {
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	messages, err := f.scan()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if !backendutil.HasFlag(msg.flags, common.DeletedFlag) {
+			continue
+		}
+
+		if err := os.Remove(f.messagePath(msg)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return f.sync()
+}
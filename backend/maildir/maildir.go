@@ -0,0 +1,230 @@
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// The separator between a message's unique name and its info, which contains
+// its flags. See https://cr.yp.to/proto/maildir.html
+const infoSep = ":2,"
+
+// Maildir flag letters. P (passed) has no IMAP counterpart, it is preserved
+// but not exposed.
+var flagLetters = map[string]byte{
+	common.DraftFlag: 'D',
+	common.FlaggedFlag: 'F',
+	common.AnsweredFlag: 'R',
+	common.SeenFlag: 'S',
+	common.DeletedFlag: 'T',
+}
+
+// The maximum number of keywords per maildir: one per lowercase letter.
+const maxKeywords = 26
+
+// Split a maildir filename into its unique name and its info.
+func parseFilename(name string) (key, info string) {
+	i := strings.IndexByte(name, ':')
+	if i < 0 {
+		return name, ""
+	}
+
+	key = name[:i]
+	if strings.HasPrefix(name[i:], infoSep) {
+		info = name[i+len(infoSep):]
+	}
+	return
+}
+
+// Convert a maildir info to IMAP flags. Letters that cannot be mapped are
+// returned in extra.
+func parseInfo(info string, keywords []string) (flags []string, extra string) {
+	for i := 0; i < len(info); i++ {
+		c := info[i]
+
+		found := false
+		for flag, letter := range flagLetters {
+			if letter == c {
+				flags = append(flags, flag)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		if c >= 'a' && c <= 'z' && int(c - 'a') < len(keywords) && keywords[c - 'a'] != "" {
+			flags = append(flags, keywords[c - 'a'])
+			continue
+		}
+
+		extra += string(c)
+	}
+
+	return
+}
+
+// Convert IMAP flags to a maildir info. Keywords that are not in the keywords
+// list are appended to it, the new list is returned.
+func formatInfo(flags []string, extra string, keywords []string) (string, []string, error) {
+	var letters []byte
+	letters = append(letters, extra...)
+
+	for _, flag := range flags {
+		if letter, ok := flagLetters[flag]; ok {
+			letters = append(letters, letter)
+			continue
+		}
+		if flag == common.RecentFlag {
+			continue
+		}
+
+		index := -1
+		for i, kw := range keywords {
+			if kw == flag {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			if len(keywords) >= maxKeywords {
+				return "", keywords, errors.New("Too many keywords in this mailbox")
+			}
+			index = len(keywords)
+			keywords = append(keywords, flag)
+		}
+		letters = append(letters, byte('a' + index))
+	}
+
+	// Letters must be in ASCII order and must not be repeated
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	info := make([]byte, 0, len(letters))
+	for i, c := range letters {
+		if i == 0 || letters[i-1] != c {
+			info = append(info, c)
+		}
+	}
+
+	return string(info), keywords, nil
+}
+
+var deliveries uint32
+
+// Generate a new unique name for a message.
+func uniqueName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	hostname = strings.Replace(hostname, "/", "\\057", -1)
+	hostname = strings.Replace(hostname, ":", "\\072", -1)
+
+	now := time.Now()
+	n := atomic.AddUint32(&deliveries, 1)
+	return fmt.Sprintf("%v.M%vP%vQ%v.%v", now.Unix(), now.Nanosecond() / 1000, os.Getpid(), n, hostname)
+}
+
+// A directory containing cur, new and tmp subdirectories.
+type maildir string
+
+func (d maildir) exists() bool {
+	info, err := os.Stat(filepath.Join(string(d), "cur"))
+	return err == nil && info.IsDir()
+}
+
+func (d maildir) create() error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(string(d), sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Safely deliver a message to the cur directory: the message is first written
+// to tmp and then moved to cur, so that readers never see a partially written
+// message. The new filename is returned.
+func (d maildir) deliver(b []byte, info string, date time.Time) (string, error) {
+	key := uniqueName()
+	tmp := filepath.Join(string(d), "tmp", key)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Chtimes(tmp, date, date); err != nil {
+		return "", err
+	}
+
+	name := key + infoSep + info
+	if err := os.Rename(tmp, filepath.Join(string(d), "cur", name)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Move messages delivered to new by external agents to cur.
+func (d maildir) moveNew() error {
+	names, err := readDirNames(filepath.Join(string(d), "new"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		key, _ := parseFilename(name)
+		src := filepath.Join(string(d), "new", name)
+		dst := filepath.Join(string(d), "cur", key + infoSep)
+
+		// The message may have been moved by another process in the meantime
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List files in a directory, ignoring hidden ones.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	all, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range all {
+		if !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
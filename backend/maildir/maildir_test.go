@@ -0,0 +1,305 @@
+package maildir_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/maildir"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/internal"
+)
+
+func allowAll(username, password string) error {
+	return nil
+}
+
+// Create a backend whose updates are discarded.
+func newBackend(t *testing.T) (bkd *maildir.Backend, root string) {
+	root = internal.TempDir(t, "go-imap-maildir")
+	bkd = maildir.New(root, allowAll)
+	go internal.DiscardUpdates(bkd.Updates(), nil)
+	return bkd, root
+}
+
+func uidValidity(t *testing.T, mbox backend.Mailbox) uint32 {
+	status, err := mbox.Status([]string{common.MailboxUidValidity})
+	if err != nil {
+		t.Fatal("Cannot get mailbox status:", err)
+	}
+	return status.UidValidity
+}
+
+// List the filenames of the messages in a maildir's cur directory.
+func curNames(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(filepath.Join(dir, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestMailbox_uids(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	for _, subject := range []string{"first", "second"} {
+		if err := mbox.CreateMessage(nil, nil, []byte("Subject: " + subject + "\r\n\r\n")); err != nil {
+			t.Fatal("Cannot create message:", err)
+		}
+	}
+	validity := uidValidity(t, mbox)
+
+	// A message delivered by an MDA
+	name := "1234567890.M1P1Q1.localhost"
+	if err := ioutil.WriteFile(filepath.Join(root, "username", "new", name), []byte("Subject: third\r\n\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// UIDs must be kept by a new backend, e.g. after a restart
+	bkd = maildir.New(root, allowAll)
+	go internal.DiscardUpdates(bkd.Updates(), nil)
+	mbox = internal.GetMailbox(t, bkd, "INBOX")
+	if uids := internal.ListUids(t, mbox); !reflect.DeepEqual(uids, []uint32{1, 2, 3}) {
+		t.Errorf("Bad UIDs: got %v, want [1 2 3]", uids)
+	}
+	if v := uidValidity(t, mbox); v != validity {
+		t.Errorf("UIDVALIDITY changed: got %v, want %v", v, validity)
+	}
+
+	// Expunged UIDs are never reused
+	seqset, _ := common.NewSeqSet("3")
+	if err := mbox.UpdateMessagesFlags(true, seqset, common.AddFlags, []string{common.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	mbox.CreateMessage(nil, nil, []byte("Subject: fourth\r\n\r\n"))
+	if uids := internal.ListUids(t, mbox); !reflect.DeepEqual(uids, []uint32{1, 2, 4}) {
+		t.Errorf("Bad UIDs after expunge: got %v, want [1 2 4]", uids)
+	}
+
+	// If the UID list is lost, UIDs are assigned again with a new UIDVALIDITY
+	if err := os.Remove(filepath.Join(root, "username", "imap-uidlist")); err != nil {
+		t.Fatal(err)
+	}
+	if v := uidValidity(t, mbox); v <= validity {
+		t.Errorf("UIDVALIDITY not increased after losing the UID list: got %v, previous was %v", v, validity)
+	}
+	if uids := internal.ListUids(t, mbox); len(uids) != 3 {
+		t.Errorf("Bad number of messages after losing the UID list: %v", uids)
+	}
+}
+
+func TestMailbox_ListMessages(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	date := time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+	body := "Subject: Hello\r\n\r\nHi there :)"
+	if err := mbox.CreateMessage([]string{common.SeenFlag, "$Important"}, &date, []byte(body)); err != nil {
+		t.Fatal("Cannot create message:", err)
+	}
+
+	messages := internal.ListMessages(t, mbox, []string{"UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"})
+	if len(messages) != 1 {
+		t.Fatalf("Expected one message, got %v", len(messages))
+	}
+
+	msg := messages[0]
+	if msg.Uid != 1 || msg.SeqNum != 1 {
+		t.Errorf("Bad message identifiers: UID %v, sequence number %v", msg.Uid, msg.SeqNum)
+	}
+	if !reflect.DeepEqual(msg.Flags, []string{common.SeenFlag, "$Important"}) {
+		t.Errorf("Bad flags: %v", msg.Flags)
+	}
+	if msg.InternalDate == nil || !msg.InternalDate.Equal(date) {
+		t.Errorf("Bad internal date: %v", msg.InternalDate)
+	}
+	if msg.Size != uint32(len(body)) {
+		t.Errorf("Bad size: got %v, want %v", msg.Size, len(body))
+	}
+	if msg.Envelope == nil || msg.Envelope.Subject != "Hello" {
+		t.Errorf("Bad envelope: %+v", msg.Envelope)
+	}
+}
+
+func TestMailbox_Expunge_updates(t *testing.T) {
+	root := internal.TempDir(t, "go-imap-maildir")
+	defer os.RemoveAll(root)
+
+	bkd := maildir.New(root, allowAll)
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	internal.ListUids(t, mbox)
+
+	internal.CheckExpungeUpdates(t, bkd, mbox)
+}
+
+func TestMailbox_flags(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "username")
+
+	// Flags are stored as letters in the info part of filenames, keywords as
+	// lowercase letters listed in the keywords file
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	flags := []string{common.SeenFlag, common.FlaggedFlag, "$Important", "$Label"}
+	if err := mbox.CreateMessage(flags, nil, []byte("Subject: first\r\n\r\n")); err != nil {
+		t.Fatal("Cannot create message:", err)
+	}
+
+	names := curNames(t, dir)
+	if len(names) != 1 || !strings.HasSuffix(names[0], ":2,FSab") {
+		t.Errorf("Bad filenames: %v", names)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "imap-keywords"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0 $Important\n1 $Label\n" {
+		t.Errorf("Bad keywords file: %q", b)
+	}
+
+	// A message with flags set by another client, P has no IMAP counterpart
+	name := "1234567890.M1P1Q1.localhost:2,PRSb"
+	if err := ioutil.WriteFile(filepath.Join(dir, "cur", name), []byte("Subject: second\r\n\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := internal.ListMessages(t, mbox, []string{"UID", "FLAGS"})
+	if len(messages) != 2 {
+		t.Fatalf("Expected two messages, got %v", len(messages))
+	}
+	if got := messages[0].Flags; !reflect.DeepEqual(got, []string{common.FlaggedFlag, common.SeenFlag, "$Important", "$Label"}) {
+		t.Errorf("Bad flags of the first message: %v", got)
+	}
+	if got := messages[1].Flags; !reflect.DeepEqual(got, []string{common.AnsweredFlag, common.SeenFlag, "$Label"}) {
+		t.Errorf("Bad flags of the second message: %v", got)
+	}
+
+	// Unknown letters are preserved when flags are updated
+	seqset, _ := common.NewSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(true, seqset, common.SetFlags, []string{common.DraftFlag, "$Important"}); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range curNames(t, dir) {
+		if n == "1234567890.M1P1Q1.localhost:2,DPa" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Flags not updated in filenames: %v", curNames(t, dir))
+	}
+}
+
+func TestMailbox_Poll(t *testing.T) {
+	root := internal.TempDir(t, "go-imap-maildir")
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "username")
+
+	bkd := maildir.New(root, allowAll)
+	mbox := internal.GetMailbox(t, bkd, "INBOX")
+	internal.ListUids(t, mbox)
+
+	// A message delivered to new by an MDA is moved to cur and reported when
+	// polling
+	name := "1234567890.M1P1Q1.localhost"
+	if err := ioutil.WriteFile(filepath.Join(dir, "new", name), []byte("Subject: Hi\r\n\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	added := make(chan *backend.AddedUpdate, 1)
+	go (func() {
+		added <- <-bkd.Updates().Added
+	})()
+
+	if err := mbox.(backend.UpdaterMailbox).Poll(); err != nil {
+		t.Fatal("Cannot poll:", err)
+	}
+
+	select {
+	case update := <-added:
+		if update.Mailbox != "INBOX" || !reflect.DeepEqual(update.Uids, []uint32{1}) {
+			t.Errorf("Bad update: %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("New message not reported")
+	}
+
+	if names := curNames(t, dir); !reflect.DeepEqual(names, []string{name + ":2,"}) {
+		t.Errorf("Message not moved to cur: %v", names)
+	}
+}
+
+func TestUser_RenameMailbox_hierarchy(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	u, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Work.Projects"); err != nil {
+		t.Fatal(err)
+	}
+	mbox := internal.GetMailbox(t, bkd, "Work.Projects")
+	if err := mbox.CreateMessage(nil, nil, []byte("Subject: Hi\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	mailboxes := func() []string {
+		list, err := u.ListMailboxes(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, m := range list {
+			names = append(names, m.Name())
+		}
+		return names
+	}
+
+	// Superiors of the new name are created, inferiors are renamed too
+	if err := u.RenameMailbox("Work", "Archive.Work"); err != nil {
+		t.Fatal("Cannot rename mailbox:", err)
+	}
+	if names := mailboxes(); !reflect.DeepEqual(names, []string{"INBOX", "Archive", "Archive.Work", "Archive.Work.Projects"}) {
+		t.Errorf("Bad mailboxes after rename: %v", names)
+	}
+	mbox = internal.GetMailbox(t, bkd, "Archive.Work.Projects")
+	if uids := internal.ListUids(t, mbox); !reflect.DeepEqual(uids, []uint32{1}) {
+		t.Errorf("Messages not kept after rename: %v", uids)
+	}
+	if _, err := os.Stat(filepath.Join(root, "username", ".Work")); !os.IsNotExist(err) {
+		t.Errorf("Old maildir not removed: %v", err)
+	}
+
+	// Inferiors are kept when deleting a mailbox
+	if err := u.DeleteMailbox("Archive.Work"); err != nil {
+		t.Fatal("Cannot delete mailbox:", err)
+	}
+	if names := mailboxes(); !reflect.DeepEqual(names, []string{"INBOX", "Archive", "Archive.Work.Projects"}) {
+		t.Errorf("Bad mailboxes after delete: %v", names)
+	}
+	if err := u.DeleteMailbox("INBOX"); err == nil {
+		t.Error("Expected an error when deleting INBOX")
+	}
+}
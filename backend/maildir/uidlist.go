@@ -0,0 +1,126 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// Files stored in each maildir.
+const (
+	// Contains UIDVALIDITY, UIDNEXT and the UID of each message.
+	uidListFile = "imap-uidlist"
+	// Maps keyword letters to IMAP keywords.
+	keywordsFile = "imap-keywords"
+)
+
+// The version of the UID list format.
+const uidListVersion = 1
+
+// A persistent list of UIDs.
+//
+// The first line contains the format version, UIDVALIDITY and UIDNEXT. Each
+// following line contains a UID and the unique name of the message it has been
+// assigned to.
+type uidList struct {
+	uidValidity uint32
+	uidNext uint32
+	uids map[string]uint32
+}
+
+func readUidList(path string) (*uidList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := &uidList{uids: map[string]uint32{}}
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, errors.New("Empty UID list: " + path)
+	}
+
+	var version int
+	_, err = fmt.Sscanf(scanner.Text(), "%d %d %d", &version, &list.uidValidity, &list.uidNext)
+	if err != nil {
+		return nil, errors.New("Invalid UID list header: " + err.Error())
+	}
+	if version != uidListVersion {
+		return nil, errors.New("Unsupported UID list version: " + strconv.Itoa(version))
+	}
+
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		list.uids[parts[1]] = uint32(uid)
+	}
+
+	return list, scanner.Err()
+}
+
+func (list *uidList) write(path string, keys []string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d %d %d\n", uidListVersion, list.uidValidity, list.uidNext)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%d %s\n", list.uids[key], key)
+	}
+
+	return backendutil.WriteFileAtomic(path, b.Bytes())
+}
+
+// Read the keywords list. The keyword at index i is stored as the letter 'a'+i
+// in filenames.
+func readKeywords(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keywords []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 || i >= maxKeywords {
+			continue
+		}
+
+		for len(keywords) <= i {
+			keywords = append(keywords, "")
+		}
+		keywords[i] = parts[1]
+	}
+
+	return keywords, scanner.Err()
+}
+
+func writeKeywords(path string, keywords []string) error {
+	var b bytes.Buffer
+	for i, kw := range keywords {
+		fmt.Fprintf(&b, "%d %s\n", i, kw)
+	}
+
+	return backendutil.WriteFileAtomic(path, b.Bytes())
+}
@@ -0,0 +1,368 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Marks a maildir as a Maildir++ folder.
+const folderMarkerFile = "maildirfolder"
+
+// Contains the names of subscribed mailboxes, one per line.
+const subscriptionsFile = "subscriptions"
+
+type User struct {
+	username string
+	root string
+	backend *Backend
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+// Get the directory name of a mailbox. Names are encoded in modified UTF-7, as
+// other Maildir++ implementations do.
+func (u *User) mailboxPath(name string) (string, error) {
+	if isInbox(name) {
+		return u.root, nil
+	}
+
+	if name == "" || strings.ContainsAny(name, "/\\\x00") {
+		return "", errors.New("Invalid mailbox name")
+	}
+	for _, part := range strings.Split(name, Delimiter) {
+		if part == "" {
+			return "", errors.New("Invalid mailbox name")
+		}
+	}
+
+	enc, err := utf7.Encoder.String(name)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(u.root, Delimiter + enc), nil
+}
+
+func (u *User) mailbox(name string) (*Mailbox, error) {
+	if isInbox(name) {
+		name = "INBOX"
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !maildir(path).exists() {
+		return nil, errors.New("No such mailbox")
+	}
+
+	return &Mailbox{
+		name: name,
+		user: u,
+		folder: u.backend.folder(u, name, path),
+	}, nil
+}
+
+// List the names of all mailboxes, except INBOX.
+func (u *User) folderNames() ([]string, error) {
+	files, err := ioutil.ReadDir(u.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range files {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, Delimiter) || name == "." || name == ".." {
+			continue
+		}
+		if !maildir(filepath.Join(u.root, name)).exists() {
+			continue
+		}
+
+		dec, err := utf7.Decoder.String(strings.TrimPrefix(name, Delimiter))
+		if err != nil {
+			continue
+		}
+		names = append(names, dec)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (u *User) subscriptions() (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(u.root, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	subscribed := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			subscribed[name] = true
+		}
+	}
+	return subscribed, scanner.Err()
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	u.backend.locker.Lock()
+	defer u.backend.locker.Unlock()
+
+	path := filepath.Join(u.root, subscriptionsFile)
+	unlock, err := backendutil.LockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	subs, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+
+	if subscribed {
+		subs[name] = true
+	} else {
+		delete(subs, name)
+	}
+
+	var names []string
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name + "\n")
+	}
+	return backendutil.WriteFileAtomic(path, b.Bytes())
+}
+
+func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
+	names, err := u.folderNames()
+	if err != nil {
+		return
+	}
+	names = append([]string{"INBOX"}, names...)
+
+	var subs map[string]bool
+	if subscribed {
+		if subs, err = u.subscriptions(); err != nil {
+			return
+		}
+	}
+
+	for _, name := range names {
+		if subscribed && !subs[name] {
+			continue
+		}
+
+		var mbox *Mailbox
+		if mbox, err = u.mailbox(name); err != nil {
+			return
+		}
+		mailboxes = append(mailboxes, mbox)
+	}
+	return
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.mailbox(name)
+}
+
+// Create a maildir folder and its superiors.
+func (u *User) createFolder(name string) error {
+	parts := strings.Split(name, Delimiter)
+	for i := range parts {
+		path, err := u.mailboxPath(strings.Join(parts[:i+1], Delimiter))
+		if err != nil {
+			return err
+		}
+
+		d := maildir(path)
+		if d.exists() {
+			continue
+		}
+		if err := d.create(); err != nil {
+			return err
+		}
+
+		marker, err := os.Create(filepath.Join(path, folderMarkerFile))
+		if err != nil {
+			return err
+		}
+		marker.Close()
+	}
+
+	return nil
+}
+
+func (u *User) CreateMailbox(name string) error {
+	// A trailing delimiter only declares that the client intends to create
+	// mailbox names under this name
+	name = strings.TrimSuffix(name, Delimiter)
+
+	if isInbox(name) {
+		return errors.New("Mailbox already exists")
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+	if maildir(path).exists() {
+		return errors.New("Mailbox already exists")
+	}
+
+	return u.createFolder(name)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if isInbox(name) {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+	if !maildir(path).exists() {
+		return errors.New("No such mailbox")
+	}
+
+	// Inferior mailboxes are stored in other directories, so they are kept
+	u.backend.forgetFolders(path)
+	return os.RemoveAll(path)
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	if isInbox(newName) {
+		return errors.New("Mailbox already exists")
+	}
+
+	src, err := u.mailboxPath(existingName)
+	if err != nil {
+		return err
+	}
+	dst, err := u.mailboxPath(newName)
+	if err != nil {
+		return err
+	}
+
+	if !maildir(src).exists() {
+		return errors.New("No such mailbox")
+	}
+	if maildir(dst).exists() {
+		return errors.New("Mailbox already exists")
+	}
+
+	if isInbox(existingName) {
+		return u.renameInbox(newName)
+	}
+
+	names, err := u.folderNames()
+	if err != nil {
+		return err
+	}
+
+	// Create superiors of the new name, but not the new mailbox itself
+	if i := strings.LastIndex(newName, Delimiter); i >= 0 {
+		if err := u.createFolder(newName[:i]); err != nil {
+			return err
+		}
+	}
+
+	// Rename the mailbox and its inferiors
+	for _, name := range names {
+		if name != existingName && !strings.HasPrefix(name, existingName + Delimiter) {
+			continue
+		}
+
+		from, err := u.mailboxPath(name)
+		if err != nil {
+			return err
+		}
+		to, err := u.mailboxPath(newName + strings.TrimPrefix(name, existingName))
+		if err != nil {
+			return err
+		}
+
+		u.backend.forgetFolders(from)
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Move all messages in INBOX to a new mailbox. Inferiors of INBOX are not
+// affected.
+func (u *User) renameInbox(newName string) error {
+	if err := u.createFolder(newName); err != nil {
+		return err
+	}
+
+	inbox, err := u.mailbox("INBOX")
+	if err != nil {
+		return err
+	}
+	dest, err := u.mailbox(newName)
+	if err != nil {
+		return err
+	}
+
+	f := inbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if err := f.dir.moveNew(); err != nil {
+		return err
+	}
+
+	names, err := readDirNames(f.path("cur"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		from := filepath.Join(string(f.dir), "cur", name)
+		to := filepath.Join(string(dest.folder.dir), "cur", name)
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+	}
+
+	// Keywords are stored per maildir
+	if b, err := ioutil.ReadFile(f.path(keywordsFile)); err == nil {
+		if err := backendutil.WriteFileAtomic(dest.folder.path(keywordsFile), b); err != nil {
+			return err
+		}
+	}
+
+	return f.sync()
+}
@@ -0,0 +1,155 @@
+// A mbox backend.
+//
+// Each user has a directory in the backend's root directory, each mailbox is a
+// mbox file in this directory. The hierarchy delimiter is a slash, mailboxes
+// with inferiors are subdirectories. Messages are stored in the mboxrd format.
+//
+// UIDs and flags are stored in an index file next to each mbox file. Flags are
+// initialized from the Status and X-Status headers when a message is first
+// indexed. Mbox files are locked with dotlocks, so that they can safely be
+// modified by other programs such as mail delivery agents.
+package mbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// The hierarchy delimiter.
+const Delimiter = "/"
+
+// A function that checks a user's credentials. It must return an error if the
+// credentials are invalid.
+type AuthFunc func(username, password string) error
+
+type Backend struct {
+	root string
+	auth AuthFunc
+	updates *backend.Updates
+	queue *backendutil.UpdateQueue
+
+	locker sync.Mutex
+	// Mbox files that have been opened, indexed by path. They are shared between
+	// all mailboxes so that changes are only detected once.
+	folders map[string]*folder
+	lastUidValidity uint32
+}
+
+// Check if a username can be safely used as a directory name.
+func validUsername(username string) bool {
+	return username != "" && username != "." && username != ".." &&
+		!strings.ContainsAny(username, "/\\\x00") && !strings.HasPrefix(username, ".")
+}
+
+func (bkd *Backend) Login(username, password string) (backend.User, error) {
+	if !validUsername(username) {
+		return nil, errors.New("Invalid username")
+	}
+	if err := bkd.auth(username, password); err != nil {
+		return nil, err
+	}
+
+	u := &User{
+		username: username,
+		root: filepath.Join(bkd.root, username),
+		backend: bkd,
+	}
+
+	// Create INBOX if it doesn't exist yet
+	if err := os.MkdirAll(u.root, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(u.root, "INBOX"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	return u, nil
+}
+
+func (bkd *Backend) Updates() *backend.Updates {
+	return bkd.updates
+}
+
+// Generate a new UIDVALIDITY value. Values are strictly increasing, so that a
+// mailbox deleted and created again never gets the same one.
+func (bkd *Backend) newUidValidity() uint32 {
+	bkd.locker.Lock()
+	defer bkd.locker.Unlock()
+
+	v := uint32(time.Now().Unix())
+	if v <= bkd.lastUidValidity {
+		v = bkd.lastUidValidity + 1
+	}
+	bkd.lastUidValidity = v
+	return v
+}
+
+// Get the shared state of a mbox file.
+func (bkd *Backend) folder(u *User, name, path string) *folder {
+	bkd.locker.Lock()
+	defer bkd.locker.Unlock()
+
+	f, ok := bkd.folders[path]
+	if !ok {
+		f = &folder{
+			backend: bkd,
+			username: u.username,
+			name: name,
+			path: path,
+		}
+		bkd.folders[path] = f
+	}
+	return f
+}
+
+// Forget about a mbox file or directory that has been removed or renamed, and
+// about all mbox files it contains. Mailboxes still referencing them will
+// return errors.
+func (bkd *Backend) forgetFolders(path string) {
+	var removed []*folder
+
+	bkd.locker.Lock()
+	for p, f := range bkd.folders {
+		if p == path || strings.HasPrefix(p, path + string(filepath.Separator)) {
+			removed = append(removed, f)
+			delete(bkd.folders, p)
+		}
+	}
+	bkd.locker.Unlock()
+
+	// Folders lock the backend to generate UIDVALIDITY values, so they must not
+	// be locked while the backend is
+	for _, f := range removed {
+		f.locker.Lock()
+		f.removed = true
+		f.locker.Unlock()
+	}
+}
+
+// Create a new mbox backend. Users' mailboxes are stored in root, auth is used
+// to check users' credentials.
+func New(root string, auth AuthFunc) *Backend {
+	updates := &backend.Updates{
+		Statuses: make(chan *backend.StatusUpdate),
+		Flags: make(chan *backend.FlagsUpdate),
+		Added: make(chan *backend.AddedUpdate),
+		UidExpunges: make(chan *backend.UidExpungeUpdate),
+	}
+
+	return &Backend{
+		root: root,
+		auth: auth,
+		updates: updates,
+		queue: backendutil.NewUpdateQueue(updates),
+		folders: map[string]*folder{},
+	}
+}
@@ -0,0 +1,319 @@
+package mbox
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/common"
+)
+
+var errMailboxRemoved = errors.New("Mailbox has been deleted or renamed")
+
+// A message as seen by clients.
+type message struct {
+	uid uint32
+	flags []string
+}
+
+// The state of a mbox file, shared between all Mailbox values referencing it.
+type folder struct {
+	backend *Backend
+	username string
+	name string
+	path string
+
+	// Protects all fields below. It must be held while reading or writing
+	// files.
+	locker sync.Mutex
+	removed bool
+	// Set to true after the first synchronization. Before, clients can't know
+	// anything about the mbox file's contents and no updates are sent.
+	synced bool
+	// The index, loaded while the mbox file is locked.
+	index *index
+	// Messages sorted by UID, as seen by clients.
+	messages []*message
+}
+
+// Lock the mbox file and load its index, updating it if the file has been
+// modified by another program. The returned function must be called to unlock
+// the file.
+func (f *folder) open() (unlock func(), err error) {
+	if f.removed {
+		return nil, errMailboxRemoved
+	}
+
+	unlock, err = backendutil.LockFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.load(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+func (f *folder) load() error {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return errMailboxRemoved
+	} else if err != nil {
+		return err
+	}
+
+	idx, err := readIndex(indexPath(f.path))
+	if os.IsNotExist(err) {
+		idx = &index{
+			uidValidity: f.backend.newUidValidity(),
+			uidNext: 1,
+			size: -1,
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if idx.size != info.Size() || idx.modTime != info.ModTime().UnixNano() {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+
+		idx.update(parseMbox(b, 0), f.backend.newUidValidity)
+		idx.size = int64(len(b))
+		idx.modTime = info.ModTime().UnixNano()
+
+		if err := idx.write(indexPath(f.path)); err != nil {
+			return err
+		}
+	}
+
+	f.index = idx
+	return nil
+}
+
+// Save the index after it has been modified. The mbox file must be locked.
+func (f *folder) saveIndex() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.index.size = info.Size()
+	f.index.modTime = info.ModTime().UnixNano()
+	return f.index.write(indexPath(f.path))
+}
+
+// Read a message from the mbox file, in the form sent to clients. The mbox file
+// must be locked.
+func (f *folder) readMessage(r io.ReaderAt, e *entry) ([]byte, *common.Message, error) {
+	b := make([]byte, e.length)
+	if _, err := r.ReadAt(b, e.offset); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	messages := parseMbox(b, e.offset)
+	if len(messages) == 0 {
+		return nil, nil, errors.New("Index is out of date")
+	}
+	raw := messages[0]
+
+	date := raw.date
+	if date.IsZero() {
+		if info, err := os.Stat(f.path); err == nil {
+			date = info.ModTime()
+		}
+	}
+
+	return decodeMessage(raw.content), &common.Message{
+		Uid: e.uid,
+		Flags: e.flags,
+		InternalDate: &date,
+	}, nil
+}
+
+// Append a message to the mbox file. The mbox file must be locked.
+func (f *folder) appendMessage(flags []string, date time.Time, body []byte) error {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	// Messages must be separated by an empty line
+	var sep []byte
+	if size > 0 {
+		end := make([]byte, 2)
+		n := size
+		if n > 2 {
+			n = 2
+		}
+		if _, err := file.ReadAt(end[:n], size - n); err != nil {
+			return err
+		}
+
+		if !bytes.HasSuffix(end[:n], []byte("\n\n")) {
+			sep = []byte("\n")
+			if end[n-1] != '\n' {
+				sep = []byte("\n\n")
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(sep)
+	b.WriteString(formatFromLine(date))
+	content := encodeMessage(body)
+	b.Write(content)
+	b.WriteString("\n")
+
+	if _, err := file.Write(b.Bytes()); err != nil {
+		// Don't leave a partial message in the mbox file
+		file.Truncate(size)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	// The separator belongs to the previous message
+	if n := len(f.index.entries); n > 0 {
+		f.index.entries[n-1].length += int64(len(sep))
+	}
+
+	f.index.entries = append(f.index.entries, &entry{
+		uid: f.index.uidNext,
+		offset: size + int64(len(sep)),
+		length: int64(b.Len() - len(sep)),
+		sum: checksum(content),
+		flags: backendutil.UpdateFlags(nil, common.SetFlags, flags),
+	})
+	f.index.uidNext++
+
+	return f.saveIndex()
+}
+
+// Rewrite the mbox file without the messages for which keep returns false. The
+// mbox file must be locked.
+func (f *folder) rewrite(keep func(e *entry) bool) error {
+	src, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := ioutil.TempFile(filepath.Dir(f.path), "." + filepath.Base(f.path) + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+
+	var entries []*entry
+	var offset int64
+	for _, e := range f.index.entries {
+		if !keep(e) {
+			continue
+		}
+
+		b := make([]byte, e.length, e.length + 2)
+		if _, err := src.ReadAt(b, e.offset); err != nil && err != io.EOF {
+			dst.Close()
+			return err
+		}
+
+		// Make sure the message is followed by an empty line
+		if !bytes.HasSuffix(b, []byte("\n")) {
+			b = append(b, '\n')
+		}
+		if !bytes.HasSuffix(b, []byte("\n\n")) {
+			b = append(b, '\n')
+		}
+
+		if _, err := dst.Write(b); err != nil {
+			dst.Close()
+			return err
+		}
+
+		e.offset = offset
+		e.length = int64(len(b))
+		offset += e.length
+		entries = append(entries, e)
+	}
+
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Chmod(info.Mode()); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(dst.Name(), f.path); err != nil {
+		return err
+	}
+
+	f.index.entries = entries
+	return f.saveIndex()
+}
+
+func (f *folder) update() backend.Update {
+	return backend.Update{Username: f.username, Mailbox: f.name}
+}
+
+// Synchronize the clients' view of the mbox file with its contents, and queue
+// updates for changes.
+func (f *folder) sync() error {
+	unlock, err := f.open()
+	if err != nil {
+		return err
+	}
+	entries := f.index.entries
+	unlock()
+
+	messages := make([]*message, len(entries))
+	for i, e := range entries {
+		messages[i] = &message{uid: e.uid, flags: e.flags}
+	}
+
+	if !f.synced {
+		f.messages = messages
+		f.synced = true
+		return nil
+	}
+
+	f.backend.queue.Push(backendutil.DiffMessages(f.update(), states(f.messages), states(messages))...)
+
+	f.messages = messages
+	return nil
+}
+
+func states(messages []*message) []backendutil.MessageState {
+	states := make([]backendutil.MessageState, len(messages))
+	for i, msg := range messages {
+		states[i] = backendutil.MessageState{Uid: msg.uid, Flags: msg.flags}
+	}
+	return states
+}
@@ -0,0 +1,160 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/backend/backendutil"
+)
+
+// The version of the index format.
+const indexVersion = 1
+
+// An indexed message.
+type entry struct {
+	uid uint32
+	offset int64
+	length int64
+	sum uint32
+	flags []string
+}
+
+// A mbox index, stored in a hidden file next to the mbox file.
+//
+// The first line contains the format version, UIDVALIDITY, UIDNEXT and the size
+// and modification time of the mbox file when it was indexed. Each following
+// line describes a message: its UID, offset, length, checksum and flags.
+type index struct {
+	uidValidity uint32
+	uidNext uint32
+	size int64
+	modTime int64
+	entries []*entry
+}
+
+func indexPath(path string) string {
+	dir, name := filepath.Split(path)
+	return filepath.Join(dir, "." + name + ".index")
+}
+
+func readIndex(path string) (*index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := &index{}
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, errors.New("Empty index: " + path)
+	}
+
+	var version int
+	_, err = fmt.Sscanf(scanner.Text(), "%d %d %d %d %d", &version, &idx.uidValidity, &idx.uidNext, &idx.size, &idx.modTime)
+	if err != nil {
+		return nil, errors.New("Invalid index header: " + err.Error())
+	}
+	if version != indexVersion {
+		return nil, errors.New("Unsupported index version: " + strconv.Itoa(version))
+	}
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			return nil, errors.New("Invalid index entry: " + scanner.Text())
+		}
+
+		e := &entry{}
+		_, err := fmt.Sscanf(strings.Join(fields[:4], " "), "%d %d %d %x", &e.uid, &e.offset, &e.length, &e.sum)
+		if err != nil {
+			return nil, errors.New("Invalid index entry: " + err.Error())
+		}
+		e.flags = fields[4:]
+
+		idx.entries = append(idx.entries, e)
+	}
+
+	return idx, scanner.Err()
+}
+
+func (idx *index) write(path string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d %d %d %d %d\n", indexVersion, idx.uidValidity, idx.uidNext, idx.size, idx.modTime)
+	for _, e := range idx.entries {
+		fmt.Fprintf(&b, "%d %d %d %08x", e.uid, e.offset, e.length, e.sum)
+		for _, flag := range e.flags {
+			b.WriteString(" " + flag)
+		}
+		b.WriteString("\n")
+	}
+
+	return backendutil.WriteFileAtomic(path, b.Bytes())
+}
+
+// Get an entry by its UID.
+func (idx *index) entry(uid uint32) *entry {
+	for _, e := range idx.entries {
+		if e.uid == uid {
+			return e
+		}
+	}
+	return nil
+}
+
+// Update the index after the mbox file has been modified by another program.
+//
+// Messages are recognized by their checksum. Other programs only append or
+// remove messages, so indexed messages are expected in the same order. If
+// messages have been reordered, UIDs cannot be kept ascending and
+// newUidValidity is called to discard them all.
+func (idx *index) update(messages []*rawMessage, newUidValidity func() uint32) {
+	old := idx.entries
+	idx.entries = make([]*entry, 0, len(messages))
+
+	var lastUid uint32
+	valid := true
+	j := 0
+	for _, msg := range messages {
+		sum := checksum(msg.content)
+
+		var e *entry
+		for k := j; k < len(old); k++ {
+			if old[k].sum == sum {
+				e = old[k]
+				j = k + 1
+				break
+			}
+		}
+
+		if e == nil {
+			e = &entry{uid: idx.uidNext, flags: headerFlags(msg.content)}
+			idx.uidNext++
+		}
+		if e.uid <= lastUid {
+			valid = false
+		}
+		lastUid = e.uid
+
+		e.offset = msg.offset
+		e.length = msg.length
+		e.sum = sum
+		idx.entries = append(idx.entries, e)
+	}
+
+	if !valid {
+		idx.uidValidity = newUidValidity()
+		idx.uidNext = 1
+		for _, e := range idx.entries {
+			e.uid = idx.uidNext
+			idx.uidNext++
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package mbox
+
+import (
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/common"
+)
+
+var systemFlags = []string{
+	common.AnsweredFlag,
+	common.FlaggedFlag,
+	common.DeletedFlag,
+	common.SeenFlag,
+	common.DraftFlag,
+}
+
+type Mailbox struct {
+	name string
+	user *User
+	folder *folder
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*common.MailboxInfo, error) {
+	info := &common.MailboxInfo{
+		Delimiter: Delimiter,
+		Name: mbox.name,
+		Attributes: []string{"\\Noinferiors"},
+	}
+	return info, nil
+}
+
+func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
+	f := mbox.folder
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if err := f.sync(); err != nil {
+		return nil, err
+	}
+
+	status := &common.MailboxStatus{
+		Items: items,
+		Name: mbox.name,
+		Flags: systemFlags,
+		PermanentFlags: append(append([]string(nil), systemFlags...), "\\*"),
+	}
+
+	for _, name := range items {
+		switch name {
+		case common.MailboxMessages:
+			status.Messages = uint32(len(f.messages))
+		case common.MailboxUidNext:
+			status.UidNext = f.index.uidNext
+		case common.MailboxUidValidity:
+			status.UidValidity = f.index.uidValidity
+		case common.MailboxRecent:
+			status.Recent = 0
+		case common.MailboxUnseen:
+			status.Unseen = 0
+			for _, msg := range f.messages {
+				if !backendutil.HasFlag(msg.flags, common.SeenFlag) {
+					status.Unseen++
+				}
+			}
+		}
+	}
+
+	return status, nil
+}
+
+func (mbox *Mailbox) Subscribe() error {
+	return mbox.user.setSubscribed(mbox.name, true)
+}
+
+func (mbox *Mailbox) Unsubscribe() error {
+	return mbox.user.setSubscribed(mbox.name, false)
+}
+
+func (mbox *Mailbox) Check() error {
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	return f.sync()
+}
+
+// Poll checks the mbox file for changes made by other programs, e.g. messages
+// delivered by an MDA.
+func (mbox *Mailbox) Poll() error {
+	return mbox.Check()
+}
+
+// Get the UIDs of the messages matching a sequence set, along with their
+// sequence numbers. The folder must be locked.
+func (mbox *Mailbox) messages(uid bool, seqset *common.SeqSet) (seqNums []uint32, uids []uint32) {
+	f := mbox.folder
+
+	var max uint32
+	if n := len(f.messages); n > 0 {
+		if uid {
+			max = f.messages[n-1].uid
+		} else {
+			max = uint32(n)
+		}
+	}
+
+	for i, msg := range f.messages {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if !backendutil.SeqSetContains(seqset, id, max) {
+			continue
+		}
+
+		seqNums = append(seqNums, seqNum)
+		uids = append(uids, msg.uid)
+	}
+
+	return
+}
+
+// Check if fetching items requires reading messages.
+func needsContents(items []string) bool {
+	for _, item := range items {
+		switch item {
+		case "UID", "FLAGS":
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	defer close(ch)
+
+	f := mbox.folder
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if !f.synced {
+		if err := f.sync(); err != nil {
+			return err
+		}
+	}
+
+	seqNums, uids := mbox.messages(uid, seqset)
+
+	// Messages are read while the mbox file is locked, and sent once it has
+	// been unlocked so that slow clients don't block other programs
+	var messages []*common.Message
+	err := func() error {
+		unlock, err := f.open()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		file, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		for i, uid := range uids {
+			e := f.index.entry(uid)
+			if e == nil {
+				// The message has been removed by another program, it will be
+				// expunged during the next synchronization
+				continue
+			}
+
+			var m *common.Message
+			if needsContents(items) {
+				b, msg, err := f.readMessage(file, e)
+				if err != nil {
+					return err
+				}
+
+				msg.SeqNum = seqNums[i]
+				m = backendutil.FetchMessage(msg, b, items)
+			} else {
+				m = backendutil.FetchMessage(&common.Message{
+					SeqNum: seqNums[i],
+					Uid: e.uid,
+					Flags: e.flags,
+				}, nil, items)
+			}
+
+			messages = append(messages, m)
+		}
+
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		ch <- m
+	}
+	return nil
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *common.SearchCriteria) (ids []uint32, err error) {
+	f := mbox.folder
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if !f.synced {
+		if err = f.sync(); err != nil {
+			return
+		}
+	}
+
+	unlock, err := f.open()
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	var maxUid uint32
+	if n := len(f.messages); n > 0 {
+		maxUid = f.messages[n-1].uid
+	}
+
+	for i, msg := range f.messages {
+		e := f.index.entry(msg.uid)
+		if e == nil {
+			continue
+		}
+
+		b, m, err := f.readMessage(file, e)
+		if err != nil {
+			return nil, err
+		}
+
+		m.SeqNum = uint32(i + 1)
+		if !backendutil.Match(m, b, uint32(len(f.messages)), maxUid, criteria) {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, m.SeqNum)
+		}
+	}
+
+	return
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date *time.Time, body []byte) error {
+	if date == nil {
+		now := time.Now()
+		date = &now
+	}
+
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	unlock, err := f.open()
+	if err != nil {
+		return err
+	}
+	err = f.appendMessage(flags, *date, body)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.sync()
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op common.FlagsOp, flags []string) error {
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	unlock, err := f.open()
+	if err != nil {
+		return err
+	}
+
+	_, uids := mbox.messages(uid, seqset)
+	for _, uid := range uids {
+		// Flags may have been changed by another process since the last
+		// synchronization, start from the current ones
+		if e := f.index.entry(uid); e != nil {
+			e.flags = backendutil.UpdateFlags(e.flags, op, flags)
+		}
+	}
+
+	err = f.index.write(indexPath(f.path))
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.sync()
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *common.SeqSet, destName string) error {
+	dest, err := mbox.user.mailbox(destName)
+	if err != nil {
+		return err
+	}
+
+	type copied struct {
+		body []byte
+		flags []string
+		date time.Time
+	}
+
+	// Read messages first, so that the source and the destination are never
+	// locked at the same time
+	var toCopy []copied
+	err = func() error {
+		f := mbox.folder
+		f.locker.Lock()
+		defer f.locker.Unlock()
+
+		unlock, err := f.open()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		file, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, uids := mbox.messages(uid, seqset)
+		for _, uid := range uids {
+			e := f.index.entry(uid)
+			if e == nil {
+				continue
+			}
+
+			b, m, err := f.readMessage(file, e)
+			if err != nil {
+				return err
+			}
+			toCopy = append(toCopy, copied{b, m.Flags, *m.InternalDate})
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	df := dest.folder
+	defer df.backend.queue.Flush()
+	df.locker.Lock()
+	defer df.locker.Unlock()
+
+	unlock, err := df.open()
+	if err != nil {
+		return err
+	}
+	for _, c := range toCopy {
+		if err = df.appendMessage(c.flags, c.date, c.body); err != nil {
+			break
+		}
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	return df.sync()
+}
+
+func (mbox *Mailbox) Expunge() error {
+	f := mbox.folder
+	defer f.backend.queue.Flush()
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	unlock, err := f.open()
+	if err != nil {
+		return err
+	}
+
+	deleted := false
+	for _, e := range f.index.entries {
+		if backendutil.HasFlag(e.flags, common.DeletedFlag) {
+			deleted = true
+			break
+		}
+	}
+
+	if deleted {
+		err = f.rewrite(func(e *entry) bool {
+			return !backendutil.HasFlag(e.flags, common.DeletedFlag)
+		})
+	}
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	return f.sync()
+}
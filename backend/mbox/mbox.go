@@ -0,0 +1,182 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// The date format used in From_ lines, as produced by asctime(3).
+const fromLineDate = "Mon Jan _2 15:04:05 2006"
+
+var fromPrefix = []byte("From ")
+
+// A message in a mbox file.
+type rawMessage struct {
+	// The offset of the message's From_ line.
+	offset int64
+	// The length of the message, including its From_ line and the empty line
+	// separating it from the next message.
+	length int64
+	// The date in the From_ line. Zero if it cannot be parsed.
+	date time.Time
+	// The message contents, as stored in the mbox file.
+	content []byte
+}
+
+// Split the contents of a mbox file into messages. A message starts with a line
+// beginning with "From " at the beginning of the file or after an empty line.
+// Data before the first From_ line is ignored.
+func parseMbox(b []byte, base int64) []*rawMessage {
+	var messages []*rawMessage
+	var cur *rawMessage
+	var start int
+
+	finish := func(end int) {
+		if cur == nil {
+			return
+		}
+		cur.length = int64(end) + base - cur.offset
+		cur.content = trimSeparator(b[start:end])
+		messages = append(messages, cur)
+	}
+
+	prevEmpty := true
+	for i := 0; i < len(b); {
+		end := len(b)
+		if j := bytes.IndexByte(b[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		line := b[i:end]
+
+		if prevEmpty && bytes.HasPrefix(line, fromPrefix) {
+			finish(i)
+			cur = &rawMessage{offset: base + int64(i), date: parseFromLine(line)}
+			start = end
+		}
+
+		prevEmpty = len(bytes.TrimRight(line, "\r\n")) == 0
+		i = end
+	}
+	finish(len(b))
+
+	return messages
+}
+
+// Remove the empty line separating a message from the next one.
+func trimSeparator(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+		return b[:len(b)-2]
+	}
+	if bytes.HasSuffix(b, []byte("\n\n")) {
+		return b[:len(b)-1]
+	}
+	return b
+}
+
+// Parse the date of a From_ line, e.g. "From user@example.org Mon Jan  2
+// 15:04:05 2006".
+func parseFromLine(line []byte) time.Time {
+	fields := strings.Fields(string(line[len(fromPrefix):]))
+	if len(fields) < 6 {
+		return time.Time{}
+	}
+
+	t, err := time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[1:6], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func formatFromLine(date time.Time) string {
+	return "From MAILER-DAEMON " + date.UTC().Format(fromLineDate) + "\n"
+}
+
+// Check if a line is a From_ line, possibly quoted with ">" characters.
+func isQuotedFromLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), fromPrefix)
+}
+
+// Convert a message stored in a mbox file to its original form: From_ lines are
+// unquoted and lines end with CRLF, as required by IMAP. This is the mboxrd
+// format.
+func decodeMessage(b []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(b) + len(b) / 40)
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b) + 1)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if len(line) > 0 && line[0] == '>' && isQuotedFromLine(line) {
+			line = line[1:]
+		}
+
+		out.Write(line)
+		out.WriteString("\r\n")
+	}
+
+	return out.Bytes()
+}
+
+// Convert a message to the form stored in mbox files: lines end with LF and
+// lines that could be mistaken for a From_ line are quoted with ">".
+func encodeMessage(b []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(b))
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b) + 1)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if isQuotedFromLine(line) {
+			out.WriteByte('>')
+		}
+
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+
+	return out.Bytes()
+}
+
+// Compute a message checksum, used to recognize messages after the mbox file
+// has been modified by another program.
+func checksum(content []byte) uint32 {
+	return crc32.ChecksumIEEE(bytes.TrimRight(content, "\r\n"))
+}
+
+// Get the flags stored in a message's Status and X-Status headers, as written by
+// mutt, pine and other mail clients.
+func headerFlags(content []byte) []string {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+	h, _ := r.ReadMIMEHeader()
+
+	var flags []string
+	if strings.Contains(h.Get("Status"), "R") {
+		flags = append(flags, common.SeenFlag)
+	}
+
+	xstatus := h.Get("X-Status")
+	for _, f := range []struct{
+		letter string
+		flag string
+	}{
+		{"A", common.AnsweredFlag},
+		{"F", common.FlaggedFlag},
+		{"T", common.DraftFlag},
+		{"D", common.DeletedFlag},
+	} {
+		if strings.Contains(xstatus, f.letter) {
+			flags = append(flags, f.flag)
+		}
+	}
+
+	return flags
+}
@@ -0,0 +1,270 @@
+package mbox_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/mbox"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/internal"
+)
+
+func allowAll(username, password string) error {
+	return nil
+}
+
+// Create a backend whose updates are discarded.
+func newBackend(t *testing.T) (bkd *mbox.Backend, root string) {
+	root = internal.TempDir(t, "go-imap-mbox")
+	bkd = mbox.New(root, allowAll)
+	go internal.DiscardUpdates(bkd.Updates(), nil)
+	return bkd, root
+}
+
+func TestMailbox_CreateMessage_mboxrd(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	body := strings.Join([]string{
+		"Subject: Quoting",
+		"",
+		"From the beginning",
+		">From a quoted line",
+		">>From a doubly quoted line",
+		"Not From a From_ line",
+		"",
+	}, "\r\n")
+
+	mailbox := internal.GetMailbox(t, bkd, "INBOX")
+	if err := mailbox.CreateMessage(nil, nil, []byte(body)); err != nil {
+		t.Fatal("Cannot create message:", err)
+	}
+	if err := mailbox.CreateMessage(nil, nil, []byte("Subject: Second\r\n\r\nFrom here\r\n")); err != nil {
+		t.Fatal("Cannot create message:", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "username", "INBOX"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"\n>From the beginning\n", "\n>>From a quoted line\n", "\n>>>From a doubly quoted line\n", "\nNot From a From_ line\n", "\n>From here\n"} {
+		if !strings.Contains(string(b), line) {
+			t.Errorf("Line %q not escaped in mbox file:\n%v", strings.TrimSpace(line), string(b))
+		}
+	}
+	if n := strings.Count(string(b), "\nFrom ") + 1; n != 2 {
+		t.Errorf("Expected 2 From_ lines in mbox file, got %v", n)
+	}
+
+	// Messages are returned in their original form, with CRLF line endings
+	messages := internal.ListMessages(t, mailbox, []string{"BODY[]"})
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(messages))
+	}
+	for section, literal := range messages[0].Body {
+		if literal == nil || literal.String() != body {
+			t.Errorf("Bad %v: got %q, want %q", section, literal, body)
+		}
+	}
+}
+
+func TestMailbox_uids(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	mailbox := internal.GetMailbox(t, bkd, "INBOX")
+	mailbox.CreateMessage(nil, nil, []byte("Subject: first\r\n\r\n"))
+	mailbox.CreateMessage(nil, nil, []byte("Subject: second\r\n\r\n"))
+
+	status, err := mailbox.Status([]string{common.MailboxUidValidity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validity := status.UidValidity
+
+	// A message delivered by an MDA
+	path := filepath.Join(root, "username", "INBOX")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("From MAILER-DAEMON Wed May 11 14:31:59 2016\nStatus: RO\nSubject: third\n\nHi\n\n")
+	f.Close()
+
+	// UIDs must be kept by a new backend, e.g. after a restart
+	bkd = mbox.New(root, allowAll)
+	go internal.DiscardUpdates(bkd.Updates(), nil)
+	mailbox = internal.GetMailbox(t, bkd, "INBOX")
+	if uids := internal.ListUids(t, mailbox); !reflect.DeepEqual(uids, []uint32{1, 2, 3}) {
+		t.Errorf("Bad UIDs: got %v, want [1 2 3]", uids)
+	}
+
+	status, err = mailbox.Status([]string{common.MailboxUidValidity, common.MailboxUidNext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UidValidity != validity {
+		t.Errorf("UIDVALIDITY changed: got %v, want %v", status.UidValidity, validity)
+	}
+	if status.UidNext != 4 {
+		t.Errorf("Bad UIDNEXT: got %v, want 4", status.UidNext)
+	}
+
+	// Flags are initialized from the Status header
+	messages := internal.ListMessages(t, mailbox, []string{"UID", "FLAGS"})
+	if flags := messages[2].Flags; !reflect.DeepEqual(flags, []string{common.SeenFlag}) {
+		t.Errorf("Bad flags of delivered message: got %v", flags)
+	}
+}
+
+func TestMailbox_Expunge_updates(t *testing.T) {
+	root := internal.TempDir(t, "go-imap-mbox")
+	defer os.RemoveAll(root)
+
+	bkd := mbox.New(root, allowAll)
+	mailbox := internal.GetMailbox(t, bkd, "INBOX")
+	internal.ListUids(t, mailbox)
+
+	internal.CheckExpungeUpdates(t, bkd, mailbox)
+}
+
+func TestMailbox_headerFlags(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	// Flags written by other mail clients in the Status and X-Status headers
+	path := filepath.Join(root, "username", "INBOX")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Join([]string{
+		"From MAILER-DAEMON Wed May 11 14:31:59 2016",
+		"Status: RO",
+		"X-Status: AF",
+		"Subject: first",
+		"",
+		"Hi",
+		"",
+		"From MAILER-DAEMON Wed May 11 14:32:00 2016",
+		"Status: O",
+		"X-Status: TD",
+		"Subject: second",
+		"",
+		"Hi",
+		"",
+		"From MAILER-DAEMON Wed May 11 14:32:01 2016",
+		"Subject: third",
+		"",
+		"Hi",
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mailbox := internal.GetMailbox(t, bkd, "INBOX")
+	messages := internal.ListMessages(t, mailbox, []string{"UID", "FLAGS"})
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %v", len(messages))
+	}
+
+	expected := [][]string{
+		{common.SeenFlag, common.AnsweredFlag, common.FlaggedFlag},
+		{common.DraftFlag, common.DeletedFlag},
+		nil,
+	}
+	for i, msg := range messages {
+		if len(msg.Flags) == 0 && len(expected[i]) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(msg.Flags, expected[i]) {
+			t.Errorf("Bad flags of message %v: got %v, want %v", i + 1, msg.Flags, expected[i])
+		}
+	}
+}
+
+func TestMailbox_Expunge_locked(t *testing.T) {
+	bkd, root := newBackend(t)
+	defer os.RemoveAll(root)
+
+	body := "Subject: Kept\r\n\r\nFrom the beginning\r\n>From a quoted line\r\n"
+
+	mailbox := internal.GetMailbox(t, bkd, "INBOX")
+	if err := mailbox.CreateMessage([]string{common.DeletedFlag}, nil, []byte("Subject: Deleted\r\n\r\nFrom here\r\n")); err != nil {
+		t.Fatal("Cannot create message:", err)
+	}
+	if err := mailbox.CreateMessage(nil, nil, []byte(body)); err != nil {
+		t.Fatal("Cannot create message:", err)
+	}
+
+	// Another program, e.g. an MDA, has locked the mbox file
+	path := filepath.Join(root, "username", "INBOX")
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path + ".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go (func() {
+		done <- mailbox.Expunge()
+	})()
+
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatal("Expunge didn't wait for the lock:", err)
+	default:
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != string(before) {
+		t.Fatalf("Mbox file modified while locked by another program (error: %v)", err)
+	}
+
+	if err := os.Remove(path + ".lock"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Cannot expunge:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expunge still waiting after the lock has been released")
+	}
+
+	// The file is rewritten without the deleted message, quoted From_ lines are
+	// kept as they are
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "Deleted") || strings.Count(string(b), "\nFrom ") + 1 != 1 {
+		t.Errorf("Deleted message still in mbox file:\n%v", string(b))
+	}
+	if !strings.Contains(string(b), "\n>From the beginning\n>>From a quoted line\n") {
+		t.Errorf("Quoting changed in mbox file:\n%v", string(b))
+	}
+	if files, _ := filepath.Glob(filepath.Join(root, "username", ".INBOX.tmp*")); len(files) > 0 {
+		t.Errorf("Temporary files left: %v", files)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Lock not removed: %v", err)
+	}
+
+	messages := internal.ListMessages(t, mailbox, []string{"UID", "BODY[]"})
+	if len(messages) != 1 || messages[0].Uid != 2 {
+		t.Fatalf("Bad messages after expunge: %v", messages)
+	}
+	for section, literal := range messages[0].Body {
+		if literal == nil || literal.String() != body {
+			t.Errorf("Bad %v: got %q, want %q", section, literal, body)
+		}
+	}
+}
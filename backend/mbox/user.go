@@ -0,0 +1,344 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Contains the names of subscribed mailboxes, one per line.
+const subscriptionsFile = ".subscriptions"
+
+type User struct {
+	username string
+	root string
+	backend *Backend
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+// Get the path of a mailbox. Each component of the name is encoded in modified
+// UTF-7. Components starting with a dot are rejected, because hidden files are
+// used to store indexes.
+func (u *User) mailboxPath(name string) (string, error) {
+	if isInbox(name) {
+		return filepath.Join(u.root, "INBOX"), nil
+	}
+
+	if name == "" || strings.ContainsAny(name, "\\\x00") {
+		return "", errors.New("Invalid mailbox name")
+	}
+
+	parts := strings.Split(name, Delimiter)
+	for i, part := range parts {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return "", errors.New("Invalid mailbox name")
+		}
+		if i == 0 && isInbox(part) {
+			return "", errors.New("INBOX cannot have inferiors")
+		}
+
+		enc, err := utf7.Encoder.String(part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = enc
+	}
+
+	return filepath.Join(u.root, filepath.Join(parts...)), nil
+}
+
+func isMbox(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (u *User) mailbox(name string) (*Mailbox, error) {
+	if isInbox(name) {
+		name = "INBOX"
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isMbox(path) {
+		return nil, errors.New("No such mailbox")
+	}
+
+	return &Mailbox{
+		name: name,
+		user: u,
+		folder: u.backend.folder(u, name, path),
+	}, nil
+}
+
+// List the names of all mailboxes.
+func (u *User) mailboxNames() ([]string, error) {
+	var names []string
+	err := filepath.Walk(u.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == u.root {
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(u.root, path)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		for i, part := range parts {
+			dec, err := utf7.Decoder.String(part)
+			if err != nil {
+				return nil
+			}
+			parts[i] = dec
+		}
+
+		names = append(names, strings.Join(parts, Delimiter))
+		return nil
+	})
+
+	sort.Strings(names)
+	return names, err
+}
+
+func (u *User) subscriptions() (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(u.root, subscriptionsFile))
+	if os.IsNotExist(err) {
+		return map[string]bool{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	subscribed := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			subscribed[name] = true
+		}
+	}
+	return subscribed, scanner.Err()
+}
+
+func (u *User) setSubscribed(name string, subscribed bool) error {
+	u.backend.locker.Lock()
+	defer u.backend.locker.Unlock()
+
+	path := filepath.Join(u.root, subscriptionsFile)
+	unlock, err := backendutil.LockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	subs, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+
+	if subscribed {
+		subs[name] = true
+	} else {
+		delete(subs, name)
+	}
+
+	var names []string
+	for name := range subs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		b.WriteString(name + "\n")
+	}
+	return backendutil.WriteFileAtomic(path, b.Bytes())
+}
+
+func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
+	names, err := u.mailboxNames()
+	if err != nil {
+		return
+	}
+
+	var subs map[string]bool
+	if subscribed {
+		if subs, err = u.subscriptions(); err != nil {
+			return
+		}
+	}
+
+	for _, name := range names {
+		if subscribed && !subs[name] {
+			continue
+		}
+
+		var mbox *Mailbox
+		if mbox, err = u.mailbox(name); err != nil {
+			return
+		}
+		mailboxes = append(mailboxes, mbox)
+	}
+	return
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	return u.mailbox(name)
+}
+
+func (u *User) CreateMailbox(name string) error {
+	// A trailing delimiter only declares that the client intends to create
+	// mailbox names under this name
+	if strings.HasSuffix(name, Delimiter) {
+		path, err := u.mailboxPath(strings.TrimSuffix(name, Delimiter))
+		if err != nil {
+			return err
+		}
+		if isMbox(path) {
+			return errors.New("Mailbox cannot have inferiors")
+		}
+		return os.MkdirAll(path, 0700)
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.New("Mailbox cannot have inferiors")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return errors.New("Mailbox already exists")
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	if isInbox(name) {
+		return errors.New("Cannot delete INBOX")
+	}
+
+	path, err := u.mailboxPath(name)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return errors.New("No such mailbox")
+	} else if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		// Mailboxes with inferiors are only deleted once they are empty
+		return os.Remove(path)
+	}
+
+	unlock, err := backendutil.LockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	u.backend.forgetFolders(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(indexPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	src, err := u.mailboxPath(existingName)
+	if err != nil {
+		return err
+	}
+	dst, err := u.mailboxPath(newName)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return errors.New("No such mailbox")
+	} else if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dst); err == nil || isInbox(newName) {
+		return errors.New("Mailbox already exists")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return errors.New("Mailbox cannot have inferiors")
+	}
+
+	if info.IsDir() {
+		// Renaming the directory renames all inferiors
+		u.backend.forgetFolders(src)
+		return os.Rename(src, dst)
+	}
+
+	unlock, err := backendutil.LockFile(src)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	u.backend.forgetFolders(src)
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := os.Rename(indexPath(src), indexPath(dst)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Renaming INBOX moves all its messages to the new mailbox, and leaves
+	// INBOX empty
+	if isInbox(existingName) {
+		f, err := os.OpenFile(src, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	return nil
+}
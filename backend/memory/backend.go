@@ -3,6 +3,7 @@ package memory
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/backend"
@@ -10,10 +11,21 @@ import (
 )
 
 type Backend struct {
+	// Receives errors occurring in the background, e.g. when AutoSave cannot
+	// save a snapshot. If nil, they're printed with the standard logger.
+	Logger common.Logger
+
 	users map[string]*User
+
+	// Protects users, mailboxes and messages. Mailbox operations are done with
+	// the lock held so that snapshots are always consistent.
+	locker sync.RWMutex
 }
 
 func (bkd *Backend) Login(username, password string) (backend.User, error) {
+	bkd.locker.RLock()
+	defer bkd.locker.RUnlock()
+
 	user, ok := bkd.users[username]
 	if ok && user.password == password {
 		return user, nil
@@ -23,7 +35,8 @@ func (bkd *Backend) Login(username, password string) (backend.User, error) {
 }
 
 func New() *Backend {
-	user := &User{username: "username", password: "password"}
+	bkd := &Backend{}
+	user := &User{username: "username", password: "password", backend: bkd}
 
 	body := `From: contact@example.org
 To: contact@example.org
@@ -38,6 +51,7 @@ Hi there :)`
 	user.mailboxes = map[string]*Mailbox{
 		"INBOX": &Mailbox{
 			name: "INBOX",
+			uidValidity: 1,
 			messages: []*Message{
 				&Message{&common.Message{
 					Uid: 6,
@@ -58,7 +72,6 @@ Hi there :)`
 		},
 	}
 
-	return &Backend{
-		users: map[string]*User{user.username: user},
-	}
+	bkd.users = map[string]*User{user.username: user}
+	return bkd
 }
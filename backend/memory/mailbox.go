@@ -4,12 +4,17 @@ import (
 	"errors"
 	"time"
 
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-imap/common"
 )
 
 type Mailbox struct {
 	name string
 	subscribed bool
+	uidValidity uint32
+	// The highest UID ever assigned in this mailbox. It is kept even if the
+	// message has been expunged so that UIDs are never reused.
+	lastUid uint32
 	messages []*Message
 	user *User
 }
@@ -28,6 +33,7 @@ func (mbox *Mailbox) Info() (*common.MailboxInfo, error) {
 }
 
 func (mbox *Mailbox) uidNext() (uid uint32) {
+	uid = mbox.lastUid
 	for _, msg := range mbox.messages {
 		if msg.Uid > uid {
 			uid = msg.Uid
@@ -38,6 +44,9 @@ func (mbox *Mailbox) uidNext() (uid uint32) {
 }
 
 func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
+	mbox.user.backend.locker.RLock()
+	defer mbox.user.backend.locker.RUnlock()
+
 	status := &common.MailboxStatus{
 		Items: items,
 		Name: mbox.name,
@@ -52,7 +61,7 @@ func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
 		case "UIDNEXT":
 			status.UidNext = mbox.uidNext()
 		case "UIDVALIDITY":
-			status.UidValidity = 1
+			status.UidValidity = mbox.uidValidity
 		case "RECENT":
 			status.Recent = 0
 		case "UNSEEN":
@@ -64,11 +73,17 @@ func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
 }
 
 func (mbox *Mailbox) Subscribe() error {
+	mbox.user.backend.locker.Lock()
+	defer mbox.user.backend.locker.Unlock()
+
 	mbox.subscribed = true
 	return nil
 }
 
 func (mbox *Mailbox) Unsubscribe() error {
+	mbox.user.backend.locker.Lock()
+	defer mbox.user.backend.locker.Unlock()
+
 	mbox.subscribed = false
 	return nil
 }
@@ -80,6 +95,10 @@ func (mbox *Mailbox) Check() error {
 func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) (err error) {
 	defer close(ch)
 
+	// Don't hold the lock while sending messages, a slow client would block
+	// all other operations
+	mbox.user.backend.locker.RLock()
+	var messages []*common.Message
 	for i, msg := range mbox.messages {
 		seqNum := uint32(i+1)
 
@@ -95,6 +114,14 @@ func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []strin
 
 		m := msg.Metadata(items)
 		m.SeqNum = seqNum
+		if m.Flags != nil {
+			m.Flags = append([]string(nil), m.Flags...)
+		}
+		messages = append(messages, m)
+	}
+	mbox.user.backend.locker.RUnlock()
+
+	for _, m := range messages {
 		ch <- m
 	}
 
@@ -102,8 +129,16 @@ func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []strin
 }
 
 func (mbox *Mailbox) SearchMessages(uid bool, criteria *common.SearchCriteria) (ids []uint32, err error) {
+	mbox.user.backend.locker.RLock()
+	defer mbox.user.backend.locker.RUnlock()
+
+	var maxUid uint32
+	if n := len(mbox.messages); n > 0 {
+		maxUid = mbox.messages[n-1].Uid
+	}
+
 	for i, msg := range mbox.messages {
-		if !msg.Matches(criteria) {
+		if !msg.MatchesSeqNum(uint32(i+1), uint32(len(mbox.messages)), maxUid, criteria) {
 			continue
 		}
 
@@ -120,15 +155,21 @@ func (mbox *Mailbox) SearchMessages(uid bool, criteria *common.SearchCriteria) (
 }
 
 func (mbox *Mailbox) CreateMessage(flags []string, date *time.Time, body []byte) error {
+	mbox.user.backend.locker.Lock()
+	defer mbox.user.backend.locker.Unlock()
+
 	if date == nil {
 		now := time.Now()
 		date = &now
 	}
 
+	uid := mbox.uidNext()
+	mbox.lastUid = uid
+
 	mbox.messages = append(mbox.messages, &Message{&common.Message{
-		Uid: mbox.uidNext(),
-		Envelope: &common.Envelope{},
-		BodyStructure: &common.BodyStructure{MimeType: "text", MimeSubType: "plain"},
+		Uid: uid,
+		Envelope: backendutil.FetchEnvelope(body),
+		BodyStructure: backendutil.FetchBodyStructure(body, true),
 		Size: uint32(len(body)),
 		InternalDate: date,
 		Flags: flags,
@@ -138,6 +179,9 @@ func (mbox *Mailbox) CreateMessage(flags []string, date *time.Time, body []byte)
 }
 
 func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op common.FlagsOp, flags []string) error {
+	mbox.user.backend.locker.Lock()
+	defer mbox.user.backend.locker.Unlock()
+
 	for i, msg := range mbox.messages {
 		var id uint32
 		if uid {
@@ -149,33 +193,16 @@ func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op com
 			continue
 		}
 
-		switch op {
-		case common.SetFlags:
-			// TODO: keep \Recent if it is present
-			msg.Flags = flags
-		case common.AddFlags:
-			// TODO: check for duplicates
-			msg.Flags = append(msg.Flags, flags...)
-		case common.RemoveFlags:
-			// Iterate through flags from the last one to the first one, to be able to
-			// delete some of them.
-			for i := len(msg.Flags) - 1; i >= 0; i-- {
-				flag := msg.Flags[i]
-
-				for _, removeFlag := range flags {
-					if removeFlag == flag {
-						msg.Flags = append(msg.Flags[:i], msg.Flags[i+1:]...)
-						break
-					}
-				}
-			}
-		}
+		msg.Flags = backendutil.UpdateFlags(msg.Flags, op, flags)
 	}
 
 	return nil
 }
 
 func (mbox *Mailbox) CopyMessages(uid bool, seqset *common.SeqSet, destName string) error {
+	mbox.user.backend.locker.Lock()
+	defer mbox.user.backend.locker.Unlock()
+
 	dest, ok := mbox.user.mailboxes[destName]
 	if !ok {
 		return errors.New("Destination mailbox doesn't exist")
@@ -192,15 +219,20 @@ func (mbox *Mailbox) CopyMessages(uid bool, seqset *common.SeqSet, destName stri
 			continue
 		}
 
-		msgCopy := *msg
+		msgCopy := *msg.Message
 		msgCopy.Uid = dest.uidNext()
-		dest.messages = append(dest.messages, &msgCopy)
+		msgCopy.Flags = append([]string(nil), msg.Flags...)
+		dest.lastUid = msgCopy.Uid
+		dest.messages = append(dest.messages, &Message{&msgCopy, msg.body})
 	}
 
 	return nil
 }
 
 func (mbox *Mailbox) Expunge() error {
+	mbox.user.backend.locker.Lock()
+	defer mbox.user.backend.locker.Unlock()
+
 	for i := len(mbox.messages) - 1; i >= 0; i-- {
 		msg := mbox.messages[i]
 
@@ -0,0 +1,36 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/common"
+)
+
+func TestMailbox_ListMessages_slowConsumer(t *testing.T) {
+	bkd := memory.New()
+	mbox := getMailbox(t, bkd, "INBOX")
+
+	// Nobody reads from ch until the end of the test
+	seqset, _ := common.NewSeqSet("1:*")
+	ch := make(chan *common.Message)
+	go mbox.ListMessages(false, seqset, []string{"UID"}, ch)
+	defer (func() {
+		for range ch {}
+	})()
+
+	done := make(chan error, 1)
+	go (func() {
+		done <- mbox.CreateMessage(nil, nil, []byte("Subject: Hi\r\n\r\n"))
+	})()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Cannot create message:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("A slow ListMessages consumer blocks writers")
+	}
+}
@@ -1,8 +1,7 @@
 package memory
 
 import (
-	"bytes"
-
+	"github.com/emersion/go-imap/backend/backendutil"
 	"github.com/emersion/go-imap/common"
 )
 
@@ -38,30 +37,9 @@ func (m *Message) Metadata(items []string) (metadata *common.Message) {
 				break
 			}
 
-			var body []byte
-			if len(section.Path) == 0 {
-				if section.Specifier == "" {
-					body = m.body
-				} else {
-					sep := []byte("\n\n")
-					parts := bytes.SplitN(m.body, sep, 2)
-					if len(parts) == 1 {
-						parts = [][]byte{nil, parts[0]}
-					}
-
-					if section.Specifier == "HEADER" {
-						body = parts[0]
-						body = append(body, sep...)
-					}
-					if section.Specifier == "TEXT" {
-						body = parts[1]
-					}
-				}
-			}
-
 			// If part doesn't exist, set the literal to nil
 			var literal *common.Literal
-			if body != nil {
+			if body, err := backendutil.FetchBodySection(m.body, section); err == nil {
 				literal = common.NewLiteral(section.ExtractPartial(body))
 			}
 			metadata.Body[section] = literal
@@ -75,6 +53,17 @@ func (m *Message) Metadata(items []string) (metadata *common.Message) {
 	return
 }
 
+// Check if the message matches some search criteria. Sequence numbers are
+// compared to the message's SeqNum field, and "*" is the message itself.
 func (m *Message) Matches(criteria *common.SearchCriteria) bool {
-	return true // TODO
+	return backendutil.Match(m.Message, m.body, m.SeqNum, m.Uid, criteria)
+}
+
+// Check if the message matches some search criteria, given its sequence number
+// in its mailbox. max and maxUid are the largest sequence number and UID in the
+// mailbox.
+func (m *Message) MatchesSeqNum(seqNum, max, maxUid uint32, criteria *common.SearchCriteria) bool {
+	msg := *m.Message
+	msg.SeqNum = seqNum
+	return backendutil.Match(&msg, m.body, max, maxUid, criteria)
 }
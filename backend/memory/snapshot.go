@@ -0,0 +1,245 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// The version of the snapshot format written by Save. Load refuses snapshots
+// with a different version.
+const SnapshotVersion = 1
+
+// A snapshot of the whole backend state.
+type snapshot struct {
+	Version int
+	Users []*userSnapshot
+}
+
+type userSnapshot struct {
+	Username string
+	Password string
+	Mailboxes []*mailboxSnapshot
+}
+
+type mailboxSnapshot struct {
+	Name string
+	Subscribed bool
+	UidValidity uint32
+	UidNext uint32
+	Messages []*messageSnapshot
+}
+
+type messageSnapshot struct {
+	Uid uint32
+	Flags []string
+	InternalDate *time.Time
+	Size uint32
+	Envelope *common.Envelope
+	BodyStructure *common.BodyStructure
+	Body []byte
+}
+
+func (bkd *Backend) snapshot() *snapshot {
+	snap := &snapshot{Version: SnapshotVersion}
+
+	for _, u := range bkd.users {
+		us := &userSnapshot{Username: u.username, Password: u.password}
+
+		for _, mbox := range u.mailboxes {
+			ms := &mailboxSnapshot{
+				Name: mbox.name,
+				Subscribed: mbox.subscribed,
+				UidValidity: mbox.uidValidity,
+				UidNext: mbox.uidNext(),
+			}
+
+			for _, msg := range mbox.messages {
+				ms.Messages = append(ms.Messages, &messageSnapshot{
+					Uid: msg.Uid,
+					Flags: msg.Flags,
+					InternalDate: msg.InternalDate,
+					Size: msg.Size,
+					Envelope: msg.Envelope,
+					BodyStructure: msg.BodyStructure,
+					Body: msg.body,
+				})
+			}
+
+			us.Mailboxes = append(us.Mailboxes, ms)
+		}
+
+		snap.Users = append(snap.Users, us)
+	}
+
+	return snap
+}
+
+func (bkd *Backend) restore(snap *snapshot) error {
+	if snap.Version != SnapshotVersion {
+		return errors.New("Unsupported snapshot version: " + strconv.Itoa(snap.Version))
+	}
+
+	users := map[string]*User{}
+	for _, us := range snap.Users {
+		if _, ok := users[us.Username]; ok {
+			return errors.New("Duplicate user in snapshot: " + us.Username)
+		}
+
+		u := &User{
+			username: us.Username,
+			password: us.Password,
+			mailboxes: map[string]*Mailbox{},
+			backend: bkd,
+		}
+
+		for _, ms := range us.Mailboxes {
+			if _, ok := u.mailboxes[ms.Name]; ok {
+				return errors.New("Duplicate mailbox in snapshot: " + ms.Name)
+			}
+
+			mbox := &Mailbox{
+				name: ms.Name,
+				subscribed: ms.Subscribed,
+				uidValidity: ms.UidValidity,
+				user: u,
+			}
+			if ms.UidNext > 0 {
+				mbox.lastUid = ms.UidNext - 1
+			}
+
+			for _, m := range ms.Messages {
+				if m.Uid == 0 || m.Uid > mbox.lastUid {
+					return errors.New("Invalid message UID in snapshot of mailbox " + ms.Name)
+				}
+
+				mbox.messages = append(mbox.messages, &Message{&common.Message{
+					Uid: m.Uid,
+					Flags: m.Flags,
+					InternalDate: m.InternalDate,
+					Size: m.Size,
+					Envelope: m.Envelope,
+					BodyStructure: m.BodyStructure,
+				}, m.Body})
+			}
+
+			u.mailboxes[mbox.name] = mbox
+		}
+
+		users[u.username] = u
+	}
+
+	bkd.users = users
+	return nil
+}
+
+// Write the complete state of the backend (users, mailboxes, subscriptions,
+// messages, flags and UIDs) to w.
+func (bkd *Backend) Save(w io.Writer) error {
+	bkd.locker.RLock()
+	defer bkd.locker.RUnlock()
+
+	return json.NewEncoder(w).Encode(bkd.snapshot())
+}
+
+// Replace the state of the backend with a snapshot previously written by Save.
+// Users returned by Login before Load will not see the restored state.
+func (bkd *Backend) Load(r io.Reader) error {
+	snap := &snapshot{}
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return err
+	}
+
+	bkd.locker.Lock()
+	defer bkd.locker.Unlock()
+
+	return bkd.restore(snap)
+}
+
+// Save the state of the backend to a file. The file is replaced atomically, so
+// that a crash during the save never leaves a truncated snapshot behind.
+func (bkd *Backend) SaveFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := bkd.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Load the state of the backend from a file written by SaveFile.
+func (bkd *Backend) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return bkd.Load(f)
+}
+
+// Save the state of the backend to path every interval. The returned function
+// stops saving and writes a last snapshot, it should be called before the
+// program exits.
+func (bkd *Backend) AutoSave(path string, interval time.Duration) (stop func() error) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go (func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := bkd.SaveFile(path); err != nil {
+					common.LogWith(bkd.Logger, &common.LogEvent{
+						Level: common.LogWarn,
+						Message: "cannot save memory backend snapshot",
+						Err: err,
+					})
+				}
+			case <-done:
+				return
+			}
+		}
+	})()
+
+	return func() error {
+		close(done)
+		<-stopped
+		return bkd.SaveFile(path)
+	}
+}
+
+// Create a new memory backend from a snapshot file. If the file doesn't exist,
+// a new backend is created with New.
+func NewFromFile(path string) (*Backend, error) {
+	bkd := New()
+	if err := bkd.LoadFile(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return bkd, nil
+}
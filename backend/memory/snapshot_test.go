@@ -0,0 +1,201 @@
+package memory_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/common"
+)
+
+func getMailbox(t *testing.T, bkd backend.Backend, name string) backend.Mailbox {
+	u, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal("Cannot login:", err)
+	}
+
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal("Cannot get mailbox:", err)
+	}
+	return mbox
+}
+
+func listUids(t *testing.T, mbox backend.Mailbox) (uids []uint32, flags [][]string) {
+	seqset, _ := common.NewSeqSet("1:*")
+	ch := make(chan *common.Message)
+	done := make(chan error, 1)
+	go (func() {
+		done <- mbox.ListMessages(false, seqset, []string{"UID", "FLAGS"}, ch)
+	})()
+
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+		flags = append(flags, msg.Flags)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Cannot list messages:", err)
+	}
+	return
+}
+
+func TestBackend_Save(t *testing.T) {
+	bkd := memory.New()
+
+	u, _ := bkd.Login("username", "password")
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	archive := getMailbox(t, bkd, "Archive")
+	archive.Subscribe()
+
+	inbox := getMailbox(t, bkd, "INBOX")
+	inbox.CreateMessage([]string{"\\Deleted"}, nil, []byte("Subject: Deleted\r\n\r\n"))
+	inbox.CreateMessage([]string{"\\Flagged"}, nil, []byte("Subject: Kept\r\n\r\n"))
+	inbox.Expunge()
+
+	b := &bytes.Buffer{}
+	if err := bkd.Save(b); err != nil {
+		t.Fatal("Cannot save:", err)
+	}
+
+	restored := memory.New()
+	if err := restored.Load(b); err != nil {
+		t.Fatal("Cannot load:", err)
+	}
+
+	inbox = getMailbox(t, restored, "INBOX")
+	uids, flags := listUids(t, inbox)
+	if len(uids) != 2 || uids[0] != 6 || uids[1] != 8 {
+		t.Fatalf("Bad UIDs after restore: %v", uids)
+	}
+	if len(flags[1]) != 1 || flags[1][0] != "\\Flagged" {
+		t.Errorf("Bad flags after restore: %v", flags[1])
+	}
+
+	// The UID of the expunged message must not be reused
+	status, err := inbox.Status([]string{"UIDNEXT", "UIDVALIDITY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.UidNext != 9 {
+		t.Errorf("Bad UIDNEXT after restore: got %v, want 9", status.UidNext)
+	}
+	if status.UidValidity != 1 {
+		t.Errorf("Bad UIDVALIDITY after restore: got %v, want 1", status.UidValidity)
+	}
+
+	u, _ = restored.Login("username", "password")
+	subscribed, err := u.ListMailboxes(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscribed) != 1 || subscribed[0].Name() != "Archive" {
+		t.Errorf("Bad subscriptions after restore: %v", subscribed)
+	}
+}
+
+func TestBackend_Load_badVersion(t *testing.T) {
+	bkd := memory.New()
+
+	err := bkd.Load(strings.NewReader(`{"Version":42}`))
+	if err == nil {
+		t.Fatal("Expected an error when loading an unsupported snapshot version")
+	}
+
+	// The previous state must be kept
+	getMailbox(t, bkd, "INBOX")
+}
+
+func TestBackend_SaveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.json")
+
+	bkd := memory.New()
+	getMailbox(t, bkd, "INBOX").CreateMessage(nil, nil, []byte("Subject: Saved\r\n\r\n"))
+	if err := bkd.SaveFile(path); err != nil {
+		t.Fatal("Cannot save:", err)
+	}
+
+	// A crash during a later save must not corrupt the existing snapshot:
+	// temporary files are only renamed once complete
+	tmp, err := ioutil.TempFile(dir, "snapshot.json.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.WriteString(`{"Version":1,"Us`)
+	tmp.Close()
+
+	restored, err := memory.NewFromFile(path)
+	if err != nil {
+		t.Fatal("Cannot load:", err)
+	}
+	if uids, _ := listUids(t, getMailbox(t, restored, "INBOX")); len(uids) != 2 {
+		t.Errorf("Bad number of messages after restore: got %v, want 2", len(uids))
+	}
+
+	// Saving again must replace the file and clean up after itself
+	os.Remove(tmp.Name())
+	if err := restored.SaveFile(path); err != nil {
+		t.Fatal("Cannot save:", err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != path {
+		t.Errorf("Unexpected files after save: %v", names)
+	}
+}
+
+func TestNewFromFile_notExist(t *testing.T) {
+	bkd, err := memory.NewFromFile(filepath.Join(os.TempDir(), "go-imap-memory-nonexistent.json"))
+	if err != nil {
+		t.Fatal("Expected no error for a missing snapshot, got:", err)
+	}
+	getMailbox(t, bkd, "INBOX")
+}
+
+func TestBackend_AutoSave_logger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := make(chan *common.LogEvent, 10)
+	bkd := memory.New()
+	bkd.Logger = common.LoggerFunc(func(ev *common.LogEvent) {
+		select {
+		case events <- ev:
+		default:
+		}
+	})
+
+	// The snapshot cannot be saved in a directory which doesn't exist
+	stop := bkd.AutoSave(filepath.Join(dir, "nonexistent", "snapshot.json"), 10 * time.Millisecond)
+
+	select {
+	case ev := <-events:
+		if ev.Level != common.LogWarn || ev.Err == nil {
+			t.Errorf("Bad log event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Error not logged")
+	}
+
+	if err := stop(); err == nil {
+		t.Error("Expected an error when saving the last snapshot")
+	}
+}
@@ -2,6 +2,7 @@ package memory
 
 import (
 	"errors"
+	"time"
 
 	"github.com/emersion/go-imap/backend"
 )
@@ -10,6 +11,7 @@ type User struct {
 	username string
 	password string
 	mailboxes map[string]*Mailbox
+	backend *Backend
 }
 
 func (u *User) Username() string {
@@ -17,6 +19,9 @@ func (u *User) Username() string {
 }
 
 func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
+	u.backend.locker.RLock()
+	defer u.backend.locker.RUnlock()
+
 	for _, mailbox := range u.mailboxes {
 		if subscribed && !mailbox.subscribed {
 			continue
@@ -28,6 +33,9 @@ func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err
 }
 
 func (u *User) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
+	u.backend.locker.RLock()
+	defer u.backend.locker.RUnlock()
+
 	mailbox, ok := u.mailboxes[name]
 	if !ok {
 		err = errors.New("No such mailbox")
@@ -36,15 +44,25 @@ func (u *User) GetMailbox(name string) (mailbox backend.Mailbox, err error) {
 }
 
 func (u *User) CreateMailbox(name string) error {
+	u.backend.locker.Lock()
+	defer u.backend.locker.Unlock()
+
 	if _, ok := u.mailboxes[name]; ok {
 		return errors.New("Mailbox already exists")
 	}
 
-	u.mailboxes[name] = &Mailbox{name: name, user: u}
+	u.mailboxes[name] = &Mailbox{
+		name: name,
+		uidValidity: uint32(time.Now().Unix()),
+		user: u,
+	}
 	return nil
 }
 
 func (u *User) DeleteMailbox(name string) error {
+	u.backend.locker.Lock()
+	defer u.backend.locker.Unlock()
+
 	if name == "INBOX" {
 		return errors.New("Cannot delete INBOX")
 	}
@@ -57,6 +75,9 @@ func (u *User) DeleteMailbox(name string) error {
 }
 
 func (u *User) RenameMailbox(existingName, newName string) error {
+	u.backend.locker.Lock()
+	defer u.backend.locker.Unlock()
+
 	mbox, ok := u.mailboxes[existingName]
 	if !ok {
 		return errors.New("No such mailbox")
@@ -64,6 +85,8 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 
 	u.mailboxes[newName] = &Mailbox{
 		name: newName,
+		uidValidity: mbox.uidValidity,
+		lastUid: mbox.uidNext() - 1,
 		messages: mbox.messages,
 		user: u,
 	}
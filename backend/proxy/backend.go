@@ -0,0 +1,71 @@
+// A backend forwarding all operations to an upstream IMAP server.
+//
+// Each login opens a new connection to the upstream server, authenticated with
+// the user's credentials. Upstream EXISTS and EXPUNGE responses are converted
+// into backend updates. Flag changes made by other upstream clients are not
+// reported, since the client doesn't support unilateral FETCH responses.
+package proxy
+
+import (
+	"crypto/tls"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+)
+
+// A function connecting to the upstream server. The returned client must be in
+// the not authenticated state.
+type DialFunc func() (*client.Client, error)
+
+type Backend struct {
+	dial DialFunc
+	updates *backend.Updates
+}
+
+func (bkd *Backend) Login(username, password string) (backend.User, error) {
+	c, err := bkd.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Login(username, password); err != nil {
+		c.Logout()
+		return nil, err
+	}
+
+	return newUser(bkd, username, c), nil
+}
+
+func (bkd *Backend) Updates() *backend.Updates {
+	return bkd.updates
+}
+
+// Create a new proxy backend connecting to the upstream server with an
+// unencrypted connection.
+func New(addr string) *Backend {
+	return NewWithDialer(func() (*client.Client, error) {
+		return client.Dial(addr)
+	})
+}
+
+// Create a new proxy backend connecting to the upstream server with an
+// encrypted connection.
+func NewTLS(addr string, tlsConfig *tls.Config) *Backend {
+	return NewWithDialer(func() (*client.Client, error) {
+		return client.DialTLS(addr, tlsConfig)
+	})
+}
+
+// Create a new proxy backend using a custom function to connect to the upstream
+// server, e.g. to use STARTTLS.
+func NewWithDialer(dial DialFunc) *Backend {
+	return &Backend{
+		dial: dial,
+		updates: &backend.Updates{
+			Statuses: make(chan *backend.StatusUpdate),
+			Mailboxes: make(chan *backend.MailboxUpdate),
+			Messages: make(chan *backend.MessageUpdate),
+			Expunges: make(chan *backend.ExpungeUpdate),
+		},
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/common"
+)
+
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+type Mailbox struct {
+	name string
+	info *common.MailboxInfo
+	user *User
+}
+
+func (mbox *Mailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *Mailbox) Info() (*common.MailboxInfo, error) {
+	return mbox.info, nil
+}
+
+func (mbox *Mailbox) selectMailbox() (*common.MailboxStatus, error) {
+	u := mbox.user
+
+	status, err := u.client.Select(mbox.name, false)
+	if err != nil {
+		u.setSelectedMailbox("")
+		return nil, err
+	}
+
+	// Updates received while selecting the mailbox are already reported in the
+	// SELECT response
+	u.flushUpdates(false)
+	u.setSelectedMailbox(mbox.name)
+	return status, nil
+}
+
+// Make sure this mailbox is selected upstream. Operations on messages need a
+// selected mailbox.
+func (mbox *Mailbox) ensureSelected() error {
+	if mbox.user.selectedMailbox() == mbox.name {
+		return nil
+	}
+
+	_, err := mbox.selectMailbox()
+	return err
+}
+
+func (mbox *Mailbox) Status(items []string) (*common.MailboxStatus, error) {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	// Flags are only returned by SELECT, which means the mailbox is being
+	// selected
+	selecting := false
+	for _, item := range items {
+		if item == common.MailboxFlags || item == common.MailboxPermanentFlags {
+			selecting = true
+			break
+		}
+	}
+
+	if !selecting {
+		return mbox.user.client.Status(mbox.name, items)
+	}
+
+	upstream, err := mbox.selectMailbox()
+	if err != nil {
+		return nil, err
+	}
+
+	status := *upstream
+	status.Items = items
+	return &status, nil
+}
+
+func (mbox *Mailbox) Subscribe() error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	return mbox.user.client.Subscribe(mbox.name)
+}
+
+func (mbox *Mailbox) Unsubscribe() error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	return mbox.user.client.Unsubscribe(mbox.name)
+}
+
+func (mbox *Mailbox) Check() error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.ensureSelected(); err != nil {
+		return err
+	}
+
+	err := mbox.user.client.Check()
+	mbox.user.flushUpdates(true)
+	return err
+}
+
+// Poll sends a NOOP command upstream, the upstream server only reports some
+// changes (e.g. expunged messages) in response to a command.
+func (mbox *Mailbox) Poll() error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.ensureSelected(); err != nil {
+		return err
+	}
+
+	err := mbox.user.client.Noop()
+	mbox.user.flushUpdates(true)
+	return err
+}
+
+func (mbox *Mailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	defer close(ch)
+
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.ensureSelected(); err != nil {
+		return err
+	}
+
+	messages := make(chan *common.Message, 10)
+	done := make(chan error, 1)
+	go (func() {
+		if uid {
+			done <- mbox.user.client.UidFetch(seqset, items, messages)
+		} else {
+			done <- mbox.user.client.Fetch(seqset, items, messages)
+		}
+	})()
+
+	for msg := range messages {
+		ch <- msg
+	}
+
+	err := <-done
+	mbox.user.flushUpdates(true)
+	return err
+}
+
+func (mbox *Mailbox) SearchMessages(uid bool, criteria *common.SearchCriteria) (ids []uint32, err error) {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err = mbox.ensureSelected(); err != nil {
+		return
+	}
+
+	if uid {
+		ids, err = mbox.user.client.UidSearch(criteria)
+	} else {
+		ids, err = mbox.user.client.Search(criteria)
+	}
+	mbox.user.flushUpdates(true)
+	return
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date *time.Time, body []byte) error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	err := mbox.user.client.Append(mbox.name, flags, date, common.NewLiteral(body))
+	mbox.user.flushUpdates(true)
+	return err
+}
+
+func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op common.FlagsOp, flags []string) error {
+	u := mbox.user
+
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	if err := mbox.ensureSelected(); err != nil {
+		return err
+	}
+
+	value := make([]interface{}, len(flags))
+	for i, flag := range flags {
+		value[i] = flag
+	}
+
+	messages := make(chan *common.Message, 10)
+	done := make(chan error, 1)
+	go (func() {
+		if uid {
+			done <- u.client.UidStore(seqset, string(op), value, messages)
+		} else {
+			done <- u.client.Store(seqset, string(op), value, messages)
+		}
+	})()
+
+	for msg := range messages {
+		u.backend.updates.Messages <- &backend.MessageUpdate{
+			Update: u.sessionUpdate(mbox.name),
+			Message: msg,
+		}
+	}
+
+	err := <-done
+	u.flushUpdates(true)
+	return err
+}
+
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *common.SeqSet, destName string) error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.ensureSelected(); err != nil {
+		return err
+	}
+
+	var err error
+	if uid {
+		err = mbox.user.client.UidCopy(seqset, destName)
+	} else {
+		err = mbox.user.client.Copy(seqset, destName)
+	}
+	mbox.user.flushUpdates(true)
+	return err
+}
+
+func (mbox *Mailbox) Expunge() error {
+	mbox.user.locker.Lock()
+	defer mbox.user.locker.Unlock()
+
+	if err := mbox.ensureSelected(); err != nil {
+		return err
+	}
+
+	// EXPUNGE responses are forwarded as updates, the server translates their
+	// sequence numbers for its client
+	seqNums := make(chan uint32)
+	done := make(chan struct{})
+	go (func() {
+		for seqNum := range seqNums {
+			mbox.user.forwardExpungeUpdate(seqNum)
+		}
+		close(done)
+	})()
+
+	err := mbox.user.client.Expunge(seqNums)
+	<-done
+	mbox.user.flushUpdates(true)
+	return err
+}
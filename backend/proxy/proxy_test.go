@@ -0,0 +1,249 @@
+package proxy_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/maildir"
+	"github.com/emersion/go-imap/backend/proxy"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/server"
+)
+
+// Start an upstream server and a proxy in front of it.
+func testProxy(t *testing.T) (upstream, s *server.Server, addr string, cleanup func()) {
+	root, err := ioutil.TempDir("", "go-imap-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream = server.New(maildir.New(root, func(username, password string) error {
+		return nil
+	}))
+	upstream.AllowInsecureAuth = true
+	ul, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go upstream.Serve(ul)
+
+	s = server.New(proxy.New(ul.Addr().String()))
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+
+	return upstream, s, l.Addr().String(), func() {
+		s.Close()
+		upstream.Close()
+		os.RemoveAll(root)
+	}
+}
+
+type session struct {
+	t *testing.T
+	conn net.Conn
+	scanner *bufio.Scanner
+}
+
+func dial(t *testing.T, addr string) *session {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+
+	sess := &session{t, c, bufio.NewScanner(c)}
+	sess.scanner.Scan() // Greeting
+	return sess
+}
+
+// Execute a command and return its untagged responses. The command must
+// succeed.
+func (sess *session) exec(tag, cmd string) []string {
+	sess.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer sess.conn.SetDeadline(time.Time{})
+
+	io.WriteString(sess.conn, tag + " " + cmd + "\r\n")
+
+	var untagged []string
+	for sess.scanner.Scan() {
+		line := sess.scanner.Text()
+		if strings.HasPrefix(line, "+ ") {
+			continue
+		}
+		if !strings.HasPrefix(line, tag + " ") {
+			untagged = append(untagged, line)
+			continue
+		}
+
+		if !strings.HasPrefix(line, tag + " OK") {
+			sess.t.Fatalf("Command %v failed: %v", cmd, line)
+		}
+		return untagged
+	}
+
+	sess.t.Fatalf("No response to command %v: %v", cmd, sess.scanner.Err())
+	return nil
+}
+
+func count(lines []string, line string) int {
+	n := 0
+	for _, l := range lines {
+		if l == line {
+			n++
+		}
+	}
+	return n
+}
+
+// Send NOOP commands until line has been received, and a few more to make sure
+// it isn't received again.
+func (sess *session) poll(line string) []string {
+	var untagged []string
+	for i := 0; i < 50; i++ {
+		if count(untagged, line) > 0 {
+			break
+		}
+		untagged = append(untagged, sess.exec("p", "NOOP")...)
+		time.Sleep(20 * time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		untagged = append(untagged, sess.exec("p", "NOOP")...)
+	}
+	return untagged
+}
+
+func TestProxy_updates(t *testing.T) {
+	_, _, addr, cleanup := testProxy(t)
+	defer cleanup()
+
+	sessions := []*session{dial(t, addr), dial(t, addr)}
+	for _, sess := range sessions {
+		defer sess.conn.Close()
+		sess.exec("a1", "LOGIN username password")
+		sess.exec("a2", "SELECT INBOX")
+	}
+	s1, s2 := sessions[0], sessions[1]
+
+	appended := s1.exec("a3", "APPEND INBOX (\\Deleted) {5}\r\nhello")
+	for i, sess := range sessions {
+		untagged := sess.poll("* 1 EXISTS")
+		if i == 0 {
+			untagged = append(appended, untagged...)
+		}
+		if count(untagged, "* 1 EXISTS") != 1 {
+			t.Errorf("Session #%v: expected one EXISTS response, got %v", i+1, untagged)
+		}
+	}
+
+	// Expunged messages are reported once to each session
+	if untagged := s1.exec("a4", "EXPUNGE"); count(untagged, "* 1 EXPUNGE") != 1 {
+		t.Errorf("Expected one EXPUNGE response, got %v", untagged)
+	}
+	if untagged := s2.poll("* 1 EXPUNGE"); count(untagged, "* 1 EXPUNGE") != 1 {
+		t.Errorf("Expected one EXPUNGE response in the other session, got %v", untagged)
+	}
+}
+
+func TestProxy_logout(t *testing.T) {
+	upstream, _, addr, cleanup := testProxy(t)
+	defer cleanup()
+
+	sess := dial(t, addr)
+	sess.exec("a1", "LOGIN username password")
+	if n := len(upstream.Conns()); n != 1 {
+		t.Fatalf("Expected one upstream connection, got %v", n)
+	}
+
+	// The upstream connection is released when the client disconnects
+	sess.conn.Close()
+	for i := 0; i < 100 && len(upstream.Conns()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(upstream.Conns()); n != 0 {
+		t.Errorf("Upstream connection not released: %v connections left", n)
+	}
+}
+
+func TestProxy_expungesDropped(t *testing.T) {
+	upstream, _, _, cleanup := testProxy(t)
+	defer cleanup()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go upstream.Serve(l)
+
+	// Updates of this backend are read by the test
+	bkd := proxy.New(l.Addr().String())
+	user, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.(backend.LogoutUser).Logout()
+
+	sess := dial(t, l.Addr().String())
+	defer sess.conn.Close()
+	sess.exec("a1", "LOGIN username password")
+	const n = 100
+	for i := 0; i < n; i++ {
+		sess.exec("a2", "APPEND INBOX (\\Deleted) {5}\r\nhello")
+	}
+
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mbox.Status([]string{common.MailboxFlags, common.MailboxMessages}); err != nil {
+		t.Fatal(err)
+	}
+
+	sess.exec("a3", "SELECT INBOX")
+	sess.exec("a4", "EXPUNGE")
+
+	// The updates aren't read while the upstream EXPUNGE responses are
+	// received, some of them are dropped
+	polled := make(chan error, 1)
+	go (func() {
+		polled <- mbox.(*proxy.Mailbox).Poll()
+	})()
+	time.Sleep(200 * time.Millisecond)
+
+	updates := bkd.Updates()
+	expunges := 0
+	for {
+		select {
+		case <-updates.Expunges:
+			expunges++
+			continue
+		case <-updates.Mailboxes:
+			continue
+		case status := <-updates.Statuses:
+			if status.Type != common.BYE {
+				t.Errorf("Expected a BYE response, got %v", status.StatusResp)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Session not closed after %v EXPUNGE responses", expunges)
+		}
+		break
+	}
+
+	if expunges >= n {
+		t.Errorf("Expected EXPUNGE responses to be dropped, got %v", expunges)
+	}
+	if err := <-polled; err != nil {
+		t.Error("Cannot poll:", err)
+	}
+}
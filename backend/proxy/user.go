@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/common"
+)
+
+// The number of upstream updates buffered by the client. Updates received when
+// the buffer is full are dropped, if EXPUNGE responses may have been dropped
+// the session is closed.
+const updatesBufferSize = 64
+
+type flushRequest struct {
+	forward bool
+	done chan struct{}
+}
+
+type User struct {
+	username string
+	backend *Backend
+	client *client.Client
+
+	// Serializes upstream commands.
+	locker sync.Mutex
+
+	// The name of the mailbox selected upstream. It has its own lock because
+	// it's read when forwarding updates, while a command is running.
+	selected string
+	selectedLocker sync.Mutex
+
+	flushes chan *flushRequest
+	done chan struct{}
+	// True if upstream EXPUNGE responses may have been dropped. Only accessed
+	// by forwardUpdates.
+	desynced bool
+}
+
+func newUser(bkd *Backend, username string, c *client.Client) *User {
+	c.MailboxUpdates = make(chan *common.MailboxStatus, updatesBufferSize)
+	c.Expunges = make(chan uint32, updatesBufferSize)
+
+	u := &User{
+		username: username,
+		backend: bkd,
+		client: c,
+		flushes: make(chan *flushRequest),
+		done: make(chan struct{}),
+	}
+
+	go u.forwardUpdates()
+
+	return u
+}
+
+func (u *User) Username() string {
+	return u.username
+}
+
+func (u *User) selectedMailbox() string {
+	u.selectedLocker.Lock()
+	defer u.selectedLocker.Unlock()
+	return u.selected
+}
+
+func (u *User) setSelectedMailbox(name string) {
+	u.selectedLocker.Lock()
+	u.selected = name
+	u.selectedLocker.Unlock()
+}
+
+// Updates received from the upstream connection of this session. Other
+// sessions of the same user have their own upstream connection, which receives
+// the same changes, so updates only target this session.
+func (u *User) sessionUpdate(mailbox string) backend.Update {
+	return backend.Update{Username: u.username, Mailbox: mailbox, User: u}
+}
+
+func (u *User) forwardMailboxUpdate(status *common.MailboxStatus) {
+	name := u.selectedMailbox()
+	if name == "" {
+		return
+	}
+
+	u.backend.updates.Mailboxes <- &backend.MailboxUpdate{
+		Update: u.sessionUpdate(name),
+		MailboxStatus: &common.MailboxStatus{
+			Name: name,
+			Items: []string{common.MailboxMessages, common.MailboxRecent},
+			Messages: status.Messages,
+			Recent: status.Recent,
+		},
+	}
+}
+
+func (u *User) forwardExpungeUpdate(seqNum uint32) {
+	name := u.selectedMailbox()
+	if name == "" {
+		return
+	}
+
+	u.backend.updates.Expunges <- &backend.ExpungeUpdate{
+		Update: u.sessionUpdate(name),
+		SeqNum: seqNum,
+	}
+}
+
+// Check whether the client may have dropped EXPUNGE responses, which happens
+// when its buffer is full. Sequence numbers can't be kept in sync with the
+// server anymore, the session is closed.
+func (u *User) checkExpunges() {
+	if u.desynced || len(u.client.Expunges) < cap(u.client.Expunges) {
+		return
+	}
+
+	name := u.selectedMailbox()
+	if name == "" {
+		return
+	}
+
+	u.desynced = true
+	u.backend.updates.Statuses <- &backend.StatusUpdate{
+		Update: u.sessionUpdate(name),
+		StatusResp: &common.StatusResp{
+			Tag: "*",
+			Type: common.BYE,
+			Info: "Too many updates from the upstream server",
+		},
+	}
+}
+
+// Process updates buffered by the client.
+func (u *User) drainUpdates(forward bool) {
+	for {
+		u.checkExpunges()
+		forward := forward && !u.desynced
+
+		select {
+		case status := <-u.client.MailboxUpdates:
+			if forward {
+				u.forwardMailboxUpdate(status)
+			}
+		case seqNum := <-u.client.Expunges:
+			if forward {
+				u.forwardExpungeUpdate(seqNum)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (u *User) forwardUpdates() {
+	for {
+		u.checkExpunges()
+
+		select {
+		case status := <-u.client.MailboxUpdates:
+			if !u.desynced {
+				u.forwardMailboxUpdate(status)
+			}
+		case seqNum := <-u.client.Expunges:
+			if !u.desynced {
+				u.forwardExpungeUpdate(seqNum)
+			}
+		case req := <-u.flushes:
+			u.drainUpdates(req.forward)
+			close(req.done)
+		case <-u.done:
+			return
+		}
+	}
+}
+
+// Wait for updates received during the last upstream command to be processed,
+// so that they are sent before the command completes. Untagged responses are
+// always received before the tagged one, so they are already buffered. If
+// forward is false, updates are discarded.
+func (u *User) flushUpdates(forward bool) {
+	req := &flushRequest{forward: forward, done: make(chan struct{})}
+	select {
+	case u.flushes <- req:
+		<-req.done
+	case <-u.done:
+	}
+}
+
+func (u *User) mailbox(info *common.MailboxInfo) *Mailbox {
+	return &Mailbox{name: info.Name, info: info, user: u}
+}
+
+func (u *User) list(subscribed bool, name string) (infos []*common.MailboxInfo, err error) {
+	ch := make(chan *common.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go (func() {
+		if subscribed {
+			done <- u.client.Lsub("", name, ch)
+		} else {
+			done <- u.client.List("", name, ch)
+		}
+	})()
+
+	for info := range ch {
+		infos = append(infos, info)
+	}
+
+	err = <-done
+	return
+}
+
+func (u *User) ListMailboxes(subscribed bool) (mailboxes []backend.Mailbox, err error) {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	infos, err := u.list(subscribed, "*")
+	if err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		mailboxes = append(mailboxes, u.mailbox(info))
+	}
+	return
+}
+
+func (u *User) GetMailbox(name string) (backend.Mailbox, error) {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	infos, err := u.list(false, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The name could contain wildcards, only accept an exact match
+	for _, info := range infos {
+		if info.Name == name || (info.Name == "INBOX" && isInbox(name)) {
+			return u.mailbox(info), nil
+		}
+	}
+
+	return nil, errors.New("No such mailbox")
+}
+
+func (u *User) CreateMailbox(name string) error {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	return u.client.Create(name)
+}
+
+func (u *User) DeleteMailbox(name string) error {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	return u.client.Delete(name)
+}
+
+func (u *User) RenameMailbox(existingName, newName string) error {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	return u.client.Rename(existingName, newName)
+}
+
+// Log out from the upstream server.
+func (u *User) Logout() error {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	close(u.done)
+	return u.client.Logout()
+}
@@ -13,9 +13,15 @@ type Update struct {
 	// The mailbox targeted by this update. If empty, the update targets all
 	// mailboxes.
 	Mailbox string
+	// The session targeted by this update, as returned by Backend.Login. If
+	// nil, all sessions of the user are notified. Backends creating separate
+	// state for each session, such as proxies, can use it for changes only
+	// visible to one session.
+	User User
 }
 
-// A status update. See RFC 3501 section 7.1 for a list of status responses.
+// A status update. See RFC 3501 section 7.1 for a list of status responses. If
+// it's a BYE response, the connection is closed once it has been sent.
 type StatusUpdate struct {
 	Update
 	*common.StatusResp
@@ -36,15 +42,63 @@ type MessageUpdate struct {
 // An expunge update.
 type ExpungeUpdate struct {
 	Update
+	// The sequence number of the expunged message, taking into account all
+	// previous expunge updates. The server translates it for each client.
 	SeqNum uint32
 }
 
+// A message flags update, addressed by UID.
+type FlagsUpdate struct {
+	Update
+	// The UID of the message.
+	Uid uint32
+	// The new flags of the message.
+	Flags []string
+}
+
+// New messages, addressed by UID.
+type AddedUpdate struct {
+	Update
+	// The UIDs of the new messages, in ascending order.
+	Uids []uint32
+}
+
+// Expunged messages, addressed by UID.
+type UidExpungeUpdate struct {
+	Update
+	// The UIDs of the expunged messages.
+	Uids []uint32
+}
+
+// A mailbox has been renamed. The mailbox of the update is the old name.
+type RenameUpdate struct {
+	Update
+	NewName string
+}
+
+// A mailbox has been deleted.
+type DeleteUpdate struct {
+	Update
+}
+
 // Updates contains channels where unilateral backend updates will be sent.
+//
+// Messages can be addressed by sequence number or by UID. With sequence
+// numbers, the backend must send updates in the order they happen, for all
+// users. UID-addressed updates don't have this requirement, the server keeps
+// track of the messages known by each client. A backend should use only one of
+// these two models for a given mailbox. Channels left nil are ignored.
 type Updates struct {
 	Statuses chan *StatusUpdate
 	Mailboxes chan *MailboxUpdate
 	Messages chan *MessageUpdate
 	Expunges chan *ExpungeUpdate
+
+	Flags chan *FlagsUpdate
+	Added chan *AddedUpdate
+	UidExpunges chan *UidExpungeUpdate
+	Renames chan *RenameUpdate
+	Deletes chan *DeleteUpdate
 }
 
 // A Backend that implements Updater is able to send unilateral backend updates.
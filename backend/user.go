@@ -77,3 +77,12 @@ type User interface {
 	// rename of INBOX.
 	RenameMailbox(existingName, newName string) error
 }
+
+// A User that implements LogoutUser is notified when the connection it was
+// logged in with is closed, e.g. to release resources held for the session.
+type LogoutUser interface {
+	User
+
+	// Logout is called when the client logs out or the connection is closed.
+	Logout() error
+}
@@ -3,10 +3,12 @@ package client
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	imap "github.com/emersion/go-imap/common"
 )
@@ -39,6 +41,10 @@ type Client struct {
 	// A channel where deleted message IDs will be sent.
 	Expunges chan uint32
 
+	// Receives events about the connection and commands. If nil, warnings and
+	// errors are printed with the standard logger.
+	Logger imap.Logger
+
 	// TODO: support unilateral message updates
 	// A channel where messages updates from the server will be sent.
 	//MessageUpdates chan *imap.Message
@@ -55,6 +61,8 @@ func (c *Client) read() error {
 			close(hdlr)
 		}
 		c.handlers = nil
+
+		c.conn.Metrics().ConnClosed()
 	})()
 
 	for {
@@ -68,8 +76,12 @@ func (c *Client) read() error {
 		if err == io.EOF || c.State == imap.LogoutState {
 			return nil
 		}
+		if _, ok := err.(net.Error); ok {
+			// The connection is broken
+			return err
+		}
 		if err != nil {
-			log.Println("Error reading response:", err)
+			c.log(imap.LogWarn, "cannot read response", err)
 			continue
 		}
 
@@ -97,7 +109,7 @@ func (c *Client) read() error {
 		c.handlersLocker.Unlock()
 
 		if !accepted {
-			log.Println("Response has not been handled", res)
+			c.log(imap.LogWarn, fmt.Sprintf("response has not been handled: %v", res), nil)
 		}
 	}
 
@@ -123,10 +135,37 @@ func (c *Client) removeHandler(hdlr imap.RespHandler) {
 	}
 }
 
+// Log an event about this client's connection.
+func (c *Client) log(level imap.LogLevel, msg string, err error) {
+	imap.LogWith(c.Logger, &imap.LogEvent{
+		Level: level,
+		ConnID: c.conn.ID(),
+		Message: msg,
+		Err: err,
+	})
+}
+
 func (c *Client) execute(cmdr imap.Commander, res imap.RespHandlerFrom) (status *imap.StatusResp, err error) {
 	cmd := cmdr.Command()
 	cmd.Tag = generateTag()
 
+	start := time.Now()
+	defer (func() {
+		ev := &imap.LogEvent{
+			Level: imap.LogInfo,
+			ConnID: c.conn.ID(),
+			Tag: cmd.Tag,
+			Command: strings.ToUpper(cmd.Name),
+			Duration: time.Since(start),
+			Err: err,
+		}
+		if status != nil {
+			ev.Result = status.Type
+		}
+		imap.LogWith(c.Logger, ev)
+		c.conn.Metrics().CommandCompleted(ev.Command, ev.Result, ev.Duration)
+	})()
+
 	// Add handler before sending command, to be sure to get the response in time
 	// (in tests, the response is sent right after our command is received, so
 	// sometimes the response was received before the setup of this handler)
@@ -216,6 +255,14 @@ func (c *Client) handleContinuationReqs(continues chan bool) {
 	}
 }
 
+// Change the state of the connection.
+func (c *Client) setState(state imap.ConnState) {
+	if c.State != state {
+		c.conn.Metrics().StateChanged(c.State, state)
+	}
+	c.State = state
+}
+
 func (c *Client) gotStatusCaps(args []interface{}) {
 	c.Caps = map[string]bool{}
 	for _, cap := range args {
@@ -246,10 +293,10 @@ func (c *Client) handleGreeting() *imap.StatusResp {
 		}
 
 		if status.Type == imap.PREAUTH {
-			c.State = imap.AuthenticatedState
+			c.setState(imap.AuthenticatedState)
 		}
 		if status.Type == imap.BYE {
-			c.State = imap.LogoutState
+			c.setState(imap.LogoutState)
 		}
 
 		go c.handleUnilateral()
@@ -277,6 +324,12 @@ func (c *Client) handleUnilateral() {
 			}
 			h.Accept()
 
+			if res.Type == imap.BYE {
+				c.conn.Metrics().UnilateralUpdate("bye")
+			} else {
+				c.conn.Metrics().UnilateralUpdate("status")
+			}
+
 			switch res.Type {
 			case imap.OK:
 				select {
@@ -294,7 +347,7 @@ func (c *Client) handleUnilateral() {
 				default:
 				}
 			case imap.BYE:
-				c.State = imap.LogoutState
+				c.setState(imap.LogoutState)
 				c.Mailbox = nil
 				c.conn.Close()
 
@@ -316,6 +369,12 @@ func (c *Client) handleUnilateral() {
 			}
 			h.Accept()
 
+			if name == "EXPUNGE" {
+				c.conn.Metrics().UnilateralUpdate("expunge")
+			} else {
+				c.conn.Metrics().UnilateralUpdate("mailbox")
+			}
+
 			switch name {
 			case "EXISTS":
 				if c.Mailbox == nil {
@@ -360,11 +419,35 @@ func (c *Client) Upgrade(upgrader imap.ConnUpgrader) error {
 	return c.conn.Upgrade(upgrader)
 }
 
+// Send measurements about this client to m. It must be called right after the
+// client is created, before executing any command.
+func (c *Client) SetMetrics(m imap.Metrics) {
+	c.conn.SetMetrics(m)
+	if m != nil {
+		m.ConnOpened()
+	}
+}
+
+// Trace network activity with t. If t is nil, tracing is disabled.
+func (c *Client) SetTracer(t *imap.Tracer) {
+	c.conn.SetTracer(t)
+}
+
 // Check if this client's connection has TLS enabled.
 func (c *Client) IsTLS() bool {
 	return c.isTLS
 }
 
+// Get the TLS connection state, or nil if the connection isn't encrypted. It
+// can be used to get channel binding data, see scram.TLSChannelBinding.
+func (c *Client) TLSState() *tls.ConnectionState {
+	if tlsConn, ok := c.conn.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
 // Create a new client from an existing connection.
 func NewClient(conn net.Conn) (c *Client, err error) {
 	continues := make(chan bool)
@@ -380,7 +463,7 @@ func NewClient(conn net.Conn) (c *Client, err error) {
 	go c.handleContinuationReqs(continues)
 
 	greeting := c.handleGreeting()
-	greeting.Err()
+	err = greeting.Err()
 	return
 }
 
@@ -44,7 +44,7 @@ func (c *Client) Select(name string, readOnly bool) (mbox *imap.MailboxStatus, e
 	}
 
 	mbox.ReadOnly = (status.Code == "READ-ONLY")
-	c.State = imap.SelectedState
+	c.setState(imap.SelectedState)
 	return
 }
 
@@ -65,6 +65,13 @@ func (c *Client) Authenticate(auth sasl.Client) (err error) {
 		Mechanism: mech,
 	}
 
+	// Send the initial response with the command if possible, to save a
+	// round-trip
+	if ir != nil && c.Caps["SASL-IR"] {
+		cmd.InitialResponse = ir
+		ir = nil
+	}
+
 	res := &responses.Authenticate{
 		Mechanism: auth,
 		InitialResponse: ir,
@@ -76,10 +83,11 @@ func (c *Client) Authenticate(auth sasl.Client) (err error) {
 		return
 	}
 	if err = status.Err(); err != nil {
+		c.conn.Metrics().AuthFailed(mech)
 		return
 	}
 
-	c.State = imap.AuthenticatedState
+	c.setState(imap.AuthenticatedState)
 	c.Caps = nil
 
 	if status.Code == "CAPABILITY" {
@@ -89,6 +97,38 @@ func (c *Client) Authenticate(auth sasl.Client) (err error) {
 	return
 }
 
+// Authenticate with an OAuth 2.0 access token obtained from source, using
+// OAUTHBEARER or XOAUTH2 depending on what the server supports. A new token is
+// requested from source each time, e.g. after reconnecting. If the server
+// rejects the token, a *sasl.OAuthBearerError is returned.
+func (c *Client) AuthenticateOAuth(username string, source TokenSource) (err error) {
+	if c.Caps == nil {
+		if _, err = c.Capability(); err != nil {
+			return
+		}
+	}
+
+	token, err := source.Token()
+	if err != nil {
+		return
+	}
+
+	var auth *oauthClient
+	if c.SupportsAuthentication(sasl.OAuthBearer) {
+		auth = newOAuthBearerClient(username, token)
+	} else if c.SupportsAuthentication(XOAuth2) {
+		auth = newXOAuth2Client(username, token)
+	} else {
+		err = errors.New("OAuth authentication not supported")
+		return
+	}
+
+	if err = c.Authenticate(auth); err != nil && auth.err != nil {
+		err = auth.err
+	}
+	return
+}
+
 // Identifies the client to the server and carries the plaintext password
 // authenticating this user.
 func (c *Client) Login(username, password string) (err error) {
@@ -111,10 +151,11 @@ func (c *Client) Login(username, password string) (err error) {
 		return
 	}
 	if err = status.Err(); err != nil {
+		c.conn.Metrics().AuthFailed("LOGIN")
 		return
 	}
 
-	c.State = imap.AuthenticatedState
+	c.setState(imap.AuthenticatedState)
 	c.Caps = nil
 
 	if status.Code == "CAPABILITY" {
@@ -129,6 +129,78 @@ func TestClient_Authenticate(t *testing.T) {
 	testClient(t, ct, st)
 }
 
+func TestClient_Authenticate_InitialResponse(t *testing.T) {
+	ct := func(c *client.Client) (err error) {
+		c.Caps["SASL-IR"] = true
+
+		err = c.Authenticate(sasl.NewPlainClient("", "username", "password"))
+		if err != nil {
+			return
+		}
+
+		if c.State != common.AuthenticatedState {
+			return fmt.Errorf("Client is not in authenticated state after AUTENTICATE")
+		}
+
+		return
+	}
+
+	st := func(c net.Conn) {
+		scanner := NewCmdScanner(c)
+
+		tag, cmd := scanner.Scan()
+		if cmd != "AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk" {
+			t.Fatal("Bad command:", cmd)
+		}
+
+		io.WriteString(c, tag + " OK AUTHENTICATE completed\r\n")
+	}
+
+	testClient(t, ct, st)
+}
+
+func TestClient_Authenticate_XOAuth2_No(t *testing.T) {
+	ct := func(c *client.Client) (err error) {
+		err = c.Authenticate(client.NewXOAuth2Client("username", "token"))
+		if err == nil {
+			return fmt.Errorf("Authentication succeeded with an invalid token")
+		}
+		return nil
+	}
+
+	st := func(c net.Conn) {
+		scanner := NewCmdScanner(c)
+
+		tag, cmd := scanner.Scan()
+		if cmd != "AUTHENTICATE XOAUTH2" {
+			t.Fatal("Bad command:", cmd)
+		}
+
+		io.WriteString(c, "+ \r\n")
+
+		line := scanner.ScanLine()
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "user=username\x01auth=Bearer token\x01\x01" {
+			t.Fatal("Bad response:", string(b))
+		}
+
+		challenge := `{"status":"401","schemes":"bearer"}`
+		io.WriteString(c, "+ " + base64.StdEncoding.EncodeToString([]byte(challenge)) + "\r\n")
+
+		// The error challenge is acknowledged with an empty response
+		if line := scanner.ScanLine(); line != "" {
+			t.Fatal("Bad response:", line)
+		}
+
+		io.WriteString(c, tag + " NO [AUTHENTICATIONFAILED] Invalid token\r\n")
+	}
+
+	testClient(t, ct, st)
+}
+
 func TestClient_Login_Success(t *testing.T) {
 	ct := func(c *client.Client) (err error) {
 		err = c.Login("username", "password")
@@ -50,7 +50,7 @@ func (c *Client) Close() (err error) {
 		return
 	}
 
-	c.State = imap.AuthenticatedState
+	c.setState(imap.AuthenticatedState)
 	c.Mailbox = nil
 	return
 }
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+
+	"github.com/emersion/go-sasl"
+)
+
+// The CRAM-MD5 mechanism name.
+const CramMD5 = "CRAM-MD5"
+
+type cramMD5Client struct {
+	username string
+	secret []byte
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return CramMD5, nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	mac := hmac.New(md5.New, a.secret)
+	mac.Write(challenge)
+	return []byte(a.username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// Create a client for the CRAM-MD5 authentication mechanism, as described in
+// RFC 2195.
+func NewCramMD5Client(username, secret string) sasl.Client {
+	return &cramMD5Client{username, []byte(secret)}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// The XOAUTH2 mechanism name.
+const XOAuth2 = "XOAUTH2"
+
+// A TokenSource provides OAuth 2.0 access tokens.
+type TokenSource interface {
+	// Get a valid access token. It's called each time the client authenticates,
+	// so expired tokens must be refreshed.
+	Token() (string, error)
+}
+
+// A client implementation of the OAUTHBEARER and XOAUTH2 mechanisms.
+type oauthClient struct {
+	mech string
+	ir []byte
+	// The error sent by the server, if any.
+	err *sasl.OAuthBearerError
+}
+
+func (a *oauthClient) Start() (mech string, ir []byte, err error) {
+	return a.mech, a.ir, nil
+}
+
+func (a *oauthClient) Next(challenge []byte) ([]byte, error) {
+	if a.err != nil {
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+
+	// The server sent an error, acknowledge it with a dummy response. See RFC
+	// 7628 section 3.2.3.
+	a.err = &sasl.OAuthBearerError{}
+	if err := json.Unmarshal(challenge, a.err); err != nil {
+		return nil, err
+	}
+
+	if a.mech == XOAuth2 {
+		return []byte{}, nil
+	}
+	return []byte{0x01}, nil
+}
+
+func newOAuthBearerClient(username, token string) *oauthClient {
+	var authzid string
+	if username != "" {
+		authzid = "a=" + strings.NewReplacer(",", "=2C", "=", "=3D").Replace(username)
+	}
+
+	return &oauthClient{
+		mech: sasl.OAuthBearer,
+		ir: []byte("n," + authzid + ",\x01auth=Bearer " + token + "\x01\x01"),
+	}
+}
+
+func newXOAuth2Client(username, token string) *oauthClient {
+	return &oauthClient{
+		mech: XOAuth2,
+		ir: []byte("user=" + username + "\x01auth=Bearer " + token + "\x01\x01"),
+	}
+}
+
+// Create a client for the OAUTHBEARER authentication mechanism, as described
+// in RFC 7628. username can be empty if the user is identified by the token.
+func NewOAuthBearerClient(username, token string) sasl.Client {
+	return newOAuthBearerClient(username, token)
+}
+
+// Create a client for the XOAUTH2 authentication mechanism.
+// See https://developers.google.com/gmail/imap/xoauth2-protocol
+func NewXOAuth2Client(username, token string) sasl.Client {
+	return newXOAuth2Client(username, token)
+}
@@ -9,16 +9,34 @@ import (
 	"github.com/emersion/go-sasl"
 )
 
+// ErrAuthCancelled is returned by Authenticate.Handle when the client cancels
+// the authentication exchange.
+var ErrAuthCancelled = errors.New("AUTHENTICATE cancelled")
+
 // An AUTHENTICATE command.
-// See RFC 3501 section 6.2.2
+// See RFC 3501 section 6.2.2 and RFC 4959
 type Authenticate struct {
 	Mechanism string
+	// The initial response, nil if there is none. It requires the SASL-IR
+	// capability.
+	InitialResponse []byte
 }
 
 func (cmd *Authenticate) Command() *imap.Command {
+	args := []interface{}{cmd.Mechanism}
+
+	if cmd.InitialResponse != nil {
+		// An empty initial response is sent as "="
+		encoded := base64.StdEncoding.EncodeToString(cmd.InitialResponse)
+		if encoded == "" {
+			encoded = "="
+		}
+		args = append(args, encoded)
+	}
+
 	return &imap.Command{
 		Name: imap.Authenticate,
-		Arguments: []interface{}{cmd.Mechanism},
+		Arguments: args,
 	}
 }
 
@@ -33,6 +51,23 @@ func (cmd *Authenticate) Parse(fields []interface{}) error {
 	}
 
 	cmd.Mechanism = strings.ToUpper(cmd.Mechanism)
+
+	if len(fields) > 1 {
+		encoded, ok := fields[1].(string)
+		if !ok {
+			return errors.New("Initial response must be a string")
+		}
+
+		if encoded == "=" {
+			cmd.InitialResponse = []byte{}
+		} else {
+			var err error
+			if cmd.InitialResponse, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -43,7 +78,7 @@ func (cmd *Authenticate) Handle(mechanisms map[string]sasl.Server, r *imap.Reade
 		return
 	}
 
-	var response []byte
+	response := cmd.InitialResponse
 	for {
 		var challenge []byte
 		var done bool
@@ -64,11 +99,15 @@ func (cmd *Authenticate) Handle(mechanisms map[string]sasl.Server, r *imap.Reade
 		if encoded, err = r.ReadInfo(); err != nil {
 			return
 		}
-		if encoded != "" {
-			response, err = base64.StdEncoding.DecodeString(encoded)
-			if err != nil {
-				return
-			}
+		if encoded == "*" {
+			err = ErrAuthCancelled
+			return
+		}
+
+		// An empty line is an empty response
+		response, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return
 		}
 	}
 }
@@ -3,8 +3,9 @@ package common
 import (
 	"bufio"
 	"net"
-	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 )
 
 // A function that upgrades a connection.
@@ -20,22 +21,70 @@ type Conn struct {
 	*Writer
 
 	waits chan struct{}
+	id uint64
 
-	// Set to true to print all commands and responses to STDOUT.
-	debug bool
+	// Protects traces and metrics.
+	locker sync.Mutex
+	// If not nil, network activity is traced.
+	traces *connTrace
+	metrics Metrics
 }
 
+// The last connection ID.
+var lastConnID uint64
+
 func (c *Conn) init() {
-	r := io.Reader(c.Conn)
-	w := io.Writer(c.Conn)
+	c.Reader.reader = bufio.NewReader(connReader{c})
+	c.Writer.writer = bufio.NewWriter(connWriter{c})
+}
+
+// Trace and measure data read from or written to the connection.
+func (c *Conn) transferred(written bool, b []byte) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
 
-	if c.debug {
-		r = io.TeeReader(c.Conn, os.Stdout)
-		w = io.MultiWriter(c.Conn, os.Stdout)
+	if c.metrics != nil {
+		if written {
+			c.metrics.BytesWritten(len(b))
+		} else {
+			c.metrics.BytesRead(len(b))
+		}
 	}
 
-	c.Reader.reader = bufio.NewReader(r)
-	c.Writer.writer = bufio.NewWriter(w)
+	if c.traces == nil {
+		return
+	}
+	if written {
+		c.traces.trace(&c.traces.out, b)
+	} else {
+		c.traces.trace(&c.traces.in, b)
+	}
+}
+
+// A reader tracing and measuring data read from a connection.
+type connReader struct {
+	c *Conn
+}
+
+func (r connReader) Read(b []byte) (int, error) {
+	n, err := r.c.Conn.Read(b)
+	if n > 0 {
+		r.c.transferred(false, b[:n])
+	}
+	return n, err
+}
+
+// A writer tracing and measuring data written to a connection.
+type connWriter struct {
+	c *Conn
+}
+
+func (w connWriter) Write(b []byte) (int, error) {
+	n, err := w.c.Conn.Write(b)
+	if n > 0 {
+		w.c.transferred(true, b[:n])
+	}
+	return n, err
 }
 
 // Write any buffered data to the underlying connection.
@@ -54,7 +103,7 @@ func (c *Conn) Flush() (err error) {
 }
 
 // Upgrade a connection, e.g. wrap an unencrypted connection with an encrypted
-// tunnel.
+// tunnel. Data read but not consumed before the upgrade is discarded.
 func (c *Conn) Upgrade(upgrader ConnUpgrader) error {
 	// Block reads and writes during the upgrading process
 	c.waits = make(chan struct{})
@@ -77,15 +126,63 @@ func (c *Conn) Wait() {
 	}
 }
 
-// Enable or disable debugging.
+// Get this connection's ID. IDs are unique in a process, they can be used to
+// match log events and traces.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// Enable or disable debugging. If enabled, network activity is printed to
+// STDOUT.
 func (c *Conn) SetDebug(debug bool) {
-	c.debug = debug
-	c.init()
+	if debug {
+		c.SetTracer(&Tracer{Writer: os.Stdout})
+	} else {
+		c.SetTracer(nil)
+	}
+}
+
+// Trace network activity with t. If t is nil, tracing is disabled.
+func (c *Conn) SetTracer(t *Tracer) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if t == nil {
+		c.traces = nil
+		return
+	}
+
+	// Only client writers wait for continuation requests before sending
+	// literals
+	client := c.Writer.continues != nil
+	c.traces = newConnTrace(t, c.id, client)
+}
+
+// Send measurements about this connection to m. If m is nil, measurements are
+// discarded.
+func (c *Conn) SetMetrics(m Metrics) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.metrics = m
+}
+
+// Get the Metrics measurements about this connection are sent to. It never
+// returns nil.
+func (c *Conn) Metrics() Metrics {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.metrics == nil {
+		return NopMetrics{}
+	}
+	return c.metrics
 }
 
 // Create a new IMAP connection.
 func NewConn(conn net.Conn, r *Reader, w *Writer) *Conn {
 	c := &Conn{Conn: conn, Reader: r, Writer: w}
+	c.id = atomic.AddUint64(&lastConnID, 1)
 
 	c.init()
 	return c
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// The severity of a log event.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// An event logged by a server or a client.
+type LogEvent struct {
+	// The time of the event.
+	Time time.Time
+	// The severity of the event.
+	Level LogLevel
+	// The ID of the connection, see Conn.ID. Zero if the event isn't related
+	// to a connection.
+	ConnID uint64
+	// A human-readable description of the event. Empty for command events.
+	Message string
+	// If something went wrong, the error.
+	Err error
+
+	// For command events, the command's tag and name.
+	Tag string
+	Command string
+	// For command events, the time spent executing the command.
+	Duration time.Duration
+	// For command events, the status of the command's response. Empty if the
+	// command hasn't completed, in this case Err is set.
+	Result StatusRespType
+}
+
+func (ev *LogEvent) String() string {
+	s := fmt.Sprintf("[conn %v] ", ev.ConnID)
+	if ev.Command != "" {
+		result := string(ev.Result)
+		if result == "" {
+			result = "failed"
+		}
+		s += fmt.Sprintf("%v %v %v (%v)", ev.Tag, ev.Command, result, ev.Duration)
+	} else {
+		s += ev.Message
+	}
+
+	if ev.Err != nil {
+		s += ": " + ev.Err.Error()
+	}
+	return s
+}
+
+// A Logger receives events about connections and the commands they execute.
+// It must be safe for concurrent use.
+type Logger interface {
+	Log(ev *LogEvent)
+}
+
+// A function implementing the Logger interface.
+type LoggerFunc func(ev *LogEvent)
+
+func (f LoggerFunc) Log(ev *LogEvent) {
+	f(ev)
+}
+
+// A Logger printing events with the standard log package.
+type StdLogger struct {
+	// The logger to print events to. If nil, the standard logger is used.
+	Logger *log.Logger
+	// Events below this level are discarded.
+	Level LogLevel
+}
+
+func (l *StdLogger) Log(ev *LogEvent) {
+	if ev.Level < l.Level {
+		return
+	}
+
+	s := ev.Level.String() + ": " + ev.String()
+	if l.Logger != nil {
+		l.Logger.Println(s)
+	} else {
+		log.Println(s)
+	}
+}
+
+// The logger used when none is configured: warnings and errors are printed
+// with the standard logger.
+var defaultLogger = &StdLogger{Level: LogWarn}
+
+// Log an event with logger, or with the default logger if nil. The event's
+// time is set if empty.
+func LogWith(logger Logger, ev *LogEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	if logger == nil {
+		logger = defaultLogger
+	}
+	logger.Log(ev)
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"time"
+)
+
+// Metrics receives measurements from a server or a client, e.g. to expose them
+// to a monitoring system. It must be safe for concurrent use.
+//
+// The metrics package provides an implementation exposing measurements in the
+// Prometheus text format.
+type Metrics interface {
+	// Called when a connection is opened and closed.
+	ConnOpened()
+	ConnClosed()
+	// Called when the state of a connection changes.
+	StateChanged(from, to ConnState)
+	// Called when a command completes. result is the status of the command's
+	// response, empty if no status response has been sent or received.
+	CommandCompleted(name string, result StatusRespType, d time.Duration)
+	// Called when data is read from or written to a connection.
+	BytesRead(n int)
+	BytesWritten(n int)
+	// Called when an authentication attempt fails.
+	AuthFailed(mechanism string)
+	// Called when a unilateral update is sent by a server or received by a
+	// client. kind is one of "status", "mailbox", "message", "expunge" and
+	// "bye".
+	UnilateralUpdate(kind string)
+}
+
+// A Metrics implementation discarding all measurements. It can be embedded in
+// implementations interested in some measurements only.
+type NopMetrics struct{}
+
+func (NopMetrics) ConnOpened() {}
+func (NopMetrics) ConnClosed() {}
+func (NopMetrics) StateChanged(from, to ConnState) {}
+func (NopMetrics) CommandCompleted(name string, result StatusRespType, d time.Duration) {}
+func (NopMetrics) BytesRead(n int) {}
+func (NopMetrics) BytesWritten(n int) {}
+func (NopMetrics) AuthFailed(mechanism string) {}
+func (NopMetrics) UnilateralUpdate(kind string) {}
@@ -27,6 +27,13 @@ var (
 	atomSpecials = string([]rune{listStart, listEnd, literalStart, sp, '%', '*'}) + quotedSpecials + respSpecials
 )
 
+// Errors returned when a reader limit is exceeded.
+var (
+	ErrLiteralTooBig = errors.New("Literal too big")
+	ErrLineTooLong = errors.New("Line too long")
+	ErrTooDeep = errors.New("Too many nested lists")
+)
+
 // A string reader.
 type StringReader interface {
 	// ReadString reads until the first occurrence of delim in the input,
@@ -76,9 +83,77 @@ func trimSuffix(str string, suffix rune) string {
 type Reader struct {
 	reader
 
+	// The maximum size of a literal. If a bigger literal is announced,
+	// ReadLiteral returns ErrLiteralTooBig without reading it. Zero means no
+	// limit.
+	MaxLiteralSize uint32
+	// The maximum length of a line read by ReadLine, literals excluded. Zero
+	// means no limit.
+	MaxLineLength int
+	// The maximum list nesting depth. Zero means no limit.
+	MaxDepth int
+	// If not nil, closed when the connection is closed. Continuation requests
+	// aren't requested anymore, and ReadLiteral returns io.EOF.
+	Done <-chan struct{}
+
 	brackets int
 	inRespCode bool
 	continues chan<- bool
+
+	lineLength int
+	lastRuneSize int
+	depth int
+}
+
+func (r *Reader) ReadRune() (char rune, size int, err error) {
+	char, size, err = r.reader.ReadRune()
+	r.lastRuneSize = size
+	r.lineLength += size
+
+	if err == nil && r.MaxLineLength > 0 && r.lineLength > r.MaxLineLength {
+		err = ErrLineTooLong
+	}
+	return
+}
+
+func (r *Reader) UnreadRune() error {
+	if err := r.reader.UnreadRune(); err != nil {
+		return err
+	}
+
+	r.lineLength -= r.lastRuneSize
+	r.lastRuneSize = 0
+	return nil
+}
+
+func (r *Reader) ReadString(delim byte) (string, error) {
+	br, ok := r.reader.(io.ByteReader)
+	if r.MaxLineLength <= 0 || !ok {
+		str, err := r.reader.ReadString(delim)
+		r.lineLength += len(str)
+		return str, err
+	}
+
+	// Read byte by byte, so that the line length is checked before buffering
+	// too much data
+	var b []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return string(b), err
+		}
+		b = append(b, c)
+
+		r.lineLength++
+		r.lastRuneSize = 0
+		if r.lineLength > r.MaxLineLength {
+			return string(b), ErrLineTooLong
+		}
+
+		if c == delim {
+			return string(b), nil
+		}
+	}
 }
 
 func (r *Reader) ReadSp() error {
@@ -173,7 +248,7 @@ func (r *Reader) ReadLiteral() (literal *Literal, err error) {
 	}
 	lstr = trimSuffix(lstr, literalEnd)
 
-	l, err := strconv.Atoi(lstr)
+	l, err := strconv.ParseUint(lstr, 10, 32)
 	if err != nil {
 		return
 	}
@@ -182,9 +257,20 @@ func (r *Reader) ReadLiteral() (literal *Literal, err error) {
 		return
 	}
 
+	// Reject the literal before the client sends it
+	if r.MaxLiteralSize > 0 && uint32(l) > r.MaxLiteralSize {
+		err = ErrLiteralTooBig
+		return
+	}
+
 	// Send continuation request
 	if r.continues != nil {
-		r.continues <- true
+		select {
+		case r.continues <- true:
+		case <-r.Done:
+			err = io.EOF
+			return
+		}
 	}
 
 	b := make([]byte, l)
@@ -275,6 +361,15 @@ func (r *Reader) ReadList() (fields []interface{}, err error) {
 		return
 	}
 
+	r.depth++
+	defer (func() {
+		r.depth--
+	})()
+	if r.MaxDepth > 0 && r.depth > r.MaxDepth {
+		err = ErrTooDeep
+		return
+	}
+
 	fields, err = r.ReadFields()
 	if err != nil {
 		return
@@ -290,14 +385,21 @@ func (r *Reader) ReadList() (fields []interface{}, err error) {
 	return
 }
 
+// Read a line. If an error occurs, the fields read so far are returned, e.g. so
+// that the command tag can be used in the error response.
 func (r *Reader) ReadLine() (fields []interface{}, err error) {
+	r.lineLength = 0
+
 	fields, err = r.ReadFields()
 	if err != nil {
 		return
 	}
 
 	r.UnreadRune()
-	err = r.ReadCrlf()
+	if err = r.ReadCrlf(); err == nil {
+		// The next line, e.g. read by ReadInfo, starts here
+		r.lineLength = 0
+	}
 	return
 }
 
@@ -360,7 +462,10 @@ func (r *Reader) ReadInfo() (info string, err error) {
 	}
 	if char != lf {
 		err = errors.New("Line doesn't end with a LF")
+		return
 	}
+
+	r.lineLength = 0
 	return
 }
 
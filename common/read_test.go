@@ -389,6 +389,41 @@ func TestReader_ReadLine(t *testing.T) {
 	}
 }
 
+func TestReader_limits(t *testing.T) {
+	_, r := newReader("a001 APPEND INBOX {1000}\r\n")
+	r.MaxLiteralSize = 999
+	if fields, err := r.ReadLine(); err != common.ErrLiteralTooBig {
+		t.Error("Expected literal to be rejected, got:", err)
+	} else if len(fields) != 3 || fields[0] != "a001" {
+		t.Error("Fields read before the literal not returned:", fields)
+	}
+
+	_, r = newReader("a001 LOGIN \"username\" \"password\"\r\n")
+	r.MaxLineLength = 20
+	if _, err := r.ReadLine(); err != common.ErrLineTooLong {
+		t.Error("Expected line to be rejected, got:", err)
+	}
+
+	// Literals don't count in the line length
+	_, r = newReader("a001 LOGIN {16}\r\nusername@example password\r\n")
+	r.MaxLineLength = 30
+	if _, err := r.ReadLine(); err != nil {
+		t.Error(err)
+	}
+
+	_, r = newReader("a001 FETCH 1 (((BODY)))\r\n")
+	r.MaxDepth = 2
+	if _, err := r.ReadLine(); err != common.ErrTooDeep {
+		t.Error("Expected nested lists to be rejected, got:", err)
+	}
+
+	_, r = newReader("a001 FETCH 1 ((BODY))\r\n")
+	r.MaxDepth = 2
+	if _, err := r.ReadLine(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestReader_ReadRespCode(t *testing.T) {
 	b, r := newReader("[CAPABILITY NOOP STARTTLS]")
 	if code, fields, err := r.ReadRespCode(); err != nil {
@@ -465,4 +500,22 @@ func TestReader_ReadInfo(t *testing.T) {
 	if _, err := r.ReadInfo(); err == nil {
 		t.Error("Invalid read didn't fail")
 	}
+
+	// The line length limit applies to each line
+	b, r = newReader("a001 AUTHENTICATE PLAIN\r\nI love potatoes.\r\nI love potatoes.\r\n")
+	r.MaxLineLength = 30
+	if _, err := r.ReadLine(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadInfo(); err != nil {
+			t.Error("Line rejected:", err)
+		}
+	}
+
+	b, r = newReader("I love potatoes, all kinds of potatoes.\r\n")
+	r.MaxLineLength = 30
+	if _, err := r.ReadInfo(); err != common.ErrLineTooLong {
+		t.Error("Expected line to be rejected, got:", err)
+	}
 }
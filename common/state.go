@@ -30,3 +30,17 @@ const (
 	// the client or server.
 	LogoutState = 0
 )
+
+func (s ConnState) String() string {
+	switch s {
+	case NotAuthenticatedState:
+		return "not authenticated"
+	case AuthenticatedState:
+		return "authenticated"
+	case SelectedState:
+		return "selected"
+	case LogoutState:
+		return "logout"
+	}
+	return "unknown"
+}
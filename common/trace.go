@@ -0,0 +1,200 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Tracer prints network activity, for debugging purposes. Each line is
+// prefixed with the connection ID and "C:" for data sent by the client or "S:"
+// for data sent by the server.
+//
+// Credentials sent with LOGIN and AUTHENTICATE are redacted. A Tracer can be
+// shared by multiple connections.
+type Tracer struct {
+	// Where the trace is written.
+	Writer io.Writer
+	// Literals bigger than this size are elided. Zero means no limit.
+	MaxLiteralSize int
+
+	locker sync.Mutex
+}
+
+func (t *Tracer) write(b []byte) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	t.Writer.Write(b)
+}
+
+const redacted = "[redacted]"
+
+// The state of a traced stream, in one direction.
+type traceStream struct {
+	fromClient bool
+
+	// The current line, not written yet.
+	line []byte
+	// The number of literal bytes remaining.
+	literal int
+	// True if the current literal isn't written.
+	hideLiteral bool
+	// True if the previous line ended with a literal, ie. the current line
+	// continues the same command.
+	cont bool
+	// True if the rest of the current command is redacted.
+	redact bool
+}
+
+// The trace of a connection.
+type connTrace struct {
+	tracer *Tracer
+	id uint64
+	in, out traceStream
+
+	// The tag of the AUTHENTICATE command in progress, if any. Lines sent by
+	// the client are redacted until the command completes.
+	authTag string
+}
+
+func newConnTrace(t *Tracer, id uint64, client bool) *connTrace {
+	return &connTrace{
+		tracer: t,
+		id: id,
+		in: traceStream{fromClient: !client},
+		out: traceStream{fromClient: client},
+	}
+}
+
+func (ct *connTrace) writeLine(s *traceStream, line string) {
+	dir := "S"
+	if s.fromClient {
+		dir = "C"
+	}
+	ct.tracer.write([]byte(fmt.Sprintf("[%v] %v: %v\n", ct.id, dir, line)))
+}
+
+// Trace data going through stream s.
+func (ct *connTrace) trace(s *traceStream, b []byte) {
+	for len(b) > 0 {
+		if s.literal > 0 {
+			n := s.literal
+			if n > len(b) {
+				n = len(b)
+			}
+			if !s.hideLiteral {
+				ct.tracer.write(b[:n])
+			}
+
+			s.literal -= n
+			b = b[n:]
+			if s.literal == 0 && !s.hideLiteral {
+				ct.tracer.write([]byte{'\n'})
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			s.line = append(s.line, b...)
+			return
+		}
+
+		s.line = append(s.line, b[:i]...)
+		b = b[i+1:]
+
+		line := strings.TrimSuffix(string(s.line), "\r")
+		s.line = s.line[:0]
+		ct.traceLine(s, line)
+	}
+}
+
+// Trace a complete line, without its CRLF.
+func (ct *connTrace) traceLine(s *traceStream, line string) {
+	size, hasLiteral := literalSize(line)
+
+	shown := line
+	if s.fromClient {
+		shown = ct.redactLine(s, line)
+	} else if ct.authTag != "" && strings.HasPrefix(line, ct.authTag + " ") {
+		ct.authTag = ""
+	}
+	ct.writeLine(s, shown)
+
+	s.cont = hasLiteral
+	if !hasLiteral {
+		s.redact = false
+		return
+	}
+
+	s.literal = size
+	s.hideLiteral = false
+	if s.redact {
+		s.hideLiteral = true
+		ct.writeLine(s, redacted)
+	} else if ct.tracer.MaxLiteralSize > 0 && size > ct.tracer.MaxLiteralSize {
+		s.hideLiteral = true
+		ct.writeLine(s, fmt.Sprintf("[%v bytes elided]", size))
+	}
+}
+
+// Redact credentials from a line sent by the client.
+func (ct *connTrace) redactLine(s *traceStream, line string) string {
+	if s.cont {
+		if s.redact {
+			return redacted
+		}
+		return line
+	}
+
+	if ct.authTag != "" {
+		// A SASL response
+		if line == "*" {
+			return line
+		}
+		return redacted
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 {
+		return line
+	}
+
+	switch strings.ToUpper(parts[1]) {
+	case Login:
+		s.redact = true
+		return parts[0] + " " + parts[1] + " " + redacted
+	case Authenticate:
+		ct.authTag = parts[0]
+
+		// Keep the mechanism, redact the initial response
+		args := strings.SplitN(parts[2], " ", 2)
+		if len(args) > 1 {
+			return parts[0] + " " + parts[1] + " " + args[0] + " " + redacted
+		}
+	}
+	return line
+}
+
+// Parse the literal announced at the end of a line, if any.
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, false
+	}
+
+	s := strings.TrimSuffix(line[i+1:len(line)-1], "+")
+	size, err := strconv.Atoi(s)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,86 @@
+package common_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/common"
+)
+
+func TestTracer(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go io.Copy(ioutil.Discard, c)
+
+	ic := common.NewConn(s, common.NewServerReader(nil, nil), common.NewWriter(nil))
+	defer ic.Close()
+
+	b := &bytes.Buffer{}
+	ic.SetTracer(&common.Tracer{Writer: b, MaxLiteralSize: 10})
+
+	// Send data from the client and read it from the server
+	recv := func(data string) {
+		go io.WriteString(c, data)
+		if _, err := io.ReadFull(ic.Reader, make([]byte, len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := func(data string) {
+		ic.Writer.Write([]byte(data))
+		if err := ic.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recv("a1 LOGIN {8}\r\nusername {8}\r\npassword\r\n")
+	send("a1 OK Logged in\r\n")
+	recv("a2 AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	send("+ \r\n")
+	recv("AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	send("a2 OK Authenticated\r\n")
+	recv("a3 FETCH 1:2 BODY[]\r\n")
+	send("* 1 FETCH (BODY[] {5}\r\nhello)\r\n")
+	send("* 2 FETCH (BODY[] {20}\r\nhello world, goodbye)\r\n")
+	send("a3 OK Fetched\r\n")
+
+	prefix := fmt.Sprintf("[%v] ", ic.ID())
+	expected := []string{
+		"C: a1 LOGIN [redacted]",
+		"C: [redacted]",
+		"C: [redacted]",
+		"C: [redacted]",
+		"C: [redacted]",
+		"S: a1 OK Logged in",
+		"C: a2 AUTHENTICATE PLAIN [redacted]",
+		"S: + ",
+		"C: [redacted]",
+		"S: a2 OK Authenticated",
+		"C: a3 FETCH 1:2 BODY[]",
+		"S: * 1 FETCH (BODY[] {5}",
+		"hello",
+		"S: )",
+		"S: * 2 FETCH (BODY[] {20}",
+		"S: [20 bytes elided]",
+		"S: )",
+		"S: a3 OK Fetched",
+	}
+	for i, line := range expected {
+		if line != "hello" {
+			expected[i] = prefix + line
+		}
+	}
+
+	got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Invalid trace: expected \n%v\n but got \n%v", strings.Join(expected, "\n"), b.String())
+	}
+
+	if strings.Contains(b.String(), "password") || strings.Contains(b.String(), "AHVzZXJuYW1lAHBhc3N3b3Jk") {
+		t.Error("Credentials not redacted")
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/common"
+)
+
+// Helpers shared by backend tests. Tests log in as "username" with the
+// password "password".
+
+// DiscardUpdates discards all updates sent by a backend, until done is closed.
+// If done is nil, updates are discarded forever.
+func DiscardUpdates(updates *backend.Updates, done <-chan struct{}) {
+	for {
+		select {
+		case <-updates.Statuses:
+		case <-updates.Mailboxes:
+		case <-updates.Messages:
+		case <-updates.Expunges:
+		case <-updates.Flags:
+		case <-updates.Added:
+		case <-updates.UidExpunges:
+		case <-updates.Renames:
+		case <-updates.Deletes:
+		case <-done:
+			return
+		}
+	}
+}
+
+// TempDir creates a temporary directory. It must be removed by the caller.
+func TempDir(t *testing.T, prefix string) string {
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// GetMailbox logs in and gets a mailbox.
+func GetMailbox(t *testing.T, bkd backend.Backend, name string) backend.Mailbox {
+	u, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal("Cannot login:", err)
+	}
+
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal("Cannot get mailbox:", err)
+	}
+	return mbox
+}
+
+// ListMessages lists all messages of a mailbox.
+func ListMessages(t *testing.T, mbox backend.Mailbox, items []string) []*common.Message {
+	seqset, _ := common.NewSeqSet("1:*")
+	ch := make(chan *common.Message)
+	done := make(chan error, 1)
+	go (func() {
+		done <- mbox.ListMessages(true, seqset, items, ch)
+	})()
+
+	var messages []*common.Message
+	for msg := range ch {
+		messages = append(messages, msg)
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Cannot list messages:", err)
+	}
+	return messages
+}
+
+// ListUids lists the UIDs of all messages of a mailbox.
+func ListUids(t *testing.T, mbox backend.Mailbox) []uint32 {
+	var uids []uint32
+	for _, msg := range ListMessages(t, mbox, []string{"UID"}) {
+		uids = append(uids, msg.Uid)
+	}
+	return uids
+}
+
+// CheckExpungeUpdates checks that a backend sends UID-addressed updates for
+// added and expunged messages, and that the mailbox can be used while they're
+// consumed. mbox must be empty, and nothing else must consume updates.
+func CheckExpungeUpdates(t *testing.T, bkd backend.Updater, mbox backend.Mailbox) {
+	updates := bkd.Updates()
+	received := make(chan []uint32, 1)
+	go (func() {
+		var added []uint32
+		for i := 0; i < 3; i++ {
+			update := <-updates.Added
+			mbox.Status([]string{common.MailboxMessages})
+			added = append(added, update.Uids...)
+		}
+
+		update := <-updates.UidExpunges
+		mbox.Status([]string{common.MailboxMessages})
+		received <- append(added, update.Uids...)
+	})()
+
+	done := make(chan error, 1)
+	go (func() {
+		for i := 0; i < 3; i++ {
+			if err := mbox.CreateMessage([]string{common.DeletedFlag}, nil, []byte("Subject: Hi\r\n\r\n")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- mbox.Expunge()
+	})()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Operations block while updates are consumed")
+	}
+
+	select {
+	case uids := <-received:
+		// Three messages added, and then expunged
+		if !reflect.DeepEqual(uids, []uint32{1, 2, 3, 1, 2, 3}) {
+			t.Errorf("Bad updates: got UIDs %v, want [1 2 3 1 2 3]", uids)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Updates not sent")
+	}
+
+	if uids := ListUids(t, mbox); len(uids) != 0 {
+		t.Errorf("Messages not expunged: %v", uids)
+	}
+}
@@ -0,0 +1,233 @@
+// Package metrics exposes measurements about IMAP servers and clients in the
+// Prometheus text format, without depending on the Prometheus client library.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// The default buckets of command latency histograms, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A histogram of command latencies.
+type histogram struct {
+	// Cumulative counts, one per bucket.
+	counts []uint64
+	count uint64
+	sum float64
+}
+
+// A Collector implements common.Metrics and exposes measurements over HTTP, in
+// the Prometheus text format. It can be used as a server's Metrics or a
+// client's.
+type Collector struct {
+	namespace string
+	buckets []float64
+
+	locker sync.Mutex
+	active int64
+	conns uint64
+	transitions map[string]uint64
+	commands map[string]uint64
+	latencies map[string]*histogram
+	bytesRead uint64
+	bytesWritten uint64
+	authFailures map[string]uint64
+	updates map[string]uint64
+}
+
+// Create a new collector. namespace is used as a prefix for metric names, e.g.
+// "imap_server". buckets are the upper bounds of command latency histograms,
+// in seconds. If nil, DefaultBuckets are used.
+func New(namespace string, buckets []float64) *Collector {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &Collector{
+		namespace: namespace,
+		buckets: buckets,
+		transitions: make(map[string]uint64),
+		commands: make(map[string]uint64),
+		latencies: make(map[string]*histogram),
+		authFailures: make(map[string]uint64),
+		updates: make(map[string]uint64),
+	}
+}
+
+func (c *Collector) ConnOpened() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.active++
+	c.conns++
+}
+
+func (c *Collector) ConnClosed() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.active--
+}
+
+func (c *Collector) StateChanged(from, to common.ConnState) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.transitions[labels("from", from.String(), "to", to.String())]++
+}
+
+func (c *Collector) CommandCompleted(name string, result common.StatusRespType, d time.Duration) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if result == "" {
+		result = "NONE"
+	}
+	c.commands[labels("command", name, "result", string(result))]++
+
+	key := labels("command", name)
+	h, ok := c.latencies[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		c.latencies[key] = h
+	}
+
+	secs := d.Seconds()
+	for i, bound := range c.buckets {
+		if secs <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+func (c *Collector) BytesRead(n int) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.bytesRead += uint64(n)
+}
+
+func (c *Collector) BytesWritten(n int) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.bytesWritten += uint64(n)
+}
+
+func (c *Collector) AuthFailed(mechanism string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.authFailures[labels("mechanism", mechanism)]++
+}
+
+func (c *Collector) UnilateralUpdate(kind string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	c.updates[labels("kind", kind)]++
+}
+
+// Write all metrics to w, in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.locker.Lock()
+	b := &bytes.Buffer{}
+
+	c.writeHeader(b, "connections_active", "gauge", "Number of open connections.")
+	fmt.Fprintf(b, "%v_connections_active %v\n", c.namespace, c.active)
+
+	c.writeHeader(b, "connections_total", "counter", "Number of opened connections.")
+	fmt.Fprintf(b, "%v_connections_total %v\n", c.namespace, c.conns)
+
+	c.writeHeader(b, "state_transitions_total", "counter", "Number of connection state transitions.")
+	c.writeValues(b, "state_transitions_total", c.transitions)
+
+	c.writeHeader(b, "commands_total", "counter", "Number of completed commands, by name and status.")
+	c.writeValues(b, "commands_total", c.commands)
+
+	c.writeHeader(b, "command_duration_seconds", "histogram", "Command latencies.")
+	for _, key := range sortedKeys(c.latencies) {
+		h := c.latencies[key]
+		name := c.namespace + "_command_duration_seconds"
+		for i, bound := range c.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(b, "%v_bucket{%v,le=\"%v\"} %v\n", name, key, le, h.counts[i])
+		}
+		fmt.Fprintf(b, "%v_bucket{%v,le=\"+Inf\"} %v\n", name, key, h.count)
+		fmt.Fprintf(b, "%v_sum{%v} %v\n", name, key, h.sum)
+		fmt.Fprintf(b, "%v_count{%v} %v\n", name, key, h.count)
+	}
+
+	c.writeHeader(b, "read_bytes_total", "counter", "Number of bytes read from connections.")
+	fmt.Fprintf(b, "%v_read_bytes_total %v\n", c.namespace, c.bytesRead)
+
+	c.writeHeader(b, "written_bytes_total", "counter", "Number of bytes written to connections.")
+	fmt.Fprintf(b, "%v_written_bytes_total %v\n", c.namespace, c.bytesWritten)
+
+	c.writeHeader(b, "auth_failures_total", "counter", "Number of failed authentication attempts, by mechanism.")
+	c.writeValues(b, "auth_failures_total", c.authFailures)
+
+	c.writeHeader(b, "unilateral_updates_total", "counter", "Number of unilateral updates, by kind.")
+	c.writeValues(b, "unilateral_updates_total", c.updates)
+
+	c.locker.Unlock()
+	return b.WriteTo(w)
+}
+
+func (c *Collector) writeHeader(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %v_%v %v\n", c.namespace, name, help)
+	fmt.Fprintf(b, "# TYPE %v_%v %v\n", c.namespace, name, typ)
+}
+
+func (c *Collector) writeValues(b *bytes.Buffer, name string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(b, "%v_%v{%v} %v\n", c.namespace, name, key, values[key])
+	}
+}
+
+// Serve metrics over HTTP, e.g. to be scraped by Prometheus.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.WriteTo(w)
+}
+
+func sortedKeys(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Format label pairs, e.g. labels("a", "b") returns `a="b"`.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, pairs[i] + "=\"" + labelEscaper.Replace(pairs[i+1]) + "\"")
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,132 @@
+package metrics_test
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/metrics"
+	"github.com/emersion/go-imap/server"
+)
+
+func TestCollector(t *testing.T) {
+	c := metrics.New("imap", []float64{0.1, 1})
+
+	c.ConnOpened()
+	c.ConnOpened()
+	c.ConnClosed()
+	c.StateChanged(common.NotAuthenticatedState, common.AuthenticatedState)
+	c.CommandCompleted("LOGIN", common.OK, 50 * time.Millisecond)
+	c.CommandCompleted("LOGIN", common.NO, 500 * time.Millisecond)
+	c.CommandCompleted("NOOP", "", 2 * time.Second)
+	c.BytesRead(10)
+	c.BytesWritten(20)
+	c.AuthFailed("PLAIN")
+	c.UnilateralUpdate("expunge")
+
+	b := &bytes.Buffer{}
+	if _, err := c.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`imap_connections_active 1`,
+		`imap_connections_total 2`,
+		`imap_state_transitions_total{from="not authenticated",to="authenticated"} 1`,
+		`imap_commands_total{command="LOGIN",result="NO"} 1`,
+		`imap_commands_total{command="LOGIN",result="OK"} 1`,
+		`imap_commands_total{command="NOOP",result="NONE"} 1`,
+		`imap_command_duration_seconds_bucket{command="LOGIN",le="0.1"} 1`,
+		`imap_command_duration_seconds_bucket{command="LOGIN",le="1"} 2`,
+		`imap_command_duration_seconds_bucket{command="LOGIN",le="+Inf"} 2`,
+		`imap_command_duration_seconds_sum{command="LOGIN"} 0.55`,
+		`imap_command_duration_seconds_count{command="LOGIN"} 2`,
+		`imap_command_duration_seconds_bucket{command="NOOP",le="1"} 0`,
+		`imap_read_bytes_total 10`,
+		`imap_written_bytes_total 20`,
+		`imap_auth_failures_total{mechanism="PLAIN"} 1`,
+		`imap_unilateral_updates_total{kind="expunge"} 1`,
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	for _, line := range expected {
+		found := false
+		for _, l := range lines {
+			if l == line {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Missing line %q in:\n%v", line, b.String())
+		}
+	}
+}
+
+func TestCollector_serverClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := metrics.New("imap_server", nil)
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Metrics = sm
+	go s.Serve(l)
+	defer s.Close()
+
+	cm := metrics.New("imap_client", nil)
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetMetrics(cm)
+
+	if err := c.Login("username", "wrong"); err == nil {
+		t.Fatal("Login with a wrong password succeeded")
+	}
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Logout(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{
+		collector *metrics.Collector
+		expected []string
+	}{
+		{sm, []string{
+			`imap_server_connections_total 1`,
+			`imap_server_commands_total{command="LOGIN",result="NO"} 1`,
+			`imap_server_commands_total{command="LOGIN",result="OK"} 1`,
+			`imap_server_state_transitions_total{from="not authenticated",to="authenticated"} 1`,
+			`imap_server_auth_failures_total{mechanism="LOGIN"} 1`,
+		}},
+		{cm, []string{
+			`imap_client_connections_total 1`,
+			`imap_client_commands_total{command="LOGIN",result="NO"} 1`,
+			`imap_client_commands_total{command="LOGIN",result="OK"} 1`,
+			`imap_client_state_transitions_total{from="not authenticated",to="authenticated"} 1`,
+			`imap_client_auth_failures_total{mechanism="LOGIN"} 1`,
+		}},
+	} {
+		b := &bytes.Buffer{}
+		tc.collector.WriteTo(b)
+
+		for _, line := range tc.expected {
+			if !strings.Contains(b.String(), line + "\n") {
+				t.Errorf("Missing line %q in:\n%v", line, b.String())
+			}
+		}
+		if strings.Contains(b.String(), "read_bytes_total 0\n") {
+			t.Errorf("Bytes read not measured:\n%v", b.String())
+		}
+	}
+}
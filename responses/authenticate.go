@@ -20,8 +20,8 @@ func (r *Authenticate) HandleFrom(hdlr imap.RespHandler) (err error) {
 	// Cancel auth if an error occurs
 	defer (func () {
 		if err != nil {
-			w.WriteString("*")
-			w.WriteCrlf()
+			w.WriteInfo("*")
+			w.Flush()
 		}
 	})()
 
@@ -36,10 +36,7 @@ func (r *Authenticate) HandleFrom(hdlr imap.RespHandler) (err error) {
 		// Empty challenge, send initial response as stated in RFC 2222 section 5.1
 		if cont.Info == "" && r.InitialResponse != nil {
 			encoded := base64.StdEncoding.EncodeToString(r.InitialResponse)
-			if _, err = w.WriteString(encoded); err != nil {
-				return
-			}
-			if _, err = w.WriteCrlf(); err != nil {
+			if _, err = w.WriteInfo(encoded); err != nil {
 				return
 			}
 			if err = w.Flush(); err != nil {
@@ -63,10 +60,8 @@ func (r *Authenticate) HandleFrom(hdlr imap.RespHandler) (err error) {
 		}
 
 		encoded := base64.StdEncoding.EncodeToString(res)
-		if _, err = w.WriteString(encoded); err != nil {
-			return
-		}
-		if _, err = w.WriteCrlf(); err != nil {
+		// Responses are not strings, an empty one must be sent as an empty line
+		if _, err = w.WriteInfo(encoded); err != nil {
 			return
 		}
 		if err = w.Flush(); err != nil {
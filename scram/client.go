@@ -0,0 +1,148 @@
+package scram
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type client struct {
+	mechanism string
+	username, password string
+	cb *ChannelBinding
+
+	h func() hash.Hash
+	step int
+	nonce string
+	gs2Header string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (a *client) Start() (mech string, ir []byte, err error) {
+	mech = a.mechanism
+
+	h, plus, err := hashFunc(a.mechanism)
+	if err != nil {
+		return
+	}
+	a.h = h
+
+	if plus {
+		if a.cb == nil {
+			err = errors.New("scram: channel binding not available")
+			return
+		}
+		a.gs2Header = "p=" + a.cb.Type + ",,"
+	} else if a.cb != nil {
+		// Channel binding is supported, but the server doesn't support it
+		a.gs2Header = "y,,"
+	} else {
+		a.gs2Header = "n,,"
+	}
+
+	if a.nonce, err = newNonce(); err != nil {
+		return
+	}
+
+	a.clientFirstBare = "n=" + usernameEscaper.Replace(a.username) + ",r=" + a.nonce
+	ir = []byte(a.gs2Header + a.clientFirstBare)
+	return
+}
+
+func (a *client) Next(challenge []byte) (response []byte, err error) {
+	switch a.step {
+	case 0:
+		response, err = a.handleServerFirst(string(challenge))
+	case 1:
+		err = a.handleServerFinal(string(challenge))
+	default:
+		err = sasl.ErrUnexpectedServerChallenge
+	}
+	a.step++
+	return
+}
+
+func (a *client) handleServerFirst(serverFirst string) ([]byte, error) {
+	attrs, err := parseAttributes(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, err
+	}
+
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("scram: invalid iteration count")
+	}
+
+	cbind := []byte(a.gs2Header)
+	if strings.HasPrefix(a.gs2Header, "p=") {
+		cbind = append(cbind, a.cb.Data...)
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	h := a.h
+	salted := pbkdf2.Key([]byte(a.password), salt, iterations, h().Size(), h)
+	clientKey := computeHMAC(h, salted, "Client Key")
+	clientSignature := computeHMAC(h, computeHash(h, clientKey), authMessage)
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	a.serverSignature = computeHMAC(h, computeHMAC(h, salted, "Server Key"), authMessage)
+
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(clientFinal), nil
+}
+
+func (a *client) handleServerFinal(serverFinal string) error {
+	attrs, err := parseAttributes(serverFinal)
+	if err != nil {
+		return err
+	}
+
+	if e, ok := attrs['e']; ok {
+		return errors.New("scram: server error: " + e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(signature, a.serverSignature) {
+		return errors.New("scram: invalid server signature")
+	}
+	return nil
+}
+
+// Create a client for a SCRAM mechanism, e.g. SHA256. cb is the channel
+// binding data of the connection, it's required by -PLUS mechanisms. It should
+// also be set for other mechanisms if available, so that the server can detect
+// downgrade attacks.
+func NewClient(mechanism, username, password string, cb *ChannelBinding) sasl.Client {
+	return &client{
+		mechanism: mechanism,
+		username: username,
+		password: password,
+		cb: cb,
+	}
+}
@@ -0,0 +1,160 @@
+// Implements the SCRAM-SHA-1 and SCRAM-SHA-256 SASL authentication mechanisms,
+// as defined in RFC 5802 and RFC 7677.
+//
+// Usernames are not prepared with SASLprep, they are compared as is.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SCRAM mechanism names. Mechanisms with the -PLUS suffix use channel binding.
+const (
+	SHA1 = "SCRAM-SHA-1"
+	SHA1Plus = "SCRAM-SHA-1-PLUS"
+	SHA256 = "SCRAM-SHA-256"
+	SHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// The default number of iterations used by NewCredentials.
+const DefaultIterations = 4096
+
+var errUnsupportedMechanism = errors.New("scram: unsupported mechanism")
+
+// Stored credentials of a user. They can't be used to impersonate the user
+// with other mechanisms.
+type Credentials struct {
+	Salt []byte
+	Iterations int
+	StoredKey []byte
+	ServerKey []byte
+}
+
+// Get the hash function used by a mechanism, and whether it uses channel
+// binding.
+func hashFunc(mechanism string) (h func() hash.Hash, plus bool, err error) {
+	plus = strings.HasSuffix(mechanism, "-PLUS")
+	switch strings.TrimSuffix(mechanism, "-PLUS") {
+	case SHA1:
+		h = sha1.New
+	case SHA256:
+		h = sha256.New
+	default:
+		err = errUnsupportedMechanism
+	}
+	return
+}
+
+func computeHMAC(h func() hash.Hash, key []byte, s string) []byte {
+	mac := hmac.New(h, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func computeHash(h func() hash.Hash, b []byte) []byte {
+	hash := h()
+	hash.Write(b)
+	return hash.Sum(nil)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// A secret used to derive the salt of unknown users, so that it doesn't change
+// between attempts. It's generated when the process starts.
+var fakeSaltKey, _ = randomBytes(32)
+
+// Get the salt sent for an unknown user.
+func fakeSalt(username string) []byte {
+	return computeHMAC(sha256.New, fakeSaltKey, username)[:16]
+}
+
+func newNonce() (string, error) {
+	b, err := randomBytes(18)
+	return base64.StdEncoding.EncodeToString(b), err
+}
+
+// Create credentials from a password for mechanism. If salt is nil, a random
+// one is generated. If iterations is zero, DefaultIterations is used.
+func NewCredentials(mechanism, password string, salt []byte, iterations int) (*Credentials, error) {
+	h, _, err := hashFunc(mechanism)
+	if err != nil {
+		return nil, err
+	}
+
+	if salt == nil {
+		if salt, err = randomBytes(16); err != nil {
+			return nil, err
+		}
+	}
+	if iterations == 0 {
+		iterations = DefaultIterations
+	}
+
+	salted := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	return &Credentials{
+		Salt: salt,
+		Iterations: iterations,
+		StoredKey: computeHash(h, computeHMAC(h, salted, "Client Key")),
+		ServerKey: computeHMAC(h, salted, "Server Key"),
+	}, nil
+}
+
+// Channel binding data, which ties the authentication to a TLS connection.
+type ChannelBinding struct {
+	// The channel binding type, e.g. "tls-unique".
+	Type string
+	Data []byte
+}
+
+// Get the channel binding data of a TLS connection. It uses "tls-exporter"
+// (RFC 9266) with TLS 1.3 and "tls-unique" (RFC 5929) with earlier versions.
+// It returns nil if state is nil or if no channel binding data is available.
+func TLSChannelBinding(state *tls.ConnectionState) *ChannelBinding {
+	if state == nil {
+		return nil
+	}
+
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil
+		}
+		return &ChannelBinding{Type: "tls-exporter", Data: data}
+	}
+
+	if len(state.TLSUnique) == 0 {
+		return nil
+	}
+	return &ChannelBinding{Type: "tls-unique", Data: state.TLSUnique}
+}
+
+var (
+	usernameEscaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+	usernameUnescaper = strings.NewReplacer("=3D", "=", "=2C", ",")
+)
+
+// Parse the attributes of a SCRAM message, e.g. "r=nonce,s=salt,i=4096".
+func parseAttributes(msg string) (attrs map[byte]string, err error) {
+	attrs = map[byte]string{}
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, errors.New("scram: malformed message")
+		}
+		attrs[attr[0]] = attr[2:]
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package scram_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/scram"
+)
+
+// Run a SCRAM exchange between a client and a server.
+func exchange(t *testing.T, mech, password string, clientCB, serverCB *scram.ChannelBinding) error {
+	creds, err := scram.NewCredentials(mech, "password", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(username string) (*scram.Credentials, error) {
+		if username != "user,name" {
+			return nil, errors.New("No such user")
+		}
+		return creds, nil
+	}
+	authenticated := false
+	auth := func(username string, verify func() error) error {
+		if err := verify(); err != nil {
+			return err
+		}
+		authenticated = true
+		return nil
+	}
+
+	c := scram.NewClient(mech, "user,name", password, clientCB)
+	s := scram.NewServer(mech, serverCB, lookup, auth)
+
+	_, response, err := c.Start()
+	if err != nil {
+		return err
+	}
+
+	for {
+		challenge, done, err := s.Next(response)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+
+		if response, err = c.Next(challenge); err != nil {
+			return err
+		}
+	}
+
+	if !authenticated {
+		t.Fatal("Exchange succeeded without authenticating")
+	}
+	return nil
+}
+
+func TestScram(t *testing.T) {
+	cb := &scram.ChannelBinding{Type: "tls-unique", Data: []byte("data")}
+
+	for _, mech := range []string{scram.SHA1, scram.SHA256} {
+		if err := exchange(t, mech, "password", nil, nil); err != nil {
+			t.Errorf("%v: cannot authenticate: %v", mech, err)
+		}
+		if err := exchange(t, mech + "-PLUS", "password", cb, cb); err != nil {
+			t.Errorf("%v-PLUS: cannot authenticate: %v", mech, err)
+		}
+
+		if err := exchange(t, mech, "wrong", nil, nil); err == nil {
+			t.Errorf("%v: authenticated with a wrong password", mech)
+		}
+		if err := exchange(t, mech + "-PLUS", "password", cb, &scram.ChannelBinding{Type: "tls-unique", Data: []byte("other")}); err == nil {
+			t.Errorf("%v-PLUS: authenticated with a channel binding mismatch", mech)
+		}
+		// The client supports channel binding and the server too, but the
+		// client has been told otherwise
+		if err := exchange(t, mech, "password", cb, cb); err == nil {
+			t.Errorf("%v: channel binding downgrade not detected", mech)
+		}
+	}
+}
+
+func TestScram_loginAfterAck(t *testing.T) {
+	creds, err := scram.NewCredentials(scram.SHA256, "password", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(username string) (*scram.Credentials, error) {
+		return creds, nil
+	}
+	authenticated := false
+	auth := func(username string, verify func() error) error {
+		if err := verify(); err != nil {
+			return err
+		}
+		authenticated = true
+		return nil
+	}
+
+	c := scram.NewClient(scram.SHA256, "username", "password", nil)
+	s := scram.NewServer(scram.SHA256, nil, lookup, auth)
+
+	_, response, err := c.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client-first, client-final
+	for i := 0; i < 2; i++ {
+		challenge, done, err := s.Next(response)
+		if err != nil || done {
+			t.Fatal("Unexpected end of exchange:", err)
+		}
+		if response, err = c.Next(challenge); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if authenticated {
+		t.Fatal("Logged in before the client acknowledged the server signature")
+	}
+
+	if _, done, err := s.Next(response); err != nil || !done {
+		t.Fatal("Exchange not completed:", err)
+	}
+	if !authenticated {
+		t.Fatal("Not logged in after the client acknowledged the server signature")
+	}
+}
+
+func TestScram_unknownUserSalt(t *testing.T) {
+	lookup := func(username string) (*scram.Credentials, error) {
+		return nil, errors.New("No such user")
+	}
+	auth := func(username string, verify func() error) error {
+		return verify()
+	}
+
+	salt := func(username string) string {
+		s := scram.NewServer(scram.SHA256, nil, lookup, auth)
+		challenge, _, err := s.Next([]byte("n,,n=" + username + ",r=nonce"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, attr := range strings.Split(string(challenge), ",") {
+			if strings.HasPrefix(attr, "s=") {
+				return attr
+			}
+		}
+		t.Fatal("No salt in challenge:", string(challenge))
+		return ""
+	}
+
+	if salt("nobody") != salt("nobody") {
+		t.Error("The salt of an unknown user changes between attempts")
+	}
+	if salt("nobody") == salt("someone") {
+		t.Error("Unknown users have the same salt")
+	}
+}
@@ -0,0 +1,225 @@
+package scram
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+var errBadCredentials = errors.New("Bad username or password")
+
+// A function returning the stored credentials of a user.
+type CredentialsLookup func(username string) (*Credentials, error)
+
+// A function called when the client acknowledged the server signature, or as
+// soon as it sent an invalid proof. verify checks the proof, the
+// authentication succeeds if nil is returned.
+type Authenticator func(username string, verify func() error) error
+
+type server struct {
+	mechanism string
+	cb *ChannelBinding
+	lookup CredentialsLookup
+	authenticate Authenticator
+
+	h func() hash.Hash
+	plus bool
+	step int
+	username string
+	nonce string
+	gs2Header string
+	clientFirstBare string
+	serverFirst string
+	creds *Credentials
+	credsErr error
+	verify func() error
+}
+
+func (a *server) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.step {
+	case 0:
+		// No initial response, send an empty challenge
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		challenge, err = a.handleClientFirst(string(response))
+	case 1:
+		challenge, err = a.handleClientFinal(string(response))
+	case 2:
+		// The client acknowledged the server signature, the login can be
+		// committed
+		if len(response) != 0 {
+			err = sasl.ErrUnexpectedClientResponse
+		} else {
+			err = a.authenticate(a.username, a.verify)
+		}
+		done = true
+	default:
+		err = sasl.ErrUnexpectedClientResponse
+	}
+	if err != nil {
+		done = true
+	}
+	a.step++
+	return
+}
+
+func (a *server) handleClientFirst(clientFirst string) ([]byte, error) {
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("scram: malformed message")
+	}
+
+	switch flag := parts[0]; {
+	case flag == "n":
+		if a.plus {
+			return nil, errors.New("scram: channel binding required")
+		}
+	case flag == "y":
+		// The client supports channel binding and thinks we don't, but we do
+		if a.cb != nil {
+			return nil, errors.New("scram: channel binding downgrade detected")
+		}
+	case strings.HasPrefix(flag, "p="):
+		if !a.plus || a.cb == nil || flag[2:] != a.cb.Type {
+			return nil, errors.New("scram: unsupported channel binding")
+		}
+	default:
+		return nil, errors.New("scram: malformed message")
+	}
+	if parts[1] != "" {
+		return nil, errors.New("scram: authorization identities not supported")
+	}
+
+	a.gs2Header = parts[0] + ",,"
+	a.clientFirstBare = parts[2]
+
+	attrs, err := parseAttributes(a.clientFirstBare)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("scram: unsupported extension")
+	}
+
+	a.username = usernameUnescaper.Replace(attrs['n'])
+	clientNonce := attrs['r']
+	if a.username == "" || clientNonce == "" {
+		return nil, errors.New("scram: malformed message")
+	}
+
+	a.creds, a.credsErr = a.lookup(a.username)
+	if a.credsErr != nil {
+		// Don't reveal whether the user exists, continue with fake credentials
+		// and fail after receiving the proof
+		if a.creds, err = NewCredentials(a.mechanism, "", fakeSalt(a.username), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	serverNonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	a.nonce = clientNonce + serverNonce
+
+	a.serverFirst = "r=" + a.nonce + ",s=" + base64.StdEncoding.EncodeToString(a.creds.Salt) + ",i=" + strconv.Itoa(a.creds.Iterations)
+	return []byte(a.serverFirst), nil
+}
+
+func (a *server) handleClientFinal(clientFinal string) ([]byte, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return nil, errors.New("scram: malformed message")
+	}
+	withoutProof := clientFinal[:i]
+
+	attrs, err := parseAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+
+	cbind := []byte(a.gs2Header)
+	if strings.HasPrefix(a.gs2Header, "p=") {
+		cbind = append(cbind, a.cb.Data...)
+	}
+	if attrs['c'] != base64.StdEncoding.EncodeToString(cbind) {
+		return nil, errors.New("scram: channel binding mismatch")
+	}
+	if attrs['r'] != a.nonce {
+		return nil, errors.New("scram: invalid nonce")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil {
+		return nil, err
+	}
+
+	h := a.h
+	authMessage := a.clientFirstBare + "," + a.serverFirst + "," + withoutProof
+
+	verify := func() error {
+		if a.credsErr != nil {
+			return a.credsErr
+		}
+
+		clientSignature := computeHMAC(h, a.creds.StoredKey, authMessage)
+		if len(proof) != len(clientSignature) {
+			return errBadCredentials
+		}
+
+		clientKey := make([]byte, len(proof))
+		for i := range proof {
+			clientKey[i] = proof[i] ^ clientSignature[i]
+		}
+		if !hmac.Equal(computeHash(h, clientKey), a.creds.StoredKey) {
+			return errBadCredentials
+		}
+		return nil
+	}
+
+	if err := verify(); err != nil {
+		// Don't send the server signature, but let the authenticator record
+		// the failed attempt
+		if authErr := a.authenticate(a.username, verify); authErr != nil {
+			err = authErr
+		}
+		return nil, err
+	}
+	a.verify = verify
+
+	serverSignature := computeHMAC(h, a.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+type errServer struct {
+	err error
+}
+
+func (a *errServer) Next(response []byte) ([]byte, bool, error) {
+	return nil, true, a.err
+}
+
+// Create a server for a SCRAM mechanism, e.g. SHA256. cb is the channel
+// binding data of the connection, or nil if not available. It's required by
+// -PLUS mechanisms.
+func NewServer(mechanism string, cb *ChannelBinding, lookup CredentialsLookup, auth Authenticator) sasl.Server {
+	h, plus, err := hashFunc(mechanism)
+	if err != nil {
+		return &errServer{err}
+	}
+
+	return &server{
+		mechanism: mechanism,
+		cb: cb,
+		lookup: lookup,
+		authenticate: auth,
+		h: h,
+		plus: plus,
+	}
+}
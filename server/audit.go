@@ -0,0 +1,172 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// A record of an operation modifying mailboxes, e.g. deleting a mailbox or
+// flagging messages.
+type AuditRecord struct {
+	// The time the operation completed.
+	Time time.Time `json:"time"`
+	// The ID of the connection, see Conn.ID.
+	ConnID uint64 `json:"conn_id"`
+	// The logged in user.
+	Username string `json:"username"`
+	// The client's address.
+	RemoteAddr string `json:"remote_addr"`
+	// The command, e.g. "UID STORE".
+	Command string `json:"command"`
+	// The mailbox the operation applies to: the selected mailbox for STORE,
+	// COPY, MOVE and EXPUNGE, the existing mailbox for RENAME.
+	Mailbox string `json:"mailbox,omitempty"`
+	// The destination mailbox for RENAME, COPY and MOVE.
+	Destination string `json:"destination,omitempty"`
+	// The UIDs of the affected messages in Mailbox, resolved before the
+	// operation is executed.
+	Uids []uint32 `json:"uids,omitempty"`
+	// For STORE, the operation, e.g. "+FLAGS.SILENT", and the flags. For
+	// APPEND, the flags of the new message.
+	Operation string `json:"operation,omitempty"`
+	Flags []string `json:"flags,omitempty"`
+	// The status of the command's response, and its text.
+	Result common.StatusRespType `json:"result"`
+	Info string `json:"info,omitempty"`
+}
+
+// An AuditSink stores audit records. It must be safe for concurrent use.
+type AuditSink interface {
+	WriteAudit(rec *AuditRecord) error
+}
+
+// A handler of a command that modifies mailboxes, e.g. an extension command
+// such as MOVE. The built-in commands don't need to implement it.
+type AuditHandler interface {
+	Handler
+
+	// Describe the operation in rec. It's called before the command is
+	// executed, so that affected messages can be resolved.
+	Audit(conn *Conn, rec *AuditRecord) error
+}
+
+// Create a middleware recording operations modifying mailboxes to sink: CREATE,
+// DELETE, RENAME, APPEND, STORE, COPY, EXPUNGE, CLOSE (which expunges
+// messages) and commands whose handler implements AuditHandler, e.g. MOVE.
+// Other commands aren't recorded.
+//
+// Records are written after the command has completed, whatever its outcome.
+// Failures to resolve affected messages or to write records are logged, they
+// don't prevent the command from being executed.
+func Audit(sink AuditSink) Middleware {
+	return func(next CommandFunc) CommandFunc {
+		return func(conn *Conn, cmd *common.Command, hdlr Handler) *common.StatusResp {
+			rec := &AuditRecord{
+				ConnID: conn.ID(),
+				Username: conn.Username(),
+				RemoteAddr: conn.RemoteAddr().String(),
+				Command: commandName(cmd),
+			}
+
+			audited, err := describeOperation(conn, hdlr, rec)
+			if !audited {
+				return next(conn, cmd, hdlr)
+			}
+			if err != nil {
+				conn.log(common.LogError, "cannot resolve messages for audit record", err)
+			}
+
+			status := next(conn, cmd, hdlr)
+
+			rec.Time = time.Now()
+			rec.Result = status.Type
+			if status.Type != common.OK {
+				rec.Info = status.Info
+			}
+			if err := sink.WriteAudit(rec); err != nil {
+				conn.log(common.LogError, "cannot write audit record", err)
+			}
+			return status
+		}
+	}
+}
+
+// Describe the operation executed by hdlr in rec. It returns false if the
+// operation isn't audited.
+func describeOperation(conn *Conn, hdlr Handler, rec *AuditRecord) (bool, error) {
+	uid := false
+	if cmd, ok := hdlr.(*Uid); ok {
+		inner, err := cmd.Inner(conn)
+		if err != nil {
+			// The command will fail
+			return false, nil
+		}
+		hdlr = inner
+		uid = true
+	}
+
+	switch cmd := hdlr.(type) {
+	case *Create:
+		rec.Mailbox = cmd.Mailbox
+	case *Delete:
+		rec.Mailbox = cmd.Mailbox
+	case *Rename:
+		rec.Mailbox = cmd.Existing
+		rec.Destination = cmd.New
+	case *Append:
+		rec.Mailbox = cmd.Mailbox
+		rec.Flags = cmd.Flags
+	case *Store:
+		rec.Operation = strings.ToUpper(cmd.Item)
+		if list, ok := cmd.Value.([]interface{}); ok {
+			rec.Flags, _ = common.ParseStringList(list)
+		}
+		return true, resolveUids(conn, uid, cmd.SeqSet, rec)
+	case *Copy:
+		rec.Destination = cmd.Mailbox
+		return true, resolveUids(conn, uid, cmd.SeqSet, rec)
+	case *Expunge, *Close:
+		if conn.MailboxReadOnly {
+			// Nothing is expunged
+			return false, nil
+		}
+		return true, resolveDeleted(conn, rec)
+	case AuditHandler:
+		return true, cmd.Audit(conn, rec)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Resolve the UIDs of the messages of the selected mailbox in seqSet.
+func resolveUids(conn *Conn, uid bool, seqSet *common.SeqSet, rec *AuditRecord) error {
+	if conn.Mailbox == nil {
+		return nil
+	}
+	rec.Mailbox = conn.Mailbox.Name()
+
+	criteria := &common.SearchCriteria{Uid: seqSet}
+	if !uid {
+		criteria = &common.SearchCriteria{SeqSet: conn.seqNums.snapshot().toBackend(seqSet)}
+	}
+
+	var err error
+	rec.Uids, err = conn.Mailbox.SearchMessages(true, criteria)
+	return err
+}
+
+// Resolve the UIDs of the messages of the selected mailbox that will be
+// expunged.
+func resolveDeleted(conn *Conn, rec *AuditRecord) error {
+	if conn.Mailbox == nil {
+		return nil
+	}
+	rec.Mailbox = conn.Mailbox.Name()
+
+	var err error
+	rec.Uids, err = conn.Mailbox.SearchMessages(true, &common.SearchCriteria{Deleted: true})
+	return err
+}
@@ -0,0 +1,99 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// An audit sink keeping records in memory.
+type memoryAuditSink struct {
+	locker sync.Mutex
+	records []*server.AuditRecord
+}
+
+func (s *memoryAuditSink) WriteAudit(rec *server.AuditRecord) error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.records = append(s.records, rec)
+	return nil
+}
+
+func TestAudit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	sink := &memoryAuditSink{}
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Use(server.Audit(sink))
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	cmds := []string{
+		"LOGIN username password",
+		"CREATE Archive",
+		"APPEND INBOX (\\Seen) {1}",
+		"SELECT INBOX",
+		"FETCH 1:* (UID)",
+		"STORE 2 +FLAGS.SILENT (\\Deleted)",
+		"UID COPY 6:* Archive",
+		"EXPUNGE",
+		"RENAME Archive Old",
+		"DELETE Nonexistent",
+	}
+	for i, cmd := range cmds {
+		tag := fmt.Sprintf("a%03d", i)
+		io.WriteString(c, tag + " " + cmd + "\r\n")
+		if strings.HasSuffix(cmd, "{1}") {
+			scanner.Scan() // Continuation request
+			io.WriteString(c, "a\r\n")
+		}
+		for scanner.Scan() && !strings.HasPrefix(scanner.Text(), tag + " ") {}
+	}
+
+	sink.locker.Lock()
+	defer sink.locker.Unlock()
+
+	expected := []string{
+		"CREATE Archive> [] [] OK",
+		"APPEND INBOX> [] [\\Seen] OK",
+		"STORE INBOX> [7] [\\Deleted] OK",
+		"UID COPY INBOX>Archive [6 7] [] OK",
+		"EXPUNGE INBOX> [7] [] OK",
+		"RENAME Archive>Old [] [] OK",
+		"DELETE Nonexistent> [] [] NO",
+	}
+
+	var got []string
+	for _, rec := range sink.records {
+		if rec.Username != "username" || rec.RemoteAddr != c.LocalAddr().String() || rec.Time.IsZero() {
+			t.Errorf("Bad audit record: %+v", rec)
+		}
+
+		got = append(got, fmt.Sprintf("%v %v>%v %v %v %v", rec.Command, rec.Mailbox, rec.Destination, rec.Uids, rec.Flags, rec.Result))
+	}
+
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Bad audit records: expected \n%v\n but got \n%v", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An AuditSink writing records to a file, one JSON object per line.
+//
+// When the file reaches MaxSize, it's rotated: it's renamed with the current
+// time as suffix, e.g. "audit.log.20060102T150405.000000000", and a new file
+// is created.
+//
+// If the file cannot be rotated, the error is returned by WriteAudit and the
+// file is reopened by the next call.
+type FileAuditSink struct {
+	// The path of the file.
+	Path string
+	// The maximum size of the file, in bytes. Zero means the file is never
+	// rotated.
+	MaxSize int64
+	// The maximum number of rotated files to keep, the oldest ones are
+	// removed. Zero means all files are kept.
+	MaxBackups int
+
+	locker sync.Mutex
+	f *os.File
+	size int64
+	closed bool
+}
+
+// The format of the suffix of rotated files.
+const auditRotateFormat = "20060102T150405.000000000"
+
+// Open a file audit sink. Records are appended to the file if it already
+// exists.
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (*FileAuditSink, error) {
+	s := &FileAuditSink{
+		Path: path,
+		MaxSize: maxSize,
+		MaxBackups: maxBackups,
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) WriteAudit(rec *AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	// The file may have been left closed by a failed rotation
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	var rotateErr error
+	if s.MaxSize > 0 && s.size > 0 && s.size + int64(len(b)) > s.MaxSize {
+		rotateErr = s.rotate()
+		if s.f == nil {
+			return rotateErr
+		}
+	}
+
+	// The record is written even if the file cannot be rotated
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+// Rotate the file. Must be called with locker held. If the file cannot be
+// reopened, it's left nil.
+func (s *FileAuditSink) rotate() error {
+	closeErr := s.f.Close()
+	s.f = nil
+
+	// Reopen the file even if it cannot be renamed, so that records can still
+	// be written
+	rotated := s.Path + "." + time.Now().UTC().Format(auditRotateFormat)
+	renameErr := os.Rename(s.Path, rotated)
+
+	if err := s.open(); err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	return s.removeBackups()
+}
+
+// Check if a file name is the name of a file rotated by this sink.
+func (s *FileAuditSink) isBackup(name string) bool {
+	prefix := filepath.Base(s.Path) + "."
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+
+	_, err := time.Parse(auditRotateFormat, strings.TrimPrefix(name, prefix))
+	return err == nil
+}
+
+// Remove the oldest rotated files, if there are too many of them.
+func (s *FileAuditSink) removeBackups() error {
+	if s.MaxBackups <= 0 {
+		return nil
+	}
+
+	// Only list files with a timestamp suffix, the path may contain glob
+	// metacharacters and other files may start with the same name
+	entries, err := os.ReadDir(filepath.Dir(s.Path))
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		if s.isBackup(e.Name()) {
+			backups = append(backups, filepath.Join(filepath.Dir(s.Path), e.Name()))
+		}
+	}
+	if len(backups) <= s.MaxBackups {
+		return nil
+	}
+
+	// Suffixes are timestamps, the oldest files come first
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups) - s.MaxBackups] {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close the file.
+func (s *FileAuditSink) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.closed = true
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
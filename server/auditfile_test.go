@@ -0,0 +1,164 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap/server"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	rec := &server.AuditRecord{Username: "username", Command: "DELETE", Mailbox: "Archive"}
+	b, _ := json.Marshal(rec)
+	size := int64(len(b) + 1)
+
+	// Two records per file
+	sink, err := server.NewFileAuditSink(path, 2 * size, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 9; i++ {
+		if err := sink.WriteAudit(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files, got %v", files)
+	}
+
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n := 0
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			got := &server.AuditRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), got); err != nil {
+				t.Fatalf("Invalid record in %v: %v", name, err)
+			}
+			if got.Mailbox != rec.Mailbox {
+				t.Fatalf("Bad record in %v: %v", name, scanner.Text())
+			}
+			n++
+		}
+		f.Close()
+
+		expected := 2
+		if name == path {
+			expected = 1
+		}
+		if n != expected {
+			t.Errorf("Expected %v records in %v, got %v", expected, name, n)
+		}
+	}
+}
+
+func TestFileAuditSink_backups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit[1].log")
+
+	// Files which aren't rotated audit files
+	others := []string{"audit[1].log.keep", "audit[1].log.20060102T150405.000000000.gz", "audit1.log.20060102T150405.000000000"}
+	for _, name := range others {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One record per file
+	sink, err := server.NewFileAuditSink(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	rec := &server.AuditRecord{Username: "username", Command: "DELETE", Mailbox: "Archive"}
+	for i := 0; i < 4; i++ {
+		if err := sink.WriteAudit(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("File %v removed: %v", name, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(others) + 2 {
+		t.Errorf("Expected the file and one backup, got %v entries", len(entries))
+	}
+}
+
+func TestFileAuditSink_rotateError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := server.NewFileAuditSink(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	rec := &server.AuditRecord{Username: "username", Command: "DELETE", Mailbox: "Archive"}
+	if err := sink.WriteAudit(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file can be neither renamed nor reopened
+	if err := os.Rename(dir, dir + ".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteAudit(rec); err == nil {
+		t.Fatal("Expected an error when the file cannot be rotated")
+	}
+
+	// Records are written again once the file can be reopened
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteAudit(rec); err != nil {
+		t.Fatal("Cannot write record after a failed rotation:", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &server.AuditRecord{}
+	if err := json.Unmarshal(b, got); err != nil || got.Mailbox != rec.Mailbox {
+		t.Errorf("Bad file contents after a failed rotation: %q", b)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteAudit(rec); err != os.ErrClosed {
+		t.Errorf("Expected os.ErrClosed after closing, got %v", err)
+	}
+}
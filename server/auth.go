@@ -0,0 +1,588 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/scram"
+	"github.com/emersion/go-sasl"
+)
+
+// An authentication attempt.
+type AuthEvent struct {
+	// The time of the attempt.
+	Time time.Time
+	// The client's address.
+	RemoteAddr net.Addr
+	// The authentication mechanism, "LOGIN" for the LOGIN command and the LOGIN
+	// mechanism.
+	Mechanism string
+	// The username sent by the client.
+	Username string
+	// True if the attempt succeeded.
+	Success bool
+	// True if the attempt has been rejected by the AuthLimiter, without being
+	// checked by the backend.
+	Throttled bool
+	// If the attempt failed, the reason why.
+	Err error
+}
+
+// An AuthLimiter throttles authentication attempts, e.g. to protect against
+// brute-force attacks.
+type AuthLimiter interface {
+	// Allow is called before an authentication attempt is checked by the
+	// backend. It can block to delay the attempt. If an error is returned, the
+	// attempt is rejected.
+	Allow(ip, username string) error
+	// Failure is called after an attempt failed.
+	Failure(ip, username string)
+	// Success is called after an attempt succeeded.
+	Success(ip, username string)
+}
+
+// ErrAuthThrottled is returned by FailureLimiter when too many attempts failed.
+var ErrAuthThrottled = errors.New("Too many failed authentication attempts, try again later")
+
+// ErrAuthFailed is sent to clients when an authentication attempt fails. The
+// error returned by the backend is only logged, it could give away whether the
+// username exists.
+var ErrAuthFailed = errors.New("Invalid credentials")
+
+// The default maximum number of entries of a FailureLimiter.
+const defaultMaxFailureEntries = 4096
+
+// The default period of time after which a FailureLimiter forgets failures.
+const defaultFailureWindow = 15 * time.Minute
+
+type authFailures struct {
+	count int
+	last time.Time
+}
+
+// A FailureLimiter is an AuthLimiter counting failed attempts per IP address
+// and per username. Each failure delays the next attempts, and attempts are
+// rejected once too many failed. Failures are forgotten after a period of
+// time without any failure.
+type FailureLimiter struct {
+	// The number of failures after which attempts are rejected.
+	MaxFailures int
+	// The period of time after which failures are forgotten. Zero means 15
+	// minutes.
+	Window time.Duration
+	// The delay added to attempts for each failure, up to MaxDelay.
+	Delay time.Duration
+	MaxDelay time.Duration
+	// The maximum number of IP addresses and usernames tracked. Once reached,
+	// the oldest failures are forgotten. Zero means 4096.
+	MaxEntries int
+
+	locker sync.Mutex
+	failures map[string]*authFailures
+}
+
+// Create a new FailureLimiter.
+func NewFailureLimiter(maxFailures int, window time.Duration) *FailureLimiter {
+	return &FailureLimiter{
+		MaxFailures: maxFailures,
+		Window: window,
+		Delay: time.Second,
+		MaxDelay: 5 * time.Second,
+		failures: map[string]*authFailures{},
+	}
+}
+
+func failureKeys(ip, username string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:" + username)
+	}
+	return keys
+}
+
+func (l *FailureLimiter) window() time.Duration {
+	if l.Window <= 0 {
+		return defaultFailureWindow
+	}
+	return l.Window
+}
+
+// Get the number of recent failures. Must be called with locker held.
+func (l *FailureLimiter) count(key string, now time.Time) int {
+	f, ok := l.failures[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(f.last) > l.window() {
+		delete(l.failures, key)
+		return 0
+	}
+	return f.count
+}
+
+func (l *FailureLimiter) Allow(ip, username string) error {
+	now := time.Now()
+
+	l.locker.Lock()
+	n := 0
+	for _, key := range failureKeys(ip, username) {
+		if c := l.count(key, now); c > n {
+			n = c
+		}
+	}
+	l.locker.Unlock()
+
+	if l.MaxFailures > 0 && n >= l.MaxFailures {
+		return ErrAuthThrottled
+	}
+
+	delay := l.Delay * time.Duration(n)
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	time.Sleep(delay)
+	return nil
+}
+
+func (l *FailureLimiter) Failure(ip, username string) {
+	now := time.Now()
+
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	if l.failures == nil {
+		l.failures = map[string]*authFailures{}
+	}
+
+	for _, key := range failureKeys(ip, username) {
+		n := l.count(key, now)
+		l.failures[key] = &authFailures{count: n + 1, last: now}
+	}
+
+	// Don't let the map grow forever
+	max := l.MaxEntries
+	if max <= 0 {
+		max = defaultMaxFailureEntries
+	}
+	if len(l.failures) > max {
+		l.evict(max, now)
+	}
+}
+
+// Forget expired failures, and then the oldest ones until there are at most
+// max entries left. Must be called with locker held.
+func (l *FailureLimiter) evict(max int, now time.Time) {
+	keys := make([]string, 0, len(l.failures))
+	for key := range l.failures {
+		if l.count(key, now) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) <= max {
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return l.failures[keys[i]].last.Before(l.failures[keys[j]].last)
+	})
+	for _, key := range keys[:len(keys)-max] {
+		delete(l.failures, key)
+	}
+}
+
+func (l *FailureLimiter) Success(ip, username string) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	delete(l.failures, "user:" + username)
+}
+
+// Authenticate the client. login is called to check the credentials, unless
+// the attempt is rejected by the server's AuthLimiter.
+func (c *Conn) authenticate(mechanism, username string, login func() (backend.User, error)) error {
+	s := c.Server
+	ip := remoteIP(c)
+
+	ev := &AuthEvent{
+		Time: time.Now(),
+		RemoteAddr: c.RemoteAddr(),
+		Mechanism: mechanism,
+		Username: username,
+	}
+
+	if s.AuthLimiter != nil {
+		if err := s.AuthLimiter.Allow(ip, username); err != nil {
+			ev.Throttled = true
+			ev.Err = err
+			s.authEvent(ev)
+
+			c.authFailed()
+			return &CodeError{Code: "UNAVAILABLE", Err: err}
+		}
+	}
+
+	user, err := login()
+	if err != nil {
+		ev.Err = err
+		s.authEvent(ev)
+		c.log(common.LogInfo, "authentication failed", err)
+
+		if s.AuthLimiter != nil {
+			s.AuthLimiter.Failure(ip, username)
+		}
+		c.authFailed()
+		return &CodeError{Code: "AUTHENTICATIONFAILED", Err: ErrAuthFailed}
+	}
+
+	if s.AuthLimiter != nil {
+		s.AuthLimiter.Success(ip, username)
+	}
+	ev.Success = true
+	s.authEvent(ev)
+
+	if err := c.setUser(user); err != nil {
+		return err
+	}
+
+	c.setState(common.AuthenticatedState)
+	return nil
+}
+
+// Count a failed authentication attempt, and close the connection if there
+// were too many of them. The tagged response is still sent.
+func (c *Conn) authFailed() {
+	c.authFailures++
+
+	max := c.Server.MaxAuthFailures
+	if max <= 0 || c.authFailures < max {
+		return
+	}
+
+	res := &common.StatusResp{
+		Tag: "*",
+		Type: common.BYE,
+		Info: "Too many authentication failures",
+	}
+	c.WriteRes(res)
+
+	// Request to close the connection
+	c.setState(common.LogoutState)
+}
+
+func (s *Server) authEvent(ev *AuthEvent) {
+	if !ev.Success && s.Metrics != nil {
+		s.Metrics.AuthFailed(ev.Mechanism)
+	}
+	if s.AuthHook != nil {
+		s.AuthHook(ev)
+	}
+}
+
+// A server implementation of the EXTERNAL authentication mechanism, as
+// described in RFC 4422 appendix A. authenticate is called with the
+// authorization identity requested by the client.
+type externalServer struct {
+	done bool
+	authenticate func(identity string) error
+}
+
+func (a *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		err = sasl.ErrUnexpectedClientResponse
+		return
+	}
+
+	// No initial response, send an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+	err = a.authenticate(string(response))
+	done = true
+	return
+}
+
+// Create a SASL server for the EXTERNAL mechanism. It's only available on
+// connections with a verified TLS client certificate, if the backend
+// implements backend.ExternalBackend.
+func newExternalServer(conn *Conn) sasl.Server {
+	bkd, ok := conn.Server.Backend.(backend.ExternalBackend)
+	if !ok {
+		return nil
+	}
+
+	state := conn.TLSState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return &externalServer{authenticate: func(identity string) error {
+		username := identity
+		if username == "" {
+			username = state.PeerCertificates[0].Subject.CommonName
+		}
+
+		return conn.authenticate(sasl.External, username, func() (backend.User, error) {
+			return bkd.LoginExternal(conn.Info(sasl.External), identity)
+		})
+	}}
+}
+
+// A server implementation of the OAUTHBEARER (RFC 7628) and XOAUTH2
+// authentication mechanisms. authenticate is called with the username and the
+// bearer token sent by the client.
+type oauthServer struct {
+	xoauth2 bool
+	done bool
+	failErr error
+	authenticate func(username, token string) error
+}
+
+func (a *oauthServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	// The client acknowledged the error challenge, the exchange can be stopped
+	if a.failErr != nil {
+		return nil, true, a.failErr
+	}
+
+	if a.done {
+		err = sasl.ErrUnexpectedClientResponse
+		return
+	}
+
+	// No initial response, send an empty challenge
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	var username, token string
+	if a.xoauth2 {
+		username, token, err = parseXOAuth2(response)
+	} else {
+		username, token, err = parseOAuthBearer(response)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	a.failErr = a.authenticate(username, token)
+	if a.failErr == nil {
+		return nil, true, nil
+	}
+
+	// Send the error as a JSON challenge, see RFC 7628 section 3.2.2
+	oauthErr := &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+	if codeErr, ok := a.failErr.(*CodeError); ok {
+		if e, ok := codeErr.Err.(*sasl.OAuthBearerError); ok {
+			oauthErr = e
+		}
+	}
+
+	if challenge, err = json.Marshal(oauthErr); err != nil {
+		return nil, true, err
+	}
+	return challenge, false, nil
+}
+
+// Parse the key/value pairs of an OAuth response, separated by 0x01.
+func parseOAuthParams(b []byte) (params map[string]string, err error) {
+	params = map[string]string{}
+	for _, p := range bytes.Split(b, []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+
+		kv := bytes.SplitN(p, []byte{'='}, 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Malformed OAuth response")
+		}
+		params[string(kv[0])] = string(kv[1])
+	}
+	return
+}
+
+// Get the token from the value of the auth parameter.
+func parseBearer(auth string) (string, error) {
+	const prefix = "bearer "
+	if !strings.HasPrefix(strings.ToLower(auth), prefix) {
+		return "", errors.New("Unsupported OAuth token type")
+	}
+	return auth[len(prefix):], nil
+}
+
+// Parse an OAUTHBEARER response, e.g.
+// "n,a=username,\x01auth=Bearer token\x01\x01".
+func parseOAuthBearer(response []byte) (username, token string, err error) {
+	parts := bytes.SplitN(response, []byte{','}, 3)
+	if len(parts) != 3 {
+		err = errors.New("Malformed OAUTHBEARER response")
+		return
+	}
+
+	// Channel binding is not supported
+	if flag := string(parts[0]); flag != "n" && flag != "y" {
+		err = errors.New("Channel binding not supported")
+		return
+	}
+
+	if authzid := string(parts[1]); authzid != "" {
+		if !strings.HasPrefix(authzid, "a=") {
+			err = errors.New("Malformed OAUTHBEARER response")
+			return
+		}
+		username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(authzid[2:])
+	}
+
+	params, err := parseOAuthParams(parts[2])
+	if err != nil {
+		return
+	}
+	token, err = parseBearer(params["auth"])
+	return
+}
+
+// Parse a XOAUTH2 response, e.g. "user=username\x01auth=Bearer token\x01\x01".
+func parseXOAuth2(response []byte) (username, token string, err error) {
+	params, err := parseOAuthParams(response)
+	if err != nil {
+		return
+	}
+	username = params["user"]
+	token, err = parseBearer(params["auth"])
+	return
+}
+
+// Create a factory of SASL servers for the OAUTHBEARER or XOAUTH2 mechanism.
+// They're only available if the backend implements backend.OAuthBackend.
+func newOAuthServerFactory(mechanism string) SaslServerFactory {
+	return func(conn *Conn) sasl.Server {
+		bkd, ok := conn.Server.Backend.(backend.OAuthBackend)
+		if !ok {
+			return nil
+		}
+
+		return &oauthServer{
+			xoauth2: mechanism == "XOAUTH2",
+			authenticate: func(username, token string) error {
+				return conn.authenticate(mechanism, username, func() (backend.User, error) {
+					return bkd.LoginOAuth(conn.Info(mechanism), username, token)
+				})
+			},
+		}
+	}
+}
+
+// Create a factory of SASL servers for a SCRAM mechanism. They're only
+// available if the backend implements backend.ScramBackend, -PLUS mechanisms
+// also require a TLS connection.
+func newScramServerFactory(mechanism string) SaslServerFactory {
+	return func(conn *Conn) sasl.Server {
+		bkd, ok := conn.Server.Backend.(backend.ScramBackend)
+		if !ok {
+			return nil
+		}
+
+		cb := scram.TLSChannelBinding(conn.TLSState())
+		if strings.HasSuffix(mechanism, "-PLUS") && cb == nil {
+			return nil
+		}
+
+		lookup := func(username string) (*scram.Credentials, error) {
+			return bkd.ScramCredentials(conn.Info(mechanism), username, strings.TrimSuffix(mechanism, "-PLUS"))
+		}
+
+		return scram.NewServer(mechanism, cb, lookup, func(username string, verify func() error) error {
+			return conn.authenticate(mechanism, username, func() (backend.User, error) {
+				if err := verify(); err != nil {
+					return nil, err
+				}
+				return bkd.LoginVerified(conn.Info(mechanism), username)
+			})
+		})
+	}
+}
+
+// A server implementation of the CRAM-MD5 authentication mechanism, as
+// described in RFC 2195. authenticate is called with the username and the
+// digest sent by the client.
+type cramMD5Server struct {
+	challenge []byte
+	authenticate func(username string, challenge, digest []byte) error
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.challenge == nil {
+		// CRAM-MD5 doesn't support initial responses
+		if response != nil {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+
+		hostname, _ := os.Hostname()
+		if hostname == "" {
+			hostname = "localhost"
+		}
+
+		b := make([]byte, 8)
+		if _, err = rand.Read(b); err != nil {
+			return nil, true, err
+		}
+
+		a.challenge = []byte(fmt.Sprintf("<%x.%d@%s>", b, time.Now().Unix(), hostname))
+		return a.challenge, false, nil
+	}
+
+	// The response is the username and the hex-encoded digest
+	i := bytes.LastIndexByte(response, ' ')
+	if i < 0 {
+		return nil, true, errors.New("Malformed CRAM-MD5 response")
+	}
+
+	digest, err := hex.DecodeString(string(response[i+1:]))
+	if err != nil {
+		return nil, true, err
+	}
+
+	return nil, true, a.authenticate(string(response[:i]), a.challenge, digest)
+}
+
+// Create a SASL server for the CRAM-MD5 mechanism. It's only available if the
+// backend implements backend.CramMD5Backend.
+func newCramMD5Server(conn *Conn) sasl.Server {
+	bkd, ok := conn.Server.Backend.(backend.CramMD5Backend)
+	if !ok {
+		return nil
+	}
+
+	return &cramMD5Server{authenticate: func(username string, challenge, digest []byte) error {
+		return conn.authenticate("CRAM-MD5", username, func() (backend.User, error) {
+			secret, err := bkd.CramMD5Secret(conn.Info("CRAM-MD5"), username)
+			if err != nil {
+				return nil, err
+			}
+
+			mac := hmac.New(md5.New, secret)
+			mac.Write(challenge)
+			if !hmac.Equal(mac.Sum(nil), digest) {
+				return nil, errors.New("Bad username or password")
+			}
+
+			return bkd.LoginVerified(conn.Info("CRAM-MD5"), username)
+		})
+	}}
+}
@@ -16,7 +16,11 @@ func (cmd *Capability) Handle(conn *Conn) error {
 		Caps: conn.getCaps(),
 	}
 
-	return conn.WriteRes(res.Response())
+	return conn.writeCmdRes(res.Response())
+}
+
+func (cmd *Capability) Concurrent(conn *Conn) bool {
+	return true
 }
 
 type Noop struct {
@@ -34,6 +38,11 @@ func (cmd *Noop) Handle(conn *Conn) error {
 	return nil
 }
 
+func (cmd *Noop) Concurrent(conn *Conn) bool {
+	// Polling can send EXPUNGE responses
+	return conn.Mailbox == nil
+}
+
 type Logout struct {
 	commands.Logout
 }
@@ -50,6 +59,6 @@ func (cmd *Logout) Handle(conn *Conn) error {
 	}
 
 	// Request to close the connection
-	conn.State = common.LogoutState
+	conn.setState(common.LogoutState)
 	return nil
 }
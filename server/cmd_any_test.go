@@ -26,7 +26,7 @@ func TestCapability(t *testing.T) {
 	io.WriteString(c, "a001 CAPABILITY\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "* CAPABILITY IMAP4rev1 AUTH=PLAIN" {
+	if scanner.Text() != "* CAPABILITY IMAP4rev1 AUTH=LOGIN AUTH=PLAIN SASL-IR" {
 		t.Fatal("Bad capability:", scanner.Text())
 	}
 
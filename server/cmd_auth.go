@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 
+	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-imap/common"
 	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-imap/responses"
@@ -38,13 +39,56 @@ func (cmd *Select) Handle(conn *Conn) error {
 		return err
 	}
 
-	conn.Mailbox = mbox
+	// Receive updates for the mailbox before listing its messages, so that
+	// none is missed. Updates of the previously selected mailbox must have
+	// been processed first.
+	conn.setMailbox(mbox)
+	conn.Server.syncUpdates()
+	conn.seqNums.startSelect()
+
+	// If the backend sends updates, they can be addressed by UID
+	uids := make([]uint32, status.Messages)
+	if conn.Server.Updates != nil {
+		if uids, err = listUids(mbox); err != nil {
+			conn.setMailbox(nil)
+			conn.MailboxReadOnly = false
+			conn.seqNums.reset(nil)
+			return err
+		}
+	}
+
 	conn.MailboxReadOnly = cmd.ReadOnly || status.ReadOnly
+	conn.seqNums.reset(uids)
+
+	// EXISTS and UIDNEXT must be consistent with the UIDs known by the client
+	status.Messages = conn.seqNums.count()
+	if next := conn.seqNums.maxUid() + 1; next > status.UidNext {
+		status.UidNext = next
+	}
 
 	res := &responses.Select{Mailbox: status}
 	return conn.WriteRes(res)
 }
 
+// List the UIDs of all messages in a mailbox.
+func listUids(mbox backend.Mailbox) ([]uint32, error) {
+	seqSet, _ := common.NewSeqSet("1:*")
+
+	ch := make(chan *common.Message)
+	done := make(chan []uint32)
+	go (func() {
+		var uids []uint32
+		for msg := range ch {
+			uids = append(uids, msg.Uid)
+		}
+		done <- uids
+	})()
+
+	err := mbox.ListMessages(true, seqSet, []string{"UID"}, ch)
+	uids := <-done
+	return uids, err
+}
+
 type Create struct {
 	commands.Create
 }
@@ -131,7 +175,7 @@ func (cmd *List) Handle(conn *Conn) error {
 	res := &responses.List{Mailboxes: ch, Subscribed: cmd.Subscribed}
 
 	go (func () {
-		done <- conn.WriteRes(res)
+		done <- conn.writeCmdRes(res)
 	})()
 
 	mailboxes, err := conn.User.ListMailboxes(cmd.Subscribed)
@@ -160,6 +204,10 @@ func (cmd *List) Handle(conn *Conn) error {
 	return <-done
 }
 
+func (cmd *List) Concurrent(conn *Conn) bool {
+	return true
+}
+
 type Status struct {
 	commands.Status
 }
@@ -180,7 +228,11 @@ func (cmd *Status) Handle(conn *Conn) error {
 	}
 
 	res := &responses.Status{Mailbox: status}
-	return conn.WriteRes(res)
+	return conn.writeCmdRes(res)
+}
+
+func (cmd *Status) Concurrent(conn *Conn) bool {
+	return true
 }
 
 type Append struct {
@@ -209,6 +261,7 @@ func (cmd *Append) Handle(conn *Conn) error {
 		if err != nil {
 			return err
 		}
+		status.Messages, _ = conn.seqNums.exists(status.Messages)
 
 		res := &responses.Select{Mailbox: status}
 		if err := conn.WriteRes(res); err != nil {
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"net"
 
+	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-imap/common"
 	"github.com/emersion/go-imap/commands"
-	"github.com/emersion/go-sasl"
 )
 
 // Common errors in Not Authenticated state.
@@ -30,7 +30,10 @@ func (cmd *StartTLS) Handle(conn *Conn) error {
 	if conn.Server.TLSConfig == nil {
 		return errors.New("TLS support not enabled")
 	}
+	return nil
+}
 
+func (cmd *StartTLS) Upgrade(conn *Conn) error {
 	tlsConfig := conn.Server.TLSConfig
 	upgrader := func (conn net.Conn) (net.Conn, error) {
 		upgraded := tls.Server(conn, tlsConfig)
@@ -38,12 +41,9 @@ func (cmd *StartTLS) Handle(conn *Conn) error {
 		return upgraded, err
 	}
 
-	if err := conn.Upgrade(upgrader); err != nil {
-		return err
-	}
-
-	conn.isTLS = true
-	return nil
+	// Data sent by the client before the TLS negotiation is discarded, to
+	// prevent command injection
+	return conn.Upgrade(upgrader)
 }
 
 type Login struct {
@@ -58,14 +58,9 @@ func (cmd *Login) Handle(conn *Conn) error {
 		return ErrAuthDisabled
 	}
 
-	user, err := conn.Server.Backend.Login(cmd.Username, cmd.Password)
-	if err != nil {
-		return err
-	}
-
-	conn.State = common.AuthenticatedState
-	conn.User = user
-	return nil
+	return conn.authenticate("LOGIN", cmd.Username, func() (backend.User, error) {
+		return conn.login("LOGIN", cmd.Username, cmd.Password)
+	})
 }
 
 type Authenticate struct {
@@ -80,10 +75,7 @@ func (cmd *Authenticate) Handle(conn *Conn) error {
 		return ErrAuthDisabled
 	}
 
-	mechanisms := map[string]sasl.Server{}
-	for name, newSasl := range conn.Server.auths {
-		mechanisms[name] = newSasl(conn)
-	}
+	mechanisms := conn.saslServers()
 
 	return cmd.Authenticate.Handle(mechanisms, conn.Reader, conn.Writer)
 }
@@ -1,11 +1,132 @@
 package server_test
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"io"
+	"math/big"
+	"net"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/internal"
+	"github.com/emersion/go-imap/scram"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-sasl"
 )
 
+func testServerTLS(t *testing.T) (s *server.Server, addr string) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(memory.New())
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func TestStartTLS(t *testing.T) {
+	s, addr := testServerTLS(t)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "* OK [CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED] IMAP4rev1 Service Ready" {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	// The LOGIN command is sent before the TLS negotiation, it must be ignored
+	io.WriteString(c, "a001 STARTTLS\r\na002 LOGIN username password\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(internal.LocalhostCert)
+
+	tc := tls.Client(c, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal("Cannot negotiate TLS:", err)
+	}
+
+	scanner = bufio.NewScanner(tc)
+
+	io.WriteString(tc, "a003 CAPABILITY\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "* CAPABILITY IMAP4rev1 AUTH=LOGIN AUTH=PLAIN SASL-IR" {
+		t.Fatal("Bad capability:", scanner.Text())
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	io.WriteString(tc, "a004 STARTTLS\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestStartTLS_client(t *testing.T) {
+	s, addr := testServerTLS(t)
+	defer s.Close()
+
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Logout()
+
+	if !c.SupportsStartTLS() {
+		t.Fatal("STARTTLS not supported")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(internal.LocalhostCert)
+
+	if err := c.StartTLS(&tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}); err != nil {
+		t.Fatal("Cannot start TLS:", err)
+	}
+	if !c.IsTLS() {
+		t.Fatal("TLS not enabled")
+	}
+
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal("Cannot login:", err)
+	}
+}
+
 func TestLogin_Ok(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer c.Close()
@@ -32,6 +153,158 @@ func TestLogin_No(t *testing.T) {
 	}
 }
 
+func TestLogin_TooManyFailures(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "a001 LOGIN username wrongpassword\r\n")
+
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "a001 NO [AUTHENTICATIONFAILED] ") {
+			t.Fatal("Bad status response:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "a002 LOGIN username wrongpassword\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "* BYE Too many authentication failures" {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+func TestLogin_Throttled(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	defer s.Close()
+
+	events := make(chan *server.AuthEvent, 2)
+	s.AuthLimiter = &server.FailureLimiter{MaxFailures: 1, Window: time.Minute}
+	s.AuthHook = func(ev *server.AuthEvent) {
+		events <- ev
+	}
+
+	io.WriteString(c, "a001 LOGIN username wrongpassword\r\n")
+
+	// The error returned by the backend isn't sent to the client
+	scanner.Scan()
+	if scanner.Text() != "a001 NO [AUTHENTICATIONFAILED] Invalid credentials" {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// Even with the right password, the attempt is rejected
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 NO [UNAVAILABLE] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	if ev := <-events; ev.Success || ev.Throttled || ev.Username != "username" || ev.Mechanism != "LOGIN" || ev.Err == server.ErrAuthFailed {
+		t.Fatal("Bad first event:", ev)
+	}
+	if ev := <-events; ev.Success || !ev.Throttled {
+		t.Fatal("Bad second event:", ev)
+	}
+}
+
+func TestFailureLimiter_MaxEntries(t *testing.T) {
+	l := &server.FailureLimiter{MaxFailures: 1, Window: time.Minute, MaxEntries: 2}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		l.Failure(ip, "")
+		time.Sleep(time.Millisecond)
+	}
+
+	// The oldest failure has been forgotten
+	if err := l.Allow("192.0.2.1", ""); err != nil {
+		t.Error("Expected the oldest failure to be forgotten, got:", err)
+	}
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		if err := l.Allow(ip, ""); err != server.ErrAuthThrottled {
+			t.Errorf("Expected %v to be throttled, got: %v", ip, err)
+		}
+	}
+}
+
+func TestFailureLimiter_zeroWindow(t *testing.T) {
+	l := &server.FailureLimiter{MaxFailures: 1}
+
+	// Failures are remembered for a default period of time
+	l.Failure("192.0.2.1", "username")
+	if err := l.Allow("192.0.2.1", ""); err != server.ErrAuthThrottled {
+		t.Error("Expected the IP address to be throttled, got:", err)
+	}
+	if err := l.Allow("192.0.2.2", "username"); err != server.ErrAuthThrottled {
+		t.Error("Expected the username to be throttled, got:", err)
+	}
+}
+
+// A backend recording connection information passed to LoginConn.
+type connInfoBackend struct {
+	backend.Backend
+	info *backend.ConnInfo
+}
+
+func (bkd *connInfoBackend) LoginConn(info *backend.ConnInfo, username, password string) (backend.User, error) {
+	bkd.info = info
+	return bkd.Backend.Login(username, password)
+}
+
+func TestLogin_ConnInfo(t *testing.T) {
+	bkd := &connInfoBackend{Backend: memory.New()}
+
+	s, err := server.Listen("127.0.0.1:0", bkd)
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	defer s.Close()
+	s.AllowInsecureAuth = true
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	if bkd.info == nil {
+		t.Fatal("LoginConn not called")
+	}
+	if bkd.info.Mechanism != "LOGIN" {
+		t.Error("Bad mechanism:", bkd.info.Mechanism)
+	}
+	if bkd.info.RemoteAddr.String() != c.LocalAddr().String() {
+		t.Error("Bad remote address:", bkd.info.RemoteAddr)
+	}
+	if bkd.info.LocalAddr.String() != c.RemoteAddr().String() {
+		t.Error("Bad local address:", bkd.info.LocalAddr)
+	}
+	if bkd.info.TLS != nil {
+		t.Error("TLS state set on an unencrypted connection")
+	}
+}
+
 func TestAuthenticate_Plain_Ok(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer c.Close()
@@ -74,6 +347,80 @@ func TestAuthenticate_Plain_No(t *testing.T) {
 	}
 }
 
+func TestAuthenticate_Plain_InitialResponse(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_EmptyInitialResponse(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	defer s.Close()
+
+	// An empty initial response is not the same as no initial response
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN =\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 NO ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_Cancel(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a001 AUTHENTICATE PLAIN\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "+" {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	io.WriteString(c, "*\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 BAD ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestAuthenticate_Login(t *testing.T) {
+	s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a001 AUTHENTICATE LOGIN\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "+ VXNlcm5hbWU6" {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	io.WriteString(c, "dXNlcm5hbWU=\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "+ UGFzc3dvcmQ6" {
+		t.Fatal("Bad continuation request:", scanner.Text())
+	}
+
+	io.WriteString(c, "cGFzc3dvcmQ=\r\n")
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
 func TestAuthenticate_No(t *testing.T) {
 	s, c, scanner := testServerGreeted(t)
 	defer c.Close()
@@ -86,3 +433,269 @@ func TestAuthenticate_No(t *testing.T) {
 		t.Fatal("Bad status response:", scanner.Text())
 	}
 }
+
+// Create a certificate. If parent is nil, the certificate is a self-signed CA.
+func testCert(t *testing.T, parent *tls.Certificate, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	issuer := template
+	var issuerKey interface{} = key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		if issuer, err = x509.ParseCertificate(parent.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+		issuerKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// A backend authenticating users with the common name of their certificate.
+type externalBackend struct {
+	backend.Backend
+}
+
+func (bkd *externalBackend) LoginExternal(info *backend.ConnInfo, identity string) (backend.User, error) {
+	if info.TLS.PeerCertificates[0].Subject.CommonName != "username" {
+		return nil, errors.New("Unknown certificate")
+	}
+	return bkd.Backend.Login("username", "password")
+}
+
+func TestAuthenticate_External(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(internal.LocalhostCert)
+
+	ca := testCert(t, nil, "Test CA")
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	s, err := server.ListenTLS("127.0.0.1:0", &externalBackend{memory.New()}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs: clientCAs,
+	})
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	defer s.Close()
+
+	c, err := client.DialTLS(s.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{testCert(t, &ca, "username")},
+		RootCAs: pool,
+	})
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Logout()
+
+	if ok := c.SupportsAuthentication(sasl.External); !ok {
+		t.Fatal("EXTERNAL not supported")
+	}
+
+	if err := c.Authenticate(sasl.NewExternalClient("")); err != nil {
+		t.Fatal("Cannot authenticate:", err)
+	}
+	if c.State != common.AuthenticatedState {
+		t.Fatal("Client not authenticated")
+	}
+}
+
+type oauthBackend struct {
+	backend.Backend
+}
+
+func (bkd *oauthBackend) LoginOAuth(info *backend.ConnInfo, username, token string) (backend.User, error) {
+	if token != "token" {
+		return nil, &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+	}
+	return bkd.Backend.Login("username", "password")
+}
+
+type tokenSource struct {
+	tokens []string
+}
+
+func (src *tokenSource) Token() (string, error) {
+	token := src.tokens[0]
+	src.tokens = src.tokens[1:]
+	return token, nil
+}
+
+func testOAuthClient(t *testing.T) (*server.Server, *client.Client) {
+	s, err := server.Listen("127.0.0.1:0", &oauthBackend{memory.New()})
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	s.AllowInsecureAuth = true
+
+	c, err := client.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	return s, c
+}
+
+func TestAuthenticate_OAuthBearer(t *testing.T) {
+	src := &tokenSource{[]string{"expired", "token"}}
+
+	s, c := testOAuthClient(t)
+	defer s.Close()
+
+	if !c.SupportsAuthentication(sasl.OAuthBearer) {
+		t.Fatal("OAUTHBEARER not supported")
+	}
+
+	err := c.AuthenticateOAuth("username", src)
+	if oauthErr, ok := err.(*sasl.OAuthBearerError); !ok || oauthErr.Status != "invalid_token" {
+		t.Fatal("Expected an OAuth error, got:", err)
+	}
+
+	// A new token is requested when authenticating again
+	if err := c.AuthenticateOAuth("username", src); err != nil {
+		t.Fatal("Cannot authenticate:", err)
+	}
+	if c.State != common.AuthenticatedState {
+		t.Fatal("Client not authenticated")
+	}
+	c.Logout()
+}
+
+func TestAuthenticate_XOAuth2(t *testing.T) {
+	s, c := testOAuthClient(t)
+	defer s.Close()
+	defer c.Logout()
+
+	if !c.SupportsAuthentication(client.XOAuth2) {
+		t.Fatal("XOAUTH2 not supported")
+	}
+
+	if err := c.Authenticate(client.NewXOAuth2Client("username", "token")); err != nil {
+		t.Fatal("Cannot authenticate:", err)
+	}
+	if c.State != common.AuthenticatedState {
+		t.Fatal("Client not authenticated")
+	}
+}
+
+type challengeBackend struct {
+	backend.Backend
+}
+
+func (bkd *challengeBackend) ScramCredentials(info *backend.ConnInfo, username, mechanism string) (*scram.Credentials, error) {
+	if username != "username" {
+		return nil, errors.New("Bad username or password")
+	}
+	return scram.NewCredentials(mechanism, "password", nil, 0)
+}
+
+func (bkd *challengeBackend) CramMD5Secret(info *backend.ConnInfo, username string) ([]byte, error) {
+	if username != "username" {
+		return nil, errors.New("Bad username or password")
+	}
+	return []byte("password"), nil
+}
+
+func (bkd *challengeBackend) LoginVerified(info *backend.ConnInfo, username string) (backend.User, error) {
+	return bkd.Backend.Login("username", "password")
+}
+
+func TestAuthenticate_Scram(t *testing.T) {
+	cert, err := tls.X509KeyPair(internal.LocalhostCert, internal.LocalhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(internal.LocalhostCert)
+
+	s, err := server.ListenTLS("127.0.0.1:0", &challengeBackend{memory.New()}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	defer s.Close()
+
+	c, err := client.DialTLS(s.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Logout()
+
+	if !c.SupportsAuthentication(scram.SHA256Plus) {
+		t.Fatal("SCRAM-SHA-256-PLUS not supported")
+	}
+
+	cb := scram.TLSChannelBinding(c.TLSState())
+	if err := c.Authenticate(scram.NewClient(scram.SHA256Plus, "username", "wrong", cb)); err == nil {
+		t.Fatal("Authenticated with a wrong password")
+	}
+
+	if err := c.Authenticate(scram.NewClient(scram.SHA256Plus, "username", "password", cb)); err != nil {
+		t.Fatal("Cannot authenticate:", err)
+	}
+	if c.State != common.AuthenticatedState {
+		t.Fatal("Client not authenticated")
+	}
+}
+
+func TestAuthenticate_CramMD5(t *testing.T) {
+	s, err := server.Listen("127.0.0.1:0", &challengeBackend{memory.New()})
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	defer s.Close()
+	s.AllowInsecureAuth = true
+
+	c, err := client.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Logout()
+
+	if !c.SupportsAuthentication(client.CramMD5) {
+		t.Fatal("CRAM-MD5 not supported")
+	}
+	// Channel binding requires TLS
+	if c.SupportsAuthentication(scram.SHA256Plus) {
+		t.Fatal("SCRAM-SHA-256-PLUS supported without TLS")
+	}
+
+	if err := c.Authenticate(client.NewCramMD5Client("username", "password")); err != nil {
+		t.Fatal("Cannot authenticate:", err)
+	}
+	if c.State != common.AuthenticatedState {
+		t.Fatal("Client not authenticated")
+	}
+}
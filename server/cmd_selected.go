@@ -47,10 +47,12 @@ func (cmd *Close) Handle(conn *Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	conn.Mailbox = nil
+	mbox := conn.Mailbox
+	conn.setMailbox(nil)
 	conn.MailboxReadOnly = false
+	conn.seqNums.reset(nil)
 
-	if err := conn.Mailbox.Expunge(); err != nil {
+	if err := mbox.Expunge(); err != nil {
 		return err
 	}
 
@@ -85,28 +87,12 @@ func (cmd *Expunge) Handle(conn *Conn) error {
 		return err
 	}
 
-	// If the backend doesn't support expunge updates, let's do it ourselves
-	if conn.Server.Updates == nil {
-		done := make(chan error)
-		defer close(done)
-
-		ch := make(chan uint32)
-		res := &responses.Expunge{SeqNums: ch}
-
-		go (func () {
-			done <- conn.WriteRes(res)
-		})()
-
-		// Iterate sequence numbers from the last one to the first one, as deleting
-		// messages changes their respective numbers
-		for i := len(seqnums) - 1; i >= 0; i-- {
-			ch <- seqnums[i]
-		}
-		close(ch)
-
-		if err := <-done; err != nil {
-			return err
-		}
+	// If the backend doesn't support expunge updates, let's do it ourselves.
+	// EXPUNGE responses are sent when the command completes.
+	// Iterate sequence numbers from the last one to the first one, as deleting
+	// messages changes their respective numbers
+	for i := len(seqnums) - 1; i >= 0; i-- {
+		conn.seqNums.expunge(seqnums[i])
 	}
 
 	return nil
@@ -121,13 +107,30 @@ func (cmd *Search) handle(uid bool, conn *Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	ids, err := conn.Mailbox.SearchMessages(uid, cmd.Criteria)
+	snap := conn.seqNums.snapshot()
+	criteria := cmd.Criteria
+	if criteria != nil && criteria.SeqSet != nil {
+		copied := *criteria
+		copied.SeqSet = snap.toBackend(criteria.SeqSet)
+		criteria = &copied
+	}
+
+	ids, err := conn.Mailbox.SearchMessages(uid, criteria)
 	if err != nil {
 		return err
 	}
+	if !uid {
+		kept := ids[:0]
+		for _, id := range ids {
+			if id = snap.toClient(id); id != 0 {
+				kept = append(kept, id)
+			}
+		}
+		ids = kept
+	}
 
 	res := &responses.Search{Ids: ids}
-	return conn.WriteRes(res)
+	return conn.writeCmdRes(res)
 }
 
 func (cmd *Search) Handle(conn *Conn) error {
@@ -138,31 +141,64 @@ func (cmd *Search) UidHandle(conn *Conn) error {
 	return cmd.handle(true, conn)
 }
 
+func (cmd *Search) Concurrent(conn *Conn) bool {
+	return true
+}
+
 type Fetch struct {
 	commands.Fetch
 }
 
 func (cmd *Fetch) handle(uid bool, conn *Conn) error {
+	return cmd.fetch(uid, conn, conn.seqNums.snapshot())
+}
+
+// Fetch messages, translating sequence numbers with snap.
+func (cmd *Fetch) fetch(uid bool, conn *Conn, snap *seqSnapshot) error {
 	if conn.Mailbox == nil {
 		return ErrNoMailboxSelected
 	}
 
+	seqSet := cmd.SeqSet
+	if !uid {
+		seqSet = snap.toBackend(seqSet)
+	}
+
 	ch := make(chan *common.Message)
-	res := &responses.Fetch{Messages: ch}
 
-	// TODO: if ListMessages() fails, make sure the goroutine is stopped
-	done := make(chan error)
+	// Write each message in its own response, so that messages aren't all kept
+	// in memory. Responses of other commands executed concurrently are written
+	// before the first message or after the last one.
+	done := make(chan error, 1)
 	go (func () {
-		done <- conn.WriteRes(res)
-		close(done)
+		var err error
+		locked := false
+		for msg := range ch {
+			if msg.SeqNum = snap.toClient(msg.SeqNum); err != nil || msg.SeqNum == 0 {
+				continue
+			}
+
+			if !locked {
+				conn.responses.Lock()
+				locked = true
+			}
+
+			res := common.NewUntaggedResp([]interface{}{msg.SeqNum, common.Fetch, msg.Format()})
+			err = conn.WriteRes(res)
+		}
+		if locked {
+			conn.responses.Unlock()
+		}
+
+		done <- err
 	})()
 
-	err := conn.Mailbox.ListMessages(uid, cmd.SeqSet, cmd.Items, ch)
-	if err != nil {
-		return err
+	// ch is closed when ListMessages returns, even if it fails
+	err := conn.Mailbox.ListMessages(uid, seqSet, cmd.Items, ch)
+	if writeErr := <-done; err == nil {
+		err = writeErr
 	}
-
-	return <-done
+	return err
 }
 
 func (cmd *Fetch) Handle(conn *Conn) error {
@@ -185,6 +221,25 @@ func (cmd *Fetch) UidHandle(conn *Conn) error {
 	return cmd.handle(true, conn)
 }
 
+func (cmd *Fetch) Concurrent(conn *Conn) bool {
+	if conn.MailboxReadOnly {
+		return true
+	}
+
+	// Fetching a body section without PEEK sets the \Seen flag
+	for _, item := range cmd.Items {
+		if strings.EqualFold(item, "RFC822") || strings.EqualFold(item, "RFC822.TEXT") {
+			return false
+		}
+
+		section, err := common.NewBodySectionName(item)
+		if err == nil && !section.Peek {
+			return false
+		}
+	}
+	return true
+}
+
 type Store struct {
 	commands.Store
 }
@@ -219,13 +274,28 @@ func (cmd *Store) handle(uid bool, conn *Conn) error {
 
 	// If the backend supports message updates, this will prevent this connection
 	// from receiving them
-	conn.silent = silent
-	err = conn.Mailbox.UpdateMessagesFlags(uid, cmd.SeqSet, item, flags)
-	conn.silent = false
+	snap := conn.seqNums.snapshot()
+	seqSet := cmd.SeqSet
+	if !uid {
+		seqSet = snap.toBackend(seqSet)
+	}
+
+	conn.setSilent(silent)
+	err = conn.Mailbox.UpdateMessagesFlags(uid, seqSet, item, flags)
+	// Updates sent by the backend must be processed before leaving silent mode
+	conn.Server.syncUpdates()
+	conn.setSilent(false)
 	if err != nil {
 		return err
 	}
 
+	// Not silent: FETCH responses are sent before the tagged response
+	if conn.Server.Updates != nil && !silent {
+		if err := conn.flushUpdates(); err != nil {
+			return err
+		}
+	}
+
 	// Not silent: send FETCH updates if the backend doesn't support message
 	// updates
 	if conn.Server.Updates == nil && !silent {
@@ -236,7 +306,7 @@ func (cmd *Store) handle(uid bool, conn *Conn) error {
 			inner.Items = append(inner.Items, "UID")
 		}
 
-		if err := inner.handle(uid, conn); err != nil {
+		if err := inner.fetch(uid, conn, snap); err != nil {
 			return err
 		}
 	}
@@ -261,7 +331,12 @@ func (cmd *Copy) handle(uid bool, conn *Conn) error {
 		return ErrNoMailboxSelected
 	}
 
-	return conn.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	seqSet := cmd.SeqSet
+	if !uid {
+		seqSet = conn.seqNums.snapshot().toBackend(seqSet)
+	}
+
+	return conn.Mailbox.CopyMessages(uid, seqSet, cmd.Mailbox)
 }
 
 func (cmd *Copy) Handle(conn *Conn) error {
@@ -274,10 +349,29 @@ func (cmd *Copy) UidHandle(conn *Conn) error {
 
 type Uid struct {
 	commands.Uid
+
+	// The handler of the command executed with UIDs, once parsed.
+	inner Handler
 }
 
-func (cmd *Uid) Handle(conn *Conn) error {
+// Get the handler of the command executed with UIDs, e.g. a *Fetch for UID
+// FETCH. Its arguments are parsed.
+func (cmd *Uid) Inner(conn *Conn) (Handler, error) {
+	if cmd.inner != nil {
+		return cmd.inner, nil
+	}
+
 	hdlr, err := conn.Server.getCommandHandler(cmd.Cmd.Command())
+	if err != nil {
+		return nil, err
+	}
+
+	cmd.inner = hdlr
+	return hdlr, nil
+}
+
+func (cmd *Uid) Handle(conn *Conn) error {
+	hdlr, err := cmd.Inner(conn)
 	if err != nil {
 		return err
 	}
@@ -289,3 +383,13 @@ func (cmd *Uid) Handle(conn *Conn) error {
 
 	return uidHdlr.UidHandle(conn)
 }
+
+func (cmd *Uid) Concurrent(conn *Conn) bool {
+	hdlr, err := cmd.Inner(conn)
+	if err != nil {
+		return false
+	}
+
+	concurrent, ok := hdlr.(ConcurrentHandler)
+	return ok && concurrent.Concurrent(conn)
+}
@@ -0,0 +1,619 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/server"
+)
+
+// Read responses until the status response of tag, and check them.
+func expectResponses(t *testing.T, scanner *bufio.Scanner, tag string, expected ...string) {
+	var got []string
+	for scanner.Scan() {
+		res := scanner.Text()
+		if strings.HasPrefix(res, tag + " ") {
+			if !strings.HasPrefix(res, tag + " OK ") {
+				t.Fatal("Bad status response:", res)
+			}
+			break
+		}
+		got = append(got, res)
+	}
+
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Bad responses for %v: expected %q, got %q", tag, expected, got)
+	}
+}
+
+func TestExpunge(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a001 APPEND INBOX {1}\r\n")
+	scanner.Scan() // Continuation request
+	io.WriteString(c, "a\r\n")
+	expectResponses(t, scanner, "a001")
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	scanner.Scan()
+	for !strings.HasPrefix(scanner.Text(), "a002 ") && scanner.Scan() {}
+
+	io.WriteString(c, "a003 STORE 1 +FLAGS.SILENT (\\Deleted)\r\n")
+	expectResponses(t, scanner, "a003")
+
+	io.WriteString(c, "a004 EXPUNGE\r\n")
+	expectResponses(t, scanner, "a004", "* 1 EXPUNGE")
+
+	io.WriteString(c, "a005 FETCH 1:* (UID)\r\n")
+	expectResponses(t, scanner, "a005", "* 1 FETCH (UID 7)")
+}
+
+// A backend whose updates are sent by tests.
+type updatesBackend struct {
+	*memory.Backend
+	updates *backend.Updates
+}
+
+func (bkd *updatesBackend) Updates() *backend.Updates {
+	return bkd.updates
+}
+
+// Send an update, and wait for it to be processed by the server.
+func (bkd *updatesBackend) send(update interface{}) {
+	switch update := update.(type) {
+	case *backend.MailboxUpdate:
+		bkd.updates.Mailboxes <- update
+	case *backend.MessageUpdate:
+		bkd.updates.Messages <- update
+	case *backend.ExpungeUpdate:
+		bkd.updates.Expunges <- update
+	case *backend.FlagsUpdate:
+		bkd.updates.Flags <- update
+	case *backend.AddedUpdate:
+		bkd.updates.Added <- update
+	case *backend.UidExpungeUpdate:
+		bkd.updates.UidExpunges <- update
+	case *backend.DeleteUpdate:
+		bkd.updates.Deletes <- update
+	}
+
+	// Updates are processed in order, send a dummy one which isn't sent to
+	// anyone
+	bkd.updates.Statuses <- &backend.StatusUpdate{
+		Update: backend.Update{Username: "nobody"},
+	}
+}
+
+func newUpdatesBackend() *updatesBackend {
+	return &updatesBackend{
+		Backend: memory.New(),
+		updates: &backend.Updates{
+			Statuses: make(chan *backend.StatusUpdate),
+			Mailboxes: make(chan *backend.MailboxUpdate),
+			Messages: make(chan *backend.MessageUpdate),
+			Expunges: make(chan *backend.ExpungeUpdate),
+			Flags: make(chan *backend.FlagsUpdate),
+			Added: make(chan *backend.AddedUpdate),
+			UidExpunges: make(chan *backend.UidExpungeUpdate),
+			Deletes: make(chan *backend.DeleteUpdate),
+		},
+	}
+}
+
+func testServerUpdates(t *testing.T) (bkd *updatesBackend, s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	bkd = newUpdatesBackend()
+
+	s, err := server.Listen("127.0.0.1:0", bkd)
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	s.AllowInsecureAuth = true
+
+	c, err = net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a001")
+	return
+}
+
+// A backend adding a message and sending its update right after the UIDs of
+// a mailbox have been listed by SELECT.
+type selectRaceBackend struct {
+	*updatesBackend
+}
+
+func (bkd *selectRaceBackend) Login(username, password string) (backend.User, error) {
+	u, err := bkd.updatesBackend.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &selectRaceUser{u, bkd.updatesBackend}, nil
+}
+
+type selectRaceUser struct {
+	backend.User
+	bkd *updatesBackend
+}
+
+func (u *selectRaceUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &selectRaceMailbox{mbox, u.bkd}, nil
+}
+
+type selectRaceMailbox struct {
+	backend.Mailbox
+	bkd *updatesBackend
+}
+
+func (mbox *selectRaceMailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	if err := mbox.Mailbox.ListMessages(uid, seqset, items, ch); err != nil {
+		return err
+	}
+
+	status, err := mbox.Status([]string{common.MailboxUidNext})
+	if err != nil {
+		return err
+	}
+	if err := mbox.CreateMessage(nil, nil, []byte("hello")); err != nil {
+		return err
+	}
+
+	mbox.bkd.send(&backend.AddedUpdate{
+		Update: backend.Update{Username: "username", Mailbox: mbox.Name()},
+		Uids: []uint32{status.UidNext},
+	})
+	return nil
+}
+
+func TestSelect_updateWhileListing(t *testing.T) {
+	bkd := &selectRaceBackend{newUpdatesBackend()}
+
+	s := server.New(bkd)
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a001")
+
+	// The message added while selecting is included in the SELECT response
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	var exists, uidNext string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasSuffix(line, " EXISTS") {
+			exists = line
+		}
+		if strings.HasPrefix(line, "* OK [UIDNEXT ") {
+			uidNext = line
+		}
+		if strings.HasPrefix(line, "a002 ") {
+			break
+		}
+	}
+	if exists != "* 2 EXISTS" {
+		t.Errorf("Expected two messages, got %q", exists)
+	}
+	if !strings.HasPrefix(uidNext, "* OK [UIDNEXT 8]") {
+		t.Errorf("Invalid UIDNEXT: %q", uidNext)
+	}
+
+	// It isn't reported again
+	io.WriteString(c, "a003 NOOP\r\n")
+	expectResponses(t, scanner, "a003")
+}
+
+// A backend sending a FLAGS update when flags are updated, without waiting
+// for it to be processed.
+type flagsUpdateBackend struct {
+	*updatesBackend
+}
+
+func (bkd *flagsUpdateBackend) Login(username, password string) (backend.User, error) {
+	u, err := bkd.updatesBackend.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &flagsUpdateUser{u, bkd.updatesBackend}, nil
+}
+
+type flagsUpdateUser struct {
+	backend.User
+	bkd *updatesBackend
+}
+
+func (u *flagsUpdateUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &flagsUpdateMailbox{mbox, u.bkd}, nil
+}
+
+type flagsUpdateMailbox struct {
+	backend.Mailbox
+	bkd *updatesBackend
+}
+
+func (mbox *flagsUpdateMailbox) UpdateMessagesFlags(uid bool, seqset *common.SeqSet, op common.FlagsOp, flags []string) error {
+	if err := mbox.Mailbox.UpdateMessagesFlags(uid, seqset, op, flags); err != nil {
+		return err
+	}
+
+	mbox.bkd.updates.Flags <- &backend.FlagsUpdate{
+		Update: backend.Update{Username: "username", Mailbox: mbox.Name()},
+		Uid: 6,
+		Flags: flags,
+	}
+	return nil
+}
+
+func TestStore_updates(t *testing.T) {
+	bkd := &flagsUpdateBackend{newUpdatesBackend()}
+
+	s := server.New(bkd)
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a001")
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a002 ") {}
+
+	for i := 0; i < 20; i++ {
+		// The FETCH response is sent before the tagged response
+		io.WriteString(c, "a003 STORE 1 FLAGS (\\Flagged)\r\n")
+		expectResponses(t, scanner, "a003", "* 1 FETCH (FLAGS (\\Flagged) UID 6)")
+
+		// Silent updates aren't reported at all
+		io.WriteString(c, "a004 STORE 1 FLAGS.SILENT (\\Seen)\r\n")
+		expectResponses(t, scanner, "a004")
+		io.WriteString(c, "a005 NOOP\r\n")
+		expectResponses(t, scanner, "a005")
+	}
+}
+
+func TestFetch_Concurrent(t *testing.T) {
+	conn := &server.Conn{}
+
+	items := map[string]bool{
+		"FLAGS": true,
+		"RFC822.SIZE": true,
+		"RFC822.HEADER": true,
+		"BODY.PEEK[]": true,
+		"BODY[]": false,
+		"RFC822": false,
+		"RFC822.TEXT": false,
+	}
+	for item, concurrent := range items {
+		cmd := &server.Fetch{}
+		cmd.Items = []string{"UID", item}
+		if cmd.Concurrent(conn) != concurrent {
+			t.Errorf("Expected FETCH %v to be executed concurrently: %v", item, concurrent)
+		}
+	}
+}
+
+func TestExpunge_deferred(t *testing.T) {
+	bkd, s, c, scanner := testServerUpdates(t)
+	defer c.Close()
+	defer s.Close()
+
+	// Add two messages, and delete the first one from another session
+	user, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := mbox.CreateMessage(nil, &now, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	scanner.Scan()
+	for !strings.HasPrefix(scanner.Text(), "a002 ") && scanner.Scan() {}
+
+	seqSet, _ := common.NewSeqSet("1")
+	if err := mbox.UpdateMessagesFlags(false, seqSet, common.AddFlags, []string{"\\Deleted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	bkd.send(&backend.ExpungeUpdate{
+		Update: backend.Update{Username: "username", Mailbox: "INBOX"},
+		SeqNum: 1,
+	})
+
+	// Sequence numbers don't change until the client is told about the expunge
+	io.WriteString(c, "a003 FETCH 2:* (UID)\r\n")
+	expectResponses(t, scanner, "a003", "* 2 FETCH (UID 7)", "* 3 FETCH (UID 8)")
+
+	io.WriteString(c, "a004 SEARCH ALL\r\n")
+	expectResponses(t, scanner, "a004", "* SEARCH 2 3")
+
+	bkd.send(&backend.MessageUpdate{
+		Update: backend.Update{Username: "username", Mailbox: "INBOX"},
+		Message: &common.Message{SeqNum: 2, Items: []string{"FLAGS"}, Flags: []string{"\\Seen"}},
+	})
+	scanner.Scan()
+	if scanner.Text() != "* 3 FETCH (FLAGS (\\Seen))" {
+		t.Fatal("Bad message update:", scanner.Text())
+	}
+
+	if err := mbox.CreateMessage(nil, &now, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	bkd.send(&backend.MailboxUpdate{
+		Update: backend.Update{Username: "username", Mailbox: "INBOX"},
+		MailboxStatus: &common.MailboxStatus{
+			Name: "INBOX",
+			Items: []string{common.MailboxMessages},
+			Messages: 3,
+		},
+	})
+	scanner.Scan()
+	if scanner.Text() != "* 4 EXISTS" {
+		t.Fatal("Bad mailbox update:", scanner.Text())
+	}
+
+	io.WriteString(c, "a005 NOOP\r\n")
+	expectResponses(t, scanner, "a005", "* 1 EXPUNGE")
+
+	io.WriteString(c, "a006 FETCH 1:* (UID)\r\n")
+	expectResponses(t, scanner, "a006", "* 1 FETCH (UID 7)", "* 2 FETCH (UID 8)", "* 3 FETCH (UID 9)")
+}
+
+func TestUpdates_uid(t *testing.T) {
+	bkd, s, c, scanner := testServerUpdates(t)
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	scanner.Scan()
+	for !strings.HasPrefix(scanner.Text(), "a002 ") && scanner.Scan() {}
+
+	user, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := backend.Update{Username: "username", Mailbox: "INBOX"}
+
+	now := time.Now()
+	if err := mbox.CreateMessage(nil, &now, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	bkd.send(&backend.AddedUpdate{Update: update, Uids: []uint32{7}})
+	scanner.Scan()
+	if scanner.Text() != "* 2 EXISTS" {
+		t.Fatal("Bad added update:", scanner.Text())
+	}
+
+	bkd.send(&backend.FlagsUpdate{Update: update, Uid: 6, Flags: []string{"\\Deleted"}})
+	scanner.Scan()
+	if scanner.Text() != "* 1 FETCH (FLAGS (\\Deleted) UID 6)" {
+		t.Fatal("Bad flags update:", scanner.Text())
+	}
+
+	seqSet, _ := common.NewSeqSet("1")
+	if err := mbox.UpdateMessagesFlags(false, seqSet, common.AddFlags, []string{"\\Deleted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	bkd.send(&backend.UidExpungeUpdate{Update: update, Uids: []uint32{6}})
+
+	io.WriteString(c, "a003 FETCH 2 (UID)\r\n")
+	expectResponses(t, scanner, "a003", "* 2 FETCH (UID 7)")
+
+	io.WriteString(c, "a004 NOOP\r\n")
+	expectResponses(t, scanner, "a004", "* 1 EXPUNGE")
+
+	bkd.send(&backend.DeleteUpdate{Update: update})
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* BYE ") {
+		t.Fatal("Bad delete update:", scanner.Text())
+	}
+}
+
+func TestUpdates_stuckClient(t *testing.T) {
+	bkd, s, stuck, _ := testServerUpdates(t)
+	defer stuck.Close()
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a001")
+
+	// Send enough updates to fill the stuck client's socket buffers and queue,
+	// the other client must receive all of them
+	const n = 20000
+	const batch = 100
+	info := strings.Repeat("a", 1024)
+
+	received := make(chan struct{})
+	go (func() {
+		for i := 0; i < n && scanner.Scan(); i++ {
+			received <- struct{}{}
+		}
+		close(received)
+	})()
+
+	for i := 0; i < n; i += batch {
+		for j := 0; j < batch; j++ {
+			bkd.updates.Statuses <- &backend.StatusUpdate{
+				Update: backend.Update{Username: "username"},
+				StatusResp: &common.StatusResp{Tag: "*", Type: common.OK, Info: info},
+			}
+		}
+
+		for j := 0; j < batch; j++ {
+			select {
+			case _, ok := <-received:
+				if !ok {
+					t.Fatal("Connection closed after", i + j, "updates:", scanner.Err())
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Updates blocked by a stuck client")
+			}
+		}
+	}
+
+	// The stuck client has been disconnected
+	stuck.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.Copy(io.Discard, stuck); err != nil {
+		t.Fatal("Stuck client not disconnected:", err)
+	}
+}
+
+func TestUpdates_bye(t *testing.T) {
+	bkd, s, c, scanner := testServerUpdates(t)
+	defer c.Close()
+	defer s.Close()
+
+	bkd.updates.Statuses <- &backend.StatusUpdate{
+		Update: backend.Update{Username: "username"},
+		StatusResp: &common.StatusResp{Tag: "*", Type: common.BYE, Info: "Bye"},
+	}
+
+	// The connection is closed after the BYE response
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal("Connection not closed:", err)
+	}
+	if len(lines) != 1 || lines[0] != "* BYE Bye" {
+		t.Error("Expected a BYE response, got", lines)
+	}
+}
+
+func TestUpdates_overflowDuringLiteral(t *testing.T) {
+	bkd := newUpdatesBackend()
+
+	s := server.New(bkd)
+	s.AllowInsecureAuth = true
+	s.MaxQueuedUpdates = 10
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a001")
+
+	// Start sending a literal, and stop reading responses while the server
+	// waits for it
+	io.WriteString(c, "a002 APPEND INBOX {10}\r\n")
+	scanner.Scan()
+	if scanner.Text() != "+ send literal" {
+		t.Fatal("Invalid continuation request:", scanner.Text())
+	}
+
+	info := strings.Repeat("a", 16 * 1024)
+	for i := 0; i < 2000; i++ {
+		bkd.updates.Statuses <- &backend.StatusUpdate{
+			Update: backend.Update{Username: "username"},
+			StatusResp: &common.StatusResp{Tag: "*", Type: common.OK, Info: info},
+		}
+	}
+
+	// The server closes the connection instead of waiting for the literal
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Fatal("Client not disconnected:", err)
+	}
+
+	user, err := bkd.Login("username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]string{common.MailboxMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Error("Expected the message not to be appended, got", status.Messages, "messages")
+	}
+}
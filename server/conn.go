@@ -3,19 +3,42 @@ package server
 import (
 	"crypto/tls"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap/common"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-sasl"
 )
 
 type Conn struct {
 	*common.Conn
 
-	isTLS bool
 	continues chan bool
-	silent bool
 	locker sync.Locker
+	// Information sent by a proxy, nil if the client isn't connected through a
+	// proxy.
+	proxy *ProxyInfo
+	// The number of commands being executed, protected by the server's locker.
+	busy int
+	// The number of failed authentication attempts.
+	authFailures int
+	// The message sequence numbers of the selected mailbox.
+	seqNums seqNums
+	// Unilateral updates waiting to be sent.
+	updates *updateQueue
+	// Held by commands while they write their untagged responses, so that
+	// responses of commands executed concurrently aren't interleaved.
+	responses sync.Mutex
+	// Closed when the connection is closed.
+	closed chan struct{}
+	closeOnce sync.Once
+	closeErr error
+	// Non-zero if another goroutine asked for the connection to be closed.
+	closeRequested int32
 
 	// This connection's server.
 	Server *Server
@@ -34,6 +57,8 @@ func (c *Conn) WriteRes(res common.WriterTo) error {
 	c.locker.Lock()
 	defer c.locker.Unlock()
 
+	c.setWriteDeadline()
+
 	if err := res.WriteTo(c.Writer); err != nil {
 		return err
 	}
@@ -41,18 +66,216 @@ func (c *Conn) WriteRes(res common.WriterTo) error {
 	return c.Writer.Flush()
 }
 
-// Close this connection.
+// Write the untagged response of a command which can be executed
+// concurrently.
+func (c *Conn) writeCmdRes(res common.WriterTo) error {
+	c.responses.Lock()
+	defer c.responses.Unlock()
+
+	return c.WriteRes(res)
+}
+
+// Must be called with locker held.
+func (c *Conn) setWriteDeadline() {
+	var deadline time.Time
+	if c.Server.WriteTimeout > 0 {
+		deadline = time.Now().Add(c.Server.WriteTimeout)
+	}
+	c.SetWriteDeadline(deadline)
+
+	// Don't postpone a deadline expired by requestClose
+	if c.isCloseRequested() {
+		c.SetWriteDeadline(time.Now())
+	}
+}
+
+// Set the deadline for the next client input, depending on whether the client
+// is logged in.
+func (c *Conn) setReadDeadline() {
+	timeout := c.Server.AutoLogout
+	if c.State == common.NotAuthenticatedState {
+		timeout = c.Server.PreAuthTimeout
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	c.SetReadDeadline(deadline)
+
+	if c.isCloseRequested() {
+		c.SetReadDeadline(time.Now())
+	}
+}
+
+// Log an event about this connection.
+func (c *Conn) log(level common.LogLevel, msg string, err error) {
+	common.LogWith(c.Server.Logger, &common.LogEvent{
+		Level: level,
+		ConnID: c.ID(),
+		Message: msg,
+		Err: err,
+	})
+}
+
+// Close this connection. It can be called from any goroutine, more than once.
+// The connection's state is left unchanged, the goroutine handling the
+// connection notices that it has been closed and logs the user out.
 func (c *Conn) Close() error {
-	if err := c.Conn.Close(); err != nil {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+
+		close(c.closed)
+	})
+	return c.closeErr
+}
+
+// Log out the user, if any. Must be called from the goroutine handling the
+// connection, once it's closed.
+func (c *Conn) logout() {
+	u, ok := c.User.(backend.LogoutUser)
+	if !ok {
+		return
+	}
+
+	if err := u.Logout(); err != nil {
+		c.log(common.LogWarn, "cannot log out user", err)
+	}
+}
+
+// Ask the goroutine handling the connection to close it. Pending reads and
+// writes fail as if they had timed out. It can be called from any goroutine.
+func (c *Conn) requestClose() {
+	atomic.StoreInt32(&c.closeRequested, 1)
+	c.SetDeadline(time.Now())
+}
+
+func (c *Conn) isCloseRequested() bool {
+	return atomic.LoadInt32(&c.closeRequested) != 0
+}
+
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Change the state of this connection. Must be called from the goroutine
+// handling the connection.
+func (c *Conn) setState(state common.ConnState) {
+	if c.State != state {
+		c.Metrics().StateChanged(c.State, state)
+	}
+	c.State = state
+}
+
+// Set the logged in user. If the server's per-user connection limit is
+// reached, the user is logged out and an error is returned.
+func (c *Conn) setUser(user backend.User) error {
+	if err := c.Server.conns.setUser(c, user, c.Server.MaxConnsPerUser); err != nil {
+		if u, ok := user.(backend.LogoutUser); ok {
+			u.Logout()
+		}
+		return err
+	}
+
+	c.User = user
+	return nil
+}
+
+func (c *Conn) setMailbox(mbox backend.Mailbox) {
+	c.Mailbox = mbox
+
+	name := ""
+	if mbox != nil {
+		name = mbox.Name()
+	}
+	c.Server.conns.setMailbox(c, name)
+}
+
+// Send the updates received so far, e.g. FETCH responses caused by a command
+// before its tagged response.
+func (c *Conn) flushUpdates() error {
+	c.Server.syncUpdates()
+
+	c.updates.writing.Lock()
+	defer c.updates.writing.Unlock()
+
+	return c.updates.write()
+}
+
+// Send EXPUNGE responses for messages expunged since the last call. It must
+// only be called when EXPUNGE responses are allowed.
+func (c *Conn) flushExpunges() error {
+	c.Server.syncUpdates()
+
+	// Updates queued before must be sent first, their sequence numbers don't
+	// take into account the expunged messages
+	c.updates.writing.Lock()
+	defer c.updates.writing.Unlock()
+
+	if err := c.updates.write(); err != nil {
 		return err
 	}
 
-	close(c.continues)
+	seqNums := c.seqNums.flush()
+	if len(seqNums) == 0 {
+		return nil
+	}
 
-	c.State = common.LogoutState
+	ch := make(chan uint32, len(seqNums))
+	for _, seqNum := range seqNums {
+		ch <- seqNum
+	}
+	close(ch)
+
+	if err := c.WriteRes(&responses.Expunge{SeqNums: ch}); err != nil {
+		return err
+	}
+
+	metrics := c.Metrics()
+	for range seqNums {
+		metrics.UnilateralUpdate("expunge")
+	}
 	return nil
 }
 
+// If silent is set, message updates are not sent to this connection.
+func (c *Conn) setSilent(silent bool) {
+	c.Server.conns.setSilent(c, silent)
+}
+
+// Get the username of the logged in user, or an empty string if the client
+// isn't logged in. Contrary to the User field, it's safe to call this function
+// from any goroutine.
+func (c *Conn) Username() string {
+	state, _ := c.Server.conns.state(c)
+	return state.username
+}
+
+// Get the name of the selected mailbox, or an empty string if no mailbox is
+// selected. Contrary to the Mailbox field, it's safe to call this function
+// from any goroutine.
+func (c *Conn) SelectedMailbox() string {
+	state, _ := c.Server.conns.state(c)
+	return state.mailbox
+}
+
+// Send a BYE response and close this connection.
+func (c *Conn) bye(info string) error {
+	res := &common.StatusResp{
+		Tag: "*",
+		Type: common.BYE,
+		Info: info,
+	}
+
+	c.WriteRes(res)
+	return c.Close()
+}
+
 func (c *Conn) getCaps() (caps []string) {
 	caps = []string{"IMAP4rev1"}
 
@@ -64,7 +287,16 @@ func (c *Conn) getCaps() (caps []string) {
 		if !c.CanAuth() {
 			caps = append(caps, "LOGINDISABLED")
 		} else {
-			caps = append(caps, "AUTH=PLAIN")
+			var names []string
+			for name := range c.saslServers() {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				caps = append(caps, "AUTH=" + name)
+			}
+			caps = append(caps, "SASL-IR")
 		}
 	}
 
@@ -72,14 +304,43 @@ func (c *Conn) getCaps() (caps []string) {
 	return
 }
 
+// Get SASL servers for authentication mechanisms available on this
+// connection.
+func (c *Conn) saslServers() map[string]sasl.Server {
+	mechanisms := map[string]sasl.Server{}
+	for name, newSasl := range c.Server.auths {
+		if server := newSasl(c); server != nil {
+			mechanisms[name] = server
+		}
+	}
+	return mechanisms
+}
+
 func (c *Conn) sendContinuationReqs() {
-	for range c.continues {
+	for {
+		select {
+		case <-c.continues:
+		case <-c.closed:
+			return
+		}
+
 		cont := &common.ContinuationResp{Info: "send literal"}
-		cont.WriteTo(c.Writer)
+		if err := c.WriteRes(cont); err != nil {
+			c.log(common.LogWarn, "cannot send continuation request", err)
+		}
 	}
 }
 
 func (c *Conn) greet() error {
+	// Complete the TLS handshake first, capabilities depend on the client
+	// certificate
+	if tlsConn, ok := c.Conn.Conn.(*tls.Conn); ok {
+		c.setReadDeadline()
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+	}
+
 	caps := c.getCaps()
 	args := make([]interface{}, len(caps))
 	for i, cap := range caps {
@@ -97,9 +358,66 @@ func (c *Conn) greet() error {
 	return c.WriteRes(greeting)
 }
 
-// Check if this connection is encrypted.
+// Check if this connection is encrypted. Connections from a proxy are
+// encrypted if the client is connected to the proxy with TLS.
 func (c *Conn) IsTLS() bool {
-	return c.isTLS
+	if c.proxy != nil && c.proxy.TLS != nil {
+		return true
+	}
+	_, ok := c.Conn.Conn.(*tls.Conn)
+	return ok
+}
+
+// Get the client's address. If the client is connected through a proxy, it's
+// the address sent by the proxy.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.proxy != nil && c.proxy.SourceAddr != nil {
+		return c.proxy.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Get the address the client is connected to. If the client is connected
+// through a proxy, it's the address sent by the proxy.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.proxy != nil && c.proxy.DestAddr != nil {
+		return c.proxy.DestAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Get the information sent by the proxy the client is connected through, or
+// nil if there is none.
+func (c *Conn) Proxy() *ProxyInfo {
+	return c.proxy
+}
+
+// Get the TLS connection state, or nil if the connection isn't encrypted.
+func (c *Conn) TLSState() *tls.ConnectionState {
+	if tlsConn, ok := c.Conn.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// Get information about this connection. mechanism is the authentication
+// mechanism used by the client.
+func (c *Conn) Info(mechanism string) *backend.ConnInfo {
+	return &backend.ConnInfo{
+		RemoteAddr: c.RemoteAddr(),
+		LocalAddr: c.LocalAddr(),
+		TLS: c.TLSState(),
+		Mechanism: mechanism,
+	}
+}
+
+// Check the credentials of a user with the backend, using mechanism.
+func (c *Conn) login(mechanism, username, password string) (backend.User, error) {
+	if bkd, ok := c.Server.Backend.(backend.ConnLoginBackend); ok {
+		return bkd.LoginConn(c.Info(mechanism), username, password)
+	}
+	return c.Server.Backend.Login(username, password)
 }
 
 // Check if the client can use plain text authentication.
@@ -110,22 +428,28 @@ func (c *Conn) CanAuth() bool {
 func newConn(s *Server, c net.Conn) *Conn {
 	continues := make(chan bool)
 	r := common.NewServerReader(nil, continues)
+	r.MaxLiteralSize = s.MaxLiteralSize
+	r.MaxLineLength = s.MaxLineLength
+	r.MaxDepth = s.MaxDepth
 	w := common.NewWriter(nil)
 
-	_, isTLS := c.(*tls.Conn)
+	closed := make(chan struct{})
+	r.Done = closed
 
 	conn := &Conn{
 		Conn: common.NewConn(c, r, w),
 
-		isTLS: isTLS,
 		continues: continues,
 		locker: &sync.Mutex{},
+		updates: newUpdateQueue(s.MaxQueuedUpdates),
+		closed: closed,
 
 		Server: s,
 		State: common.NotAuthenticatedState,
 	}
 
 	go conn.sendContinuationReqs()
+	go conn.sendUpdates()
 
 	return conn
 }
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+)
+
+// ErrTooManyConns is returned when a connection limit is reached.
+var ErrTooManyConns = errors.New("Too many connections")
+
+// The state of a connection as seen by other goroutines.
+type connState struct {
+	ip string
+	user backend.User
+	username string
+	mailbox string
+	silent bool
+}
+
+// A mailbox of a user.
+type mailboxKey struct {
+	username, mailbox string
+}
+
+// A registry of active connections. It keeps track of each connection's user
+// and selected mailbox, so that other goroutines never need to read
+// connection fields.
+type connRegistry struct {
+	locker sync.RWMutex
+	conns map[*Conn]*connState
+	byUser map[string]map[*Conn]struct{}
+	// Connections which have selected a mailbox, used to find the recipients
+	// of updates.
+	byMailbox map[mailboxKey]map[*Conn]struct{}
+	byIP map[string]int
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: map[*Conn]*connState{},
+		byUser: map[string]map[*Conn]struct{}{},
+		byMailbox: map[mailboxKey]map[*Conn]struct{}{},
+		byIP: map[string]int{},
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Add a connection. If the total number of connections would exceed maxConns
+// or the number of connections from the same IP address would exceed
+// maxPerIP, ErrTooManyConns is returned. Zero means no limit.
+func (r *connRegistry) add(conn *Conn, maxConns, maxPerIP int) error {
+	ip := remoteIP(conn)
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if maxConns > 0 && len(r.conns) >= maxConns {
+		return ErrTooManyConns
+	}
+	if maxPerIP > 0 && r.byIP[ip] >= maxPerIP {
+		return ErrTooManyConns
+	}
+
+	r.conns[conn] = &connState{ip: ip}
+	r.byIP[ip]++
+	return nil
+}
+
+func (r *connRegistry) remove(conn *Conn) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if state, ok := r.conns[conn]; ok {
+		r.removeMailbox(conn, state)
+		r.removeUser(conn, state.username)
+		delete(r.conns, conn)
+
+		if r.byIP[state.ip]--; r.byIP[state.ip] <= 0 {
+			delete(r.byIP, state.ip)
+		}
+	}
+}
+
+func (r *connRegistry) removeUser(conn *Conn, username string) {
+	if username == "" {
+		return
+	}
+
+	conns := r.byUser[username]
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(r.byUser, username)
+	}
+}
+
+func (r *connRegistry) addMailbox(conn *Conn, state *connState) {
+	if state.mailbox == "" {
+		return
+	}
+
+	key := mailboxKey{state.username, state.mailbox}
+	if r.byMailbox[key] == nil {
+		r.byMailbox[key] = map[*Conn]struct{}{}
+	}
+	r.byMailbox[key][conn] = struct{}{}
+}
+
+func (r *connRegistry) removeMailbox(conn *Conn, state *connState) {
+	if state.mailbox == "" {
+		return
+	}
+
+	key := mailboxKey{state.username, state.mailbox}
+	conns := r.byMailbox[key]
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(r.byMailbox, key)
+	}
+}
+
+// Set the user a connection is logged in as. If the number of connections
+// logged in as this user would exceed maxPerUser, ErrTooManyConns is returned.
+// Zero means no limit.
+func (r *connRegistry) setUser(conn *Conn, user backend.User, maxPerUser int) error {
+	username := ""
+	if user != nil {
+		username = user.Username()
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	state, ok := r.conns[conn]
+	if !ok {
+		return nil
+	}
+
+	if username != "" && username != state.username && maxPerUser > 0 && len(r.byUser[username]) >= maxPerUser {
+		return ErrTooManyConns
+	}
+
+	r.removeMailbox(conn, state)
+	r.removeUser(conn, state.username)
+	state.user = user
+	state.username = username
+	state.mailbox = ""
+
+	if username != "" {
+		if r.byUser[username] == nil {
+			r.byUser[username] = map[*Conn]struct{}{}
+		}
+		r.byUser[username][conn] = struct{}{}
+	}
+	return nil
+}
+
+func (r *connRegistry) setMailbox(conn *Conn, name string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if state, ok := r.conns[conn]; ok {
+		r.removeMailbox(conn, state)
+		state.mailbox = name
+		r.addMailbox(conn, state)
+	}
+}
+
+// Rename the selected mailbox of a user's connections.
+func (r *connRegistry) renameMailbox(username, existingName, newName string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	for conn := range r.byMailbox[mailboxKey{username, existingName}] {
+		state := r.conns[conn]
+		r.removeMailbox(conn, state)
+		state.mailbox = newName
+		r.addMailbox(conn, state)
+	}
+}
+
+func (r *connRegistry) setSilent(conn *Conn, silent bool) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if state, ok := r.conns[conn]; ok {
+		state.silent = silent
+	}
+}
+
+// Get a copy of a connection's state.
+func (r *connRegistry) state(conn *Conn) (state connState, ok bool) {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+
+	s, ok := r.conns[conn]
+	if ok {
+		state = *s
+	}
+	return
+}
+
+func (r *connRegistry) all() []*Conn {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+
+	conns := make([]*Conn, 0, len(r.conns))
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Get connections logged in as username and having selected the mailbox
+// called name. An empty username matches all connections, an empty mailbox
+// name matches all mailboxes. If silent is true, connections executing a
+// silent STORE command are excluded.
+func (r *connRegistry) lookup(username, mailbox string, silent bool) []*Conn {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+
+	var conns []*Conn
+	match := func(conn *Conn, state *connState) {
+		if mailbox != "" && state.mailbox != mailbox {
+			return
+		}
+		if silent && state.silent {
+			return
+		}
+		conns = append(conns, conn)
+	}
+
+	if username != "" && mailbox != "" {
+		for conn := range r.byMailbox[mailboxKey{username, mailbox}] {
+			match(conn, r.conns[conn])
+		}
+	} else if username != "" {
+		for conn := range r.byUser[username] {
+			match(conn, r.conns[conn])
+		}
+	} else {
+		for conn, state := range r.conns {
+			match(conn, state)
+		}
+	}
+	return conns
+}
+
+// Get the connections targeted by a backend update. See lookup for silent.
+func (r *connRegistry) lookupUpdate(update *backend.Update, silent bool) []*Conn {
+	conns := r.lookup(update.Username, update.Mailbox, silent)
+	if update.User == nil {
+		return conns
+	}
+
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+
+	var matching []*Conn
+	for _, conn := range conns {
+		if state, ok := r.conns[conn]; ok && state.user == update.User {
+			matching = append(matching, conn)
+		}
+	}
+	return matching
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/commands"
+)
+
+// A function executing a command. hdlr is the command's handler, its arguments
+// have already been parsed: it can be type-asserted to access them, e.g.
+// hdlr.(*Fetch).SeqSet. For UID commands, hdlr is a *Uid, see Uid.Inner. It
+// returns the command's status response, which is written to the client.
+type CommandFunc func(conn *Conn, cmd *common.Command, hdlr Handler) *common.StatusResp
+
+// A Middleware wraps the execution of commands, e.g. for auditing or access
+// control. It returns a CommandFunc calling next to execute the command. It can
+// inspect or replace the status response returned by next, or return its own
+// status response without calling next to reject the command. If the tag of
+// the returned response is empty, it's set to the command's tag. A middleware
+// must not return a nil status response: it's treated as an internal error and
+// the command fails with NO.
+//
+// Middlewares are only called for commands that have been parsed
+// successfully. They must be safe for concurrent use, since commands can be
+// executed concurrently.
+type Middleware func(next CommandFunc) CommandFunc
+
+// Add middlewares wrapping the execution of commands. Middlewares are called
+// in the order they have been added: the first one is the outermost. Use must
+// be called before the server starts accepting connections.
+func (s *Server) Use(mws ...Middleware) {
+	s.middlewares = append(s.middlewares, mws...)
+}
+
+// Execute a command with its handler, without middlewares.
+func runHandler(conn *Conn, cmd *common.Command, hdlr Handler) *common.StatusResp {
+	err := hdlr.Handle(conn)
+	if err == commands.ErrAuthCancelled {
+		// The client cancelled the command, it must be rejected with BAD
+		return &common.StatusResp{
+			Tag: cmd.Tag,
+			Type: common.BAD,
+			Info: err.Error(),
+		}
+	} else if err != nil {
+		status := &common.StatusResp{
+			Tag: cmd.Tag,
+			Type: common.NO,
+			Info: err.Error(),
+		}
+		if codeErr, ok := err.(*CodeError); ok {
+			status.Code = codeErr.Code
+		}
+		return status
+	}
+
+	return &common.StatusResp{
+		Tag: cmd.Tag,
+		Type: common.OK,
+		Info: cmd.Name + " completed",
+	}
+}
+
+// Wrap a middleware's CommandFunc so that a nil status response is replaced by
+// a NO response, instead of crashing middlewares or the server using it.
+func checkStatus(f CommandFunc) CommandFunc {
+	return func(conn *Conn, cmd *common.Command, hdlr Handler) *common.StatusResp {
+		if status := f(conn, cmd, hdlr); status != nil {
+			return status
+		}
+
+		conn.log(common.LogError, "middleware returned no status response for " + cmd.Name, nil)
+		return &common.StatusResp{
+			Tag: cmd.Tag,
+			Type: common.NO,
+			Info: "Internal server error",
+		}
+	}
+}
+
+// Execute a command through middlewares. If the connection must be upgraded
+// after the response is sent, up is not nil.
+func (s *Server) handleCommand(hdlr Handler, cmd *common.Command, conn *Conn) (status *common.StatusResp, up HandlerUpgrader) {
+	// The handler actually executed, if any
+	var handled Handler
+
+	run := func(conn *Conn, cmd *common.Command, hdlr Handler) *common.StatusResp {
+		handled = hdlr
+		return runHandler(conn, cmd, hdlr)
+	}
+
+	f := CommandFunc(run)
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		f = checkStatus(s.middlewares[i](f))
+	}
+
+	status = f(conn, cmd, hdlr)
+	if status.Tag == "" {
+		status.Tag = cmd.Tag
+	}
+
+	// Only upgrade the connection if the client is told the command succeeded
+	if handled != nil && status.Type == common.OK {
+		up, _ = handled.(HandlerUpgrader)
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/server"
+)
+
+func TestServer_Use(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	defer s.Close()
+
+	var locker sync.Mutex
+	var calls []string
+
+	// Records commands and their results
+	s.Use(func(next server.CommandFunc) server.CommandFunc {
+		return func(conn *server.Conn, cmd *common.Command, hdlr server.Handler) *common.StatusResp {
+			status := next(conn, cmd, hdlr)
+
+			locker.Lock()
+			calls = append(calls, cmd.Tag + " " + cmd.Name + " " + string(status.Type))
+			locker.Unlock()
+			return status
+		}
+	})
+
+	// Rejects fetching all messages at once
+	s.Use(func(next server.CommandFunc) server.CommandFunc {
+		return func(conn *server.Conn, cmd *common.Command, hdlr server.Handler) *common.StatusResp {
+			h := hdlr
+			if uid, ok := hdlr.(*server.Uid); ok {
+				inner, err := uid.Inner(conn)
+				if err != nil {
+					return &common.StatusResp{Type: common.BAD, Info: err.Error()}
+				}
+				h = inner
+			}
+
+			if fetch, ok := h.(*server.Fetch); ok && fetch.SeqSet.String() == "1:*" {
+				return &common.StatusResp{
+					Type: common.NO,
+					Code: "LIMIT",
+					Info: "Too many messages",
+				}
+			}
+			return next(conn, cmd, hdlr)
+		}
+	})
+
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a001")
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "a002 ") {}
+
+	io.WriteString(c, "a003 FETCH 1:* (UID)\r\n")
+	scanner.Scan()
+	if scanner.Text() != "a003 NO [LIMIT] Too many messages" {
+		t.Fatal("Bad FETCH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a004 UID FETCH 1:* (UID)\r\n")
+	scanner.Scan()
+	if scanner.Text() != "a004 NO [LIMIT] Too many messages" {
+		t.Fatal("Bad UID FETCH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "a005 FETCH 1 (UID)\r\n")
+	expectResponses(t, scanner, "a005", "* 1 FETCH (UID 6)")
+
+	io.WriteString(c, "a006 FOO\r\n")
+	scanner.Scan()
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	expected := []string{"a001 LOGIN OK", "a002 SELECT OK", "a003 FETCH NO", "a004 UID NO", "a005 FETCH OK"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Bad middleware calls: expected %v, got %v", expected, calls)
+	}
+}
+
+func TestServer_Use_nilStatus(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	defer s.Close()
+
+	var locker sync.Mutex
+	var types []string
+
+	// Uses the status response returned by the next middleware
+	s.Use(func(next server.CommandFunc) server.CommandFunc {
+		return func(conn *server.Conn, cmd *common.Command, hdlr server.Handler) *common.StatusResp {
+			status := next(conn, cmd, hdlr)
+
+			locker.Lock()
+			types = append(types, string(status.Type))
+			locker.Unlock()
+			return status
+		}
+	})
+
+	// Broken middleware
+	s.Use(func(next server.CommandFunc) server.CommandFunc {
+		return func(conn *server.Conn, cmd *common.Command, hdlr server.Handler) *common.StatusResp {
+			if cmd.Name == "NOOP" {
+				return nil
+			}
+			return next(conn, cmd, hdlr)
+		}
+	})
+
+	go s.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 NOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "a001 NO Internal server error" {
+		t.Fatal("Bad NOOP response:", scanner.Text())
+	}
+
+	// The connection is still usable
+	io.WriteString(c, "a002 LOGIN username password\r\n")
+	expectResponses(t, scanner, "a002")
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if strings.Join(types, ",") != "NO,OK" {
+		t.Fatalf("Bad status responses seen by middlewares: %v", types)
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The signature of PROXY protocol v2 headers.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The maximum length of a PROXY protocol v1 header, including the CRLF.
+const proxyV1MaxLen = 107
+
+// How long to wait for a PROXY protocol header if the server has no
+// PreAuthTimeout.
+const proxyHeaderTimeout = 10 * time.Second
+
+// PROXY protocol v2 TLV types.
+const (
+	proxyTLVAuthority = 0x02
+	proxyTLVSSL = 0x20
+	proxyTLVSSLVersion = 0x21
+	proxyTLVSSLCN = 0x22
+	proxyTLVSSLCipher = 0x23
+	proxyTLVSSLSigAlg = 0x24
+	proxyTLVSSLKeyAlg = 0x25
+)
+
+// PROXY protocol v2 SSL client flags.
+const (
+	proxyClientSSL = 0x01
+	proxyClientCertConn = 0x02
+	proxyClientCertSess = 0x04
+)
+
+var errMalformedProxyHeader = errors.New("Malformed PROXY protocol header")
+
+// Information about the TLS connection between a client and a proxy, sent
+// with the PROXY protocol v2.
+type ProxyTLS struct {
+	// The TLS version, e.g. "TLSv1.3".
+	Version string
+	// The cipher, e.g. "ECDHE-RSA-AES128-GCM-SHA256".
+	Cipher string
+	// The signature and key algorithms of the proxy's certificate.
+	SigAlg, KeyAlg string
+	// True if the client presented a certificate.
+	ClientCert bool
+	// True if the client certificate has been verified by the proxy.
+	Verified bool
+	// The common name of the client certificate.
+	CommonName string
+}
+
+// Information sent by a proxy with the PROXY protocol.
+type ProxyInfo struct {
+	// The client's address.
+	SourceAddr net.Addr
+	// The address the client connected to.
+	DestAddr net.Addr
+	// The host name requested by the client, e.g. with SNI. Only sent with the
+	// PROXY protocol v2.
+	Authority string
+	// If the client is connected to the proxy with TLS, information about the
+	// TLS connection. Only sent with the PROXY protocol v2.
+	TLS *ProxyTLS
+}
+
+// Check if a connection comes from a trusted proxy.
+func (s *Server) isTrustedProxy(c net.Conn) bool {
+	ip := net.ParseIP(remoteIP(c))
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range s.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read a PROXY protocol header from a connection. The header is read without
+// consuming any other data, so that c can then be used as is.
+func (s *Server) readProxyHeader(c net.Conn) (*ProxyInfo, error) {
+	timeout := s.PreAuthTimeout
+	if timeout <= 0 {
+		timeout = proxyHeaderTimeout
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	b := make([]byte, len(proxyV2Sig))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2(c)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyV1(c, b)
+	}
+	return nil, errMalformedProxyHeader
+}
+
+// Read a PROXY protocol v1 header, whose first bytes have already been read.
+func readProxyV1(c net.Conn, start []byte) (*ProxyInfo, error) {
+	line := start
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errMalformedProxyHeader
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	// PROXY TCP4 192.0.2.1 192.0.2.2 56324 143
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) < 2 {
+		return nil, errMalformedProxyHeader
+	}
+
+	info := &ProxyInfo{}
+	switch fields[1] {
+	case "UNKNOWN":
+		// The proxy doesn't know the client's address
+		return info, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errMalformedProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, errMalformedProxyHeader
+	}
+
+	var err error
+	if info.SourceAddr, err = parseProxyV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if info.DestAddr, err = parseProxyV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func parseProxyV1Addr(ip, port string) (net.Addr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, errMalformedProxyHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errMalformedProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// Read a PROXY protocol v2 header, whose signature has already been read.
+func readProxyV2(c net.Conn) (*ProxyInfo, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr[0] >> 4 != 2 {
+		return nil, errors.New("Unsupported PROXY protocol version")
+	}
+	cmd := hdr[0] & 0x0F
+	family := hdr[1] >> 4
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(c, payload); err != nil {
+		return nil, err
+	}
+
+	info := &ProxyInfo{}
+
+	// A LOCAL command is sent by the proxy itself, e.g. for health checks
+	if cmd == 0 {
+		return info, nil
+	}
+	if cmd != 1 {
+		return nil, errMalformedProxyHeader
+	}
+
+	var ipLen int
+	switch family {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// Unspecified or UNIX addresses, ignore them
+		return info, nil
+	}
+
+	addrsLen := 2 * ipLen + 4
+	if len(payload) < addrsLen {
+		return nil, errMalformedProxyHeader
+	}
+
+	info.SourceAddr = &net.TCPAddr{
+		IP: net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	info.DestAddr = &net.TCPAddr{
+		IP: net.IP(payload[ipLen:2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	err := parseProxyTLVs(payload[addrsLen:], func(t byte, v []byte) error {
+		switch t {
+		case proxyTLVAuthority:
+			info.Authority = string(v)
+		case proxyTLVSSL:
+			tlsInfo, err := parseProxySSL(v)
+			if err != nil {
+				return err
+			}
+			info.TLS = tlsInfo
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Parse PROXY protocol v2 TLVs, calling f for each one of them.
+func parseProxyTLVs(b []byte, f func(t byte, v []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return errMalformedProxyHeader
+		}
+
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3 + n {
+			return errMalformedProxyHeader
+		}
+
+		if err := f(b[0], b[3:3+n]); err != nil {
+			return err
+		}
+		b = b[3+n:]
+	}
+	return nil
+}
+
+// Parse the value of a PP2_TYPE_SSL TLV. It returns nil if the client isn't
+// connected with TLS.
+func parseProxySSL(v []byte) (*ProxyTLS, error) {
+	if len(v) < 5 {
+		return nil, errMalformedProxyHeader
+	}
+
+	client := v[0]
+	if client & proxyClientSSL == 0 {
+		return nil, nil
+	}
+
+	tlsInfo := &ProxyTLS{
+		ClientCert: client & (proxyClientCertConn | proxyClientCertSess) != 0,
+	}
+	tlsInfo.Verified = tlsInfo.ClientCert && binary.BigEndian.Uint32(v[1:5]) == 0
+
+	err := parseProxyTLVs(v[5:], func(t byte, v []byte) error {
+		switch t {
+		case proxyTLVSSLVersion:
+			tlsInfo.Version = string(v)
+		case proxyTLVSSLCN:
+			tlsInfo.CommonName = string(v)
+		case proxyTLVSSLCipher:
+			tlsInfo.Cipher = string(v)
+		case proxyTLVSSLSigAlg:
+			tlsInfo.SigAlg = string(v)
+		case proxyTLVSSLKeyAlg:
+			tlsInfo.KeyAlg = string(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tlsInfo, nil
+}
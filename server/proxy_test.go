@@ -0,0 +1,142 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+func testProxyServer(t *testing.T, trusted string) (s *server.Server, c net.Conn) {
+	_, n, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s = server.New(memory.New())
+	s.TrustedProxies = []*net.IPNet{n}
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	return
+}
+
+func TestServer_ProxyV1(t *testing.T) {
+	s, c := testProxyServer(t, "127.0.0.0/8")
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 143\r\n")
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "* OK [CAPABILITY IMAP4rev1 LOGINDISABLED] IMAP4rev1 Service Ready" {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	conns := s.Conns()
+	if len(conns) != 1 {
+		t.Fatal("Expected exactly one connection, got:", len(conns))
+	}
+	if addr := conns[0].RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Error("Bad remote address:", addr)
+	}
+	if addr := conns[0].LocalAddr().String(); addr != "192.0.2.2:143" {
+		t.Error("Bad local address:", addr)
+	}
+}
+
+// Build a PROXY protocol v2 TLV.
+func proxyTLV(t byte, v []byte) []byte {
+	b := []byte{t, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(v)))
+	return append(b, v...)
+}
+
+func TestServer_ProxyV2(t *testing.T) {
+	s, c := testProxyServer(t, "127.0.0.0/8")
+	defer s.Close()
+	defer c.Close()
+
+	// Client connected with TLS and a verified certificate
+	ssl := []byte{0x01 | 0x02, 0, 0, 0, 0}
+	ssl = append(ssl, proxyTLV(0x21, []byte("TLSv1.3"))...)
+	ssl = append(ssl, proxyTLV(0x22, []byte("username"))...)
+
+	payload := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0, 143}
+	payload = append(payload, proxyTLV(0x02, []byte("mail.example.org"))...)
+	payload = append(payload, proxyTLV(0x20, ssl)...)
+
+	hdr := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	hdr = append(hdr, 0x21, 0x11, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(payload)))
+	c.Write(append(hdr, payload...))
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	// The connection is encrypted between the client and the proxy
+	if scanner.Text() != "* OK [CAPABILITY IMAP4rev1 AUTH=LOGIN AUTH=PLAIN SASL-IR] IMAP4rev1 Service Ready" {
+		t.Fatal("Bad greeting:", scanner.Text())
+	}
+
+	conns := s.Conns()
+	if len(conns) != 1 {
+		t.Fatal("Expected exactly one connection, got:", len(conns))
+	}
+	if addr := conns[0].RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Error("Bad remote address:", addr)
+	}
+
+	info := conns[0].Proxy()
+	if info.Authority != "mail.example.org" {
+		t.Error("Bad authority:", info.Authority)
+	}
+	if info.TLS == nil {
+		t.Fatal("No TLS information")
+	}
+	if info.TLS.Version != "TLSv1.3" || info.TLS.CommonName != "username" || !info.TLS.Verified {
+		t.Errorf("Bad TLS information: %+v", info.TLS)
+	}
+}
+
+func TestServer_ProxyUntrusted(t *testing.T) {
+	s, c := testProxyServer(t, "192.0.2.0/24")
+	defer s.Close()
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	conns := s.Conns()
+	if len(conns) != 1 {
+		t.Fatal("Expected exactly one connection, got:", len(conns))
+	}
+	if conns[0].Proxy() != nil {
+		t.Error("Untrusted connection handled as proxied")
+	}
+}
+
+func TestServer_ProxyMalformed(t *testing.T) {
+	s, c := testProxyServer(t, "127.0.0.0/8")
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+
+	scanner := bufio.NewScanner(c)
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap/common"
+)
+
+// A message of the selected mailbox, as seen by a client.
+type seqMessage struct {
+	// The message UID, zero if unknown.
+	uid uint32
+	// True if the message has been expunged, but the client hasn't been told
+	// yet.
+	expunged bool
+}
+
+// The message sequence numbers of the selected mailbox, as seen by a client.
+//
+// Sequence numbers used by the backend don't include expunged messages, but
+// EXPUNGE responses cannot be sent at any time (see RFC 3501 section 7.4.1):
+// expunged messages are kept until the client is told about them, and sequence
+// numbers are translated in both directions.
+type seqNums struct {
+	locker sync.Mutex
+	messages []*seqMessage
+	// The number of expunged messages the client hasn't been told about.
+	pending int
+	// Incremented each time a mailbox is selected.
+	generation uint64
+	// True while a mailbox is being selected. UID-addressed updates are
+	// recorded and applied by reset, other updates are ignored.
+	selecting bool
+	addedUids []uint32
+	expungedUids map[uint32]bool
+}
+
+// Start selecting a mailbox. The UIDs of its messages must be listed after
+// this call, then passed to reset.
+func (s *seqNums) startSelect() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.messages = nil
+	s.pending = 0
+	s.generation++
+	s.selecting = true
+	s.addedUids = nil
+	s.expungedUids = make(map[uint32]bool)
+}
+
+// Reset the sequence numbers after a mailbox has been selected. uids contains
+// the UIDs of the mailbox's messages, zero if unknown.
+func (s *seqNums) reset(uids []uint32) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.messages = make([]*seqMessage, 0, len(uids))
+	for _, uid := range uids {
+		if !s.expungedUids[uid] {
+			s.messages = append(s.messages, &seqMessage{uid: uid})
+		}
+	}
+	for _, uid := range s.addedUids {
+		if !s.expungedUids[uid] && s.indexUid(uid) < 0 {
+			s.messages = append(s.messages, &seqMessage{uid: uid})
+		}
+	}
+
+	s.pending = 0
+	s.generation++
+	s.selecting = false
+	s.addedUids = nil
+	s.expungedUids = nil
+}
+
+// Get the current generation, which changes each time a mailbox is selected.
+func (s *seqNums) gen() uint64 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.generation
+}
+
+// Get the index of a message from its backend sequence number, or -1 if there
+// is no such message.
+func (s *seqNums) index(seqNum uint32) int {
+	if seqNum == 0 {
+		return -1
+	}
+
+	n := uint32(0)
+	for i, msg := range s.messages {
+		if msg.expunged {
+			continue
+		}
+		n++
+		if n == seqNum {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get the index of a message from its UID, or -1 if there is no such message.
+func (s *seqNums) indexUid(uid uint32) int {
+	if uid == 0 {
+		return -1
+	}
+
+	for i, msg := range s.messages {
+		if msg.uid == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get a message from its backend sequence number, or nil if there is no such
+// message.
+func (s *seqNums) message(seqNum uint32) *seqMessage {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if i := s.index(seqNum); i >= 0 {
+		return s.messages[i]
+	}
+	return nil
+}
+
+// Get a message from its UID, or nil if the message is unknown or has been
+// expunged.
+func (s *seqNums) messageUid(uid uint32) *seqMessage {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if i := s.indexUid(uid); i >= 0 && !s.messages[i].expunged {
+		return s.messages[i]
+	}
+	return nil
+}
+
+// Get the client sequence number of a message. Zero is returned if the message
+// has been expunged.
+func (s *seqNums) seqNum(msg *seqMessage) uint32 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for i, m := range s.messages {
+		if m == msg {
+			if m.expunged {
+				return 0
+			}
+			return uint32(i + 1)
+		}
+	}
+	return 0
+}
+
+// Get the number of messages, as seen by the client.
+func (s *seqNums) count() uint32 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return uint32(len(s.messages))
+}
+
+// Get the highest known UID, zero if unknown.
+func (s *seqNums) maxUid() uint32 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	max := uint32(0)
+	for _, msg := range s.messages {
+		if msg.uid > max {
+			max = msg.uid
+		}
+	}
+	return max
+}
+
+// Get a snapshot of the expunged messages, used to translate sequence
+// numbers.
+func (s *seqNums) snapshot() *seqSnapshot {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	snap := &seqSnapshot{pending: s.pending}
+	if s.pending > 0 {
+		snap.expunged = make([]bool, len(s.messages))
+		for i, msg := range s.messages {
+			snap.expunged[i] = msg.expunged
+		}
+	}
+	return snap
+}
+
+// The expunged messages of the selected mailbox at some point in time. A
+// command translates all of its sequence numbers with the same snapshot, so
+// that updates received while it's executed don't change their meaning.
+type seqSnapshot struct {
+	// For each message as seen by the client, true if it has been expunged.
+	// Nil if no message has been expunged.
+	expunged []bool
+	pending int
+}
+
+// Convert a backend sequence number to a client one. Zero is returned if the
+// message is unknown.
+func (s *seqSnapshot) toClient(seqNum uint32) uint32 {
+	if s.pending == 0 {
+		return seqNum
+	}
+	if seqNum == 0 {
+		return 0
+	}
+
+	n := uint32(0)
+	for i, expunged := range s.expunged {
+		if expunged {
+			continue
+		}
+		n++
+		if n == seqNum {
+			return uint32(i + 1)
+		}
+	}
+	return 0
+}
+
+// Convert a client sequence set to a backend one. Expunged messages are
+// excluded.
+func (s *seqSnapshot) toBackend(set *common.SeqSet) *common.SeqSet {
+	if s.pending == 0 || set == nil {
+		return set
+	}
+
+	translated := &common.SeqSet{}
+	last := uint32(len(s.expunged))
+	n := uint32(0)
+	for i, expunged := range s.expunged {
+		if expunged {
+			continue
+		}
+		n++
+
+		seqNum := uint32(i + 1)
+		if set.Contains(seqNum) || (seqNum == last && set.Contains(0)) {
+			translated.AddNum(n)
+		}
+	}
+	return translated
+}
+
+// Mark a message as expunged, from its backend sequence number. It returns
+// false if the message is unknown.
+func (s *seqNums) expunge(seqNum uint32) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	i := s.index(seqNum)
+	if i < 0 {
+		return false
+	}
+
+	s.messages[i].expunged = true
+	s.pending++
+	return true
+}
+
+// Mark a message as expunged, from its UID. It returns false if the message
+// is unknown.
+func (s *seqNums) expungeUid(uid uint32) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.selecting {
+		s.expungedUids[uid] = true
+		return false
+	}
+
+	i := s.indexUid(uid)
+	if i < 0 || s.messages[i].expunged {
+		return false
+	}
+
+	s.messages[i].expunged = true
+	s.pending++
+	return true
+}
+
+// Add new messages from their UIDs. It returns false if a mailbox is being
+// selected, the messages are added once it's done.
+func (s *seqNums) add(uids []uint32) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.selecting {
+		s.addedUids = append(s.addedUids, uids...)
+		return false
+	}
+
+	for _, uid := range uids {
+		if s.indexUid(uid) < 0 {
+			s.messages = append(s.messages, &seqMessage{uid: uid})
+		}
+	}
+	return true
+}
+
+// Update the number of messages in the mailbox, as reported by the backend.
+// It returns the number of messages as seen by the client, and false if a
+// mailbox is being selected.
+func (s *seqNums) exists(n uint32) (uint32, bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.selecting {
+		return 0, false
+	}
+
+	for uint32(len(s.messages) - s.pending) < n {
+		s.messages = append(s.messages, &seqMessage{})
+	}
+	return uint32(len(s.messages)), true
+}
+
+// Forget expunged messages. It returns the sequence numbers to send in EXPUNGE
+// responses, in order.
+func (s *seqNums) flush() []uint32 {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.pending == 0 {
+		return nil
+	}
+
+	var seqNums []uint32
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if msg.expunged {
+			seqNums = append(seqNums, uint32(len(kept) + 1))
+			continue
+		}
+		kept = append(kept, msg)
+	}
+
+	s.messages = kept
+	s.pending = 0
+	return seqNums
+}
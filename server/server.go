@@ -2,19 +2,40 @@
 package server
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
-	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap/common"
 	"github.com/emersion/go-imap/backend"
-	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/scram"
 	"github.com/emersion/go-sasl"
 )
 
+// ErrServerClosed is returned by Serve after the server has been shut down or
+// closed.
+var ErrServerClosed = errors.New("Server closed")
+
+// How often Shutdown checks whether all connections have been closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// A CodeError is an error sent to the client with a response code.
+type CodeError struct {
+	// The response code, e.g. "AUTHENTICATIONFAILED".
+	// See https://www.iana.org/assignments/imap-response-codes/imap-response-codes.xhtml
+	Code string
+	Err error
+}
+
+func (err *CodeError) Error() string {
+	return err.Err.Error()
+}
+
 // A command handler.
 type Handler interface {
 	common.Parser
@@ -23,20 +44,55 @@ type Handler interface {
 	Handle(conn *Conn) error
 }
 
+// A command handler that upgrades the connection after the command succeeded,
+// e.g. to start TLS.
+type HandlerUpgrader interface {
+	Handler
+
+	// Upgrade the connection. It's called after the OK response has been sent.
+	// If an error is returned, the connection is closed.
+	Upgrade(conn *Conn) error
+}
+
+// A command handler that can be executed concurrently with other commands of
+// the same connection. Its responses must not depend on other commands in
+// progress.
+type ConcurrentHandler interface {
+	Handler
+
+	// Check if this command can be executed concurrently. It's called after the
+	// command has been parsed, when no other command changing the connection's
+	// state is in progress.
+	Concurrent(conn *Conn) bool
+}
+
 // A function that creates handlers.
 type HandlerFactory func() Handler
 
-// A function that creates SASL servers.
+// A function that creates SASL servers. It returns nil if the mechanism isn't
+// available on the connection.
 type SaslServerFactory func(conn *Conn) sasl.Server
 
 // An IMAP server.
 type Server struct {
 	listener net.Listener
-	conns []*Conn
+	conns *connRegistry
+
+	// Protects listeners, active, shuttingDown and the busy counter of
+	// connections.
+	locker sync.Mutex
+	listeners map[net.Listener]struct{}
+	// The number of connections being handled.
+	active int
+	shuttingDown bool
 
 	caps map[string]common.ConnState
 	commands map[string]HandlerFactory
 	auths map[string]SaslServerFactory
+	middlewares []Middleware
+
+	// Used to wait for updates received by listenUpdates to be processed.
+	updatesSync chan chan struct{}
 
 	// This server's backend.
 	Backend backend.Backend
@@ -46,8 +102,67 @@ type Server struct {
 	TLSConfig *tls.Config
 	// Allow authentication over unencrypted connections.
 	AllowInsecureAuth bool
-	// Print all network activity to STDOUT.
+	// Print all network activity to STDOUT, credentials excluded. Ignored if
+	// Tracer is set.
 	Debug bool
+	// If not nil, network activity is traced.
+	Tracer *common.Tracer
+	// Receives events about connections and commands. If nil, warnings and
+	// errors are printed with the standard logger.
+	Logger common.Logger
+	// If not nil, receives measurements about connections and commands.
+	Metrics common.Metrics
+
+	// The maximum amount of time a client can stay connected without logging
+	// in. Zero means no timeout.
+	PreAuthTimeout time.Duration
+	// The inactivity autologout timer for logged in clients. RFC 3501 requires
+	// it to be at least 30 minutes. Commands waiting for client input, such as
+	// IDLE, are also subject to this timer, starting when the command is
+	// received. Zero means no timeout.
+	AutoLogout time.Duration
+	// The maximum amount of time to write a response to a client. Zero means no
+	// timeout.
+	WriteTimeout time.Duration
+
+	// The maximum number of simultaneous connections, in total, from a single
+	// IP address and logged in as a single user. Zero means no limit.
+	MaxConns int
+	MaxConnsPerIP int
+	MaxConnsPerUser int
+	// The maximum size of a literal sent by a client, e.g. a message appended
+	// with APPEND. Bigger literals are rejected with a TOOBIG response code.
+	// Zero means no limit.
+	MaxLiteralSize uint32
+	// The maximum length of a command line, literals excluded. Zero means no
+	// limit.
+	MaxLineLength int
+	// The maximum nesting depth of lists in a command. Zero means no limit.
+	MaxDepth int
+
+	// Throttles authentication attempts. If nil, attempts are not limited.
+	AuthLimiter AuthLimiter
+	// The maximum number of failed authentication attempts on a connection,
+	// after which the connection is closed. Zero means no limit.
+	MaxAuthFailures int
+	// If not nil, called after each authentication attempt, e.g. to feed
+	// intrusion prevention tools.
+	AuthHook func(ev *AuthEvent)
+	// The maximum number of commands executed concurrently on a connection.
+	// Commands which don't change the state of the connection or of the selected
+	// mailbox, e.g. FETCH or STATUS, are executed concurrently. Other commands
+	// wait for all previous commands to complete. Zero or one disables
+	// concurrent execution.
+	MaxConcurrentCommands int
+	// The maximum number of unilateral updates, e.g. new message
+	// notifications, waiting to be sent to a client. If a client doesn't read
+	// its responses and this limit is reached, the connection is closed. Zero
+	// means no limit.
+	MaxQueuedUpdates int
+	// Networks of trusted proxies, e.g. load balancers. Connections from these
+	// networks must start with a PROXY protocol header (v1 or v2) carrying the
+	// client's address. Other connections are handled as usual.
+	TrustedProxies []*net.IPNet
 }
 
 // Get this server's address.
@@ -55,27 +170,161 @@ func (s *Server) Addr() net.Addr {
 	return s.listener.Addr()
 }
 
-func (s *Server) listen() error {
-	defer s.listener.Close()
+// Get a snapshot of active connections.
+func (s *Server) Conns() []*Conn {
+	return s.conns.all()
+}
+
+// Accept incoming connections on the listener l and handle them. Serve always
+// returns a non-nil error. After Shutdown or Close, the returned error is
+// ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.locker.Lock()
+	if s.shuttingDown {
+		s.locker.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listener == nil {
+		s.listener = l
+	}
+	s.listeners[l] = struct{}{}
+	s.locker.Unlock()
+
+	defer (func() {
+		s.locker.Lock()
+		delete(s.listeners, l)
+		s.locker.Unlock()
+
+		l.Close()
+	})()
 
 	for {
-		c, err := s.listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		conn := newConn(s, c)
-		if s.Debug {
-			conn.SetDebug(true)
+		// Connections from proxies are accepted in their own goroutine, since
+		// reading the PROXY protocol header can block
+		if len(s.TrustedProxies) > 0 && s.isTrustedProxy(c) {
+			go s.acceptProxied(c)
+			continue
+		}
+
+		if err := s.accept(c, nil); err == ErrServerClosed {
+			return err
 		}
+	}
+}
+
+// Accept a connection from a proxy, after reading its PROXY protocol header.
+func (s *Server) acceptProxied(c net.Conn) {
+	raw := c
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		// The header is sent before the TLS handshake
+		raw = tlsConn.NetConn()
+	}
+
+	proxy, err := s.readProxyHeader(raw)
+	if err != nil {
+		common.LogWith(s.Logger, &common.LogEvent{
+			Level: common.LogError,
+			Message: "cannot read PROXY protocol header from " + c.RemoteAddr().String(),
+			Err: err,
+		})
+		c.Close()
+		return
+	}
+
+	s.accept(c, proxy)
+}
+
+// Register a new connection and start handling it. proxy is the information
+// sent by a proxy, if any.
+func (s *Server) accept(c net.Conn, proxy *ProxyInfo) error {
+	conn := newConn(s, c)
+	conn.proxy = proxy
+	if s.Tracer != nil {
+		conn.SetTracer(s.Tracer)
+	} else if s.Debug {
+		conn.SetDebug(true)
+	}
+	conn.SetMetrics(s.Metrics)
+
+	s.locker.Lock()
+	if s.shuttingDown {
+		s.locker.Unlock()
+		c.Close()
+		return ErrServerClosed
+	}
+	if err := s.conns.add(conn, s.MaxConns, s.MaxConnsPerIP); err != nil {
+		s.locker.Unlock()
+		go conn.bye(err.Error())
+		return err
+	}
+	s.active++
+	s.locker.Unlock()
+
+	conn.log(common.LogInfo, "connection from " + conn.RemoteAddr().String(), nil)
+	conn.Metrics().ConnOpened()
+
+	go s.handleConn(conn)
+	return nil
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.shuttingDown
+}
+
+// Mark a connection as executing a command. Returns false if the server is
+// shutting down, in this case the command must not be executed.
+func (s *Server) startCommand(conn *Conn) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
 
-		go s.handleConn(conn)
+	if s.shuttingDown {
+		return false
 	}
+	conn.busy++
+	return true
+}
+
+// Mark a command as completed. Returns false if the server is shutting down and
+// no other command is in progress on the connection, in this case the
+// connection must be closed.
+func (s *Server) endCommand(conn *Conn) bool {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	conn.busy--
+	return !s.shuttingDown || conn.busy > 0
 }
 
 func (s *Server) handleConn(conn *Conn) error {
-	s.conns = append(s.conns, conn)
-	defer conn.Close()
+	// Commands executed concurrently
+	var inflight sync.WaitGroup
+	sem := make(chan struct{}, s.MaxConcurrentCommands)
+
+	defer (func() {
+		inflight.Wait()
+		conn.setState(common.LogoutState)
+		conn.Close()
+		conn.logout()
+		s.conns.remove(conn)
+
+		s.locker.Lock()
+		s.active--
+		s.locker.Unlock()
+
+		conn.log(common.LogInfo, "connection closed", nil)
+		conn.Metrics().ConnClosed()
+	})()
 
 	// Send greeting
 	if err := conn.greet(); err != nil {
@@ -83,154 +332,223 @@ func (s *Server) handleConn(conn *Conn) error {
 	}
 
 	for {
-		if conn.State == common.LogoutState {
+		if conn.State == common.LogoutState || conn.isClosed() || conn.isCloseRequested() {
 			return nil
 		}
 
 		conn.Wait()
+		conn.setReadDeadline()
 
 		fields, err := conn.ReadLine()
-		if err == io.EOF || conn.State == common.LogoutState {
+		if err == io.EOF || conn.State == common.LogoutState || conn.isClosed() || conn.isCloseRequested() {
 			return nil
 		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return conn.bye("Autologout")
+		}
+		if err == common.ErrLiteralTooBig {
+			// The continuation request hasn't been sent, the client won't
+			// send the literal: the connection can still be used
+			tag := "*"
+			if len(fields) > 0 {
+				if t, ok := fields[0].(string); ok {
+					tag = t
+				}
+			}
+
+			res := &common.StatusResp{
+				Tag: tag,
+				Type: common.BAD,
+				Code: "TOOBIG",
+				Info: err.Error(),
+			}
+			if err := conn.WriteRes(res); err != nil {
+				return err
+			}
+			continue
+		}
+		if err == common.ErrLineTooLong || err == common.ErrTooDeep {
+			return conn.bye(err.Error())
+		}
 		if err != nil {
-			log.Println("Error reading command:", err)
+			conn.log(common.LogError, "cannot read command", err)
 			return err
 		}
 
-		var res common.WriterTo
+		if !s.startCommand(conn) {
+			// The server is shutting down, the connection has been closed
+			return nil
+		}
+
+		// Restart the timer, the command may wait for client input
+		conn.setReadDeadline()
 
 		cmd := &common.Command{}
 		if err := cmd.Parse(fields); err != nil {
-			res = &common.StatusResp{
+			conn.log(common.LogInfo, "invalid command", err)
+
+			res := &common.StatusResp{
 				Tag: "*",
 				Type: common.BAD,
 				Info: err.Error(),
 			}
-		} else {
-			var err error
-			res, err = s.handleCommand(cmd, conn)
-			if err != nil {
-				res = &common.StatusResp{
-					Tag: cmd.Tag,
-					Type: common.BAD,
-					Info: err.Error(),
-				}
+			if err := conn.WriteRes(res); err != nil {
+				conn.log(common.LogError, "cannot write response", err)
+			}
+
+			if !s.endCommand(conn) {
+				return conn.bye("server shutting down")
+			}
+			continue
+		}
+
+		hdlr, err := s.getCommandHandler(cmd)
+		if err != nil {
+			if err := s.executeCommand(conn, cmd, nil, err, false); err != nil {
+				return err
 			}
+			continue
 		}
 
-		if err := conn.WriteRes(res); err != nil {
-			log.Println("Error writing response:", err)
+		if s.isConcurrent(conn, hdlr) {
+			// Execute the command in the background and read the next one
+			sem <- struct{}{}
+			inflight.Add(1)
+			go (func() {
+				defer inflight.Done()
+				defer (func() { <-sem })()
+
+				if err := s.executeCommand(conn, cmd, hdlr, nil, false); err != nil {
+					conn.requestClose()
+				}
+			})()
 			continue
 		}
+
+		// Other commands are executed alone, and the next command is only read
+		// after they complete
+		inflight.Wait()
+		if err := s.executeCommand(conn, cmd, hdlr, nil, true); err != nil {
+			return err
+		}
 	}
 }
 
-func (s *Server) getCommandHandler(cmd *common.Command) (hdlr Handler, err error) {
-	newHandler, ok := s.commands[cmd.Name]
-	if !ok {
-		err = errors.New("Unknown command")
-		return
-	}
+// Check if EXPUNGE responses can be sent while executing a command. They
+// cannot be sent during FETCH, STORE and SEARCH, see RFC 3501 section 7.4.1.
+func allowsExpunge(cmd *common.Command) bool {
+	name := strings.TrimPrefix(commandName(cmd), "UID ")
+	return name != "FETCH" && name != "STORE" && name != "SEARCH"
+}
 
-	hdlr = newHandler()
-	err = hdlr.Parse(cmd.Arguments)
-	return
+// Get the name of a command in upper case. For UID commands, the name of the
+// sub-command is included, e.g. "UID FETCH".
+func commandName(cmd *common.Command) string {
+	name := strings.ToUpper(cmd.Name)
+	if name == "UID" && len(cmd.Arguments) > 0 {
+		if sub, ok := cmd.Arguments[0].(string); ok {
+			name += " " + strings.ToUpper(sub)
+		}
+	}
+	return name
 }
 
-func (s *Server) handleCommand(cmd *common.Command, conn *Conn) (res common.WriterTo, err error) {
-	hdlr, err := s.getCommandHandler(cmd)
-	if err != nil {
-		return
+// Check if a command can be executed concurrently with other commands of the
+// same connection.
+func (s *Server) isConcurrent(conn *Conn, hdlr Handler) bool {
+	if s.MaxConcurrentCommands <= 1 {
+		return false
 	}
 
-	if err := hdlr.Handle(conn); err != nil {
-		res = &common.StatusResp{
-			Tag: cmd.Tag,
-			Type: common.NO,
-			Info: err.Error(),
+	concurrent, ok := hdlr.(ConcurrentHandler)
+	return ok && concurrent.Concurrent(conn)
+}
+
+// Execute a command and write its response. parseErr is the error returned
+// when parsing the command, if any. alone is true if no other command is
+// executed concurrently. If the connection must be closed, an error is
+// returned.
+func (s *Server) executeCommand(conn *Conn, cmd *common.Command, hdlr Handler, parseErr error, alone bool) error {
+	start := time.Now()
+
+	var res *common.StatusResp
+	var up HandlerUpgrader
+
+	if parseErr == nil {
+		res, up = s.handleCommand(hdlr, cmd, conn)
+
+		if alone && allowsExpunge(cmd) {
+			if err := conn.flushExpunges(); err != nil {
+				conn.log(common.LogError, "cannot write response", err)
+			}
 		}
 	} else {
 		res = &common.StatusResp{
 			Tag: cmd.Tag,
-			Type: common.OK,
-			Info: cmd.Name + " completed",
+			Type: common.BAD,
+			Info: parseErr.Error(),
 		}
 	}
 
-	return
-}
-
-func (s *Server) listenUpdates() (err error) {
-	updater, ok := s.Backend.(backend.Updater)
-	if !ok {
-		return
+	ev := &common.LogEvent{
+		Level: common.LogInfo,
+		ConnID: conn.ID(),
+		Tag: cmd.Tag,
+		Command: commandName(cmd),
+		Result: res.Type,
 	}
-	s.Updates = updater.Updates()
-
-	var update *backend.Update
-	var res common.WriterTo
-	for {
-		// TODO: do not generate response if nobody will receive it
-
-		select {
-		case status := <-s.Updates.Statuses:
-			update = &status.Update
-			res = status.StatusResp
-		case mailbox := <-s.Updates.Mailboxes:
-			update = &mailbox.Update
-			res = &responses.Select{Mailbox: mailbox.MailboxStatus}
-		case message := <-s.Updates.Messages:
-			update = &message.Update
-
-			ch := make(chan *common.Message)
-			go (func() {
-				ch <- message.Message
-				close(ch)
-			})()
 
-			res = &responses.Fetch{Messages: ch}
-		case expunge := <-s.Updates.Expunges:
-			update = &expunge.Update
+	if err := conn.WriteRes(res); err != nil {
+		conn.log(common.LogError, "cannot write response", err)
+		ev.Result = ""
+		ev.Err = err
+	}
 
-			ch := make(chan uint32)
-			go (func() {
-				ch <- expunge.SeqNum
-				close(ch)
-			})()
+	ev.Duration = time.Since(start)
+	common.LogWith(s.Logger, ev)
+	conn.Metrics().CommandCompleted(s.metricsName(cmd), ev.Result, ev.Duration)
 
-			res = &responses.Expunge{SeqNums: ch}
+	if up != nil {
+		if err := up.Upgrade(conn); err != nil {
+			conn.log(common.LogError, "cannot upgrade connection", err)
+			s.endCommand(conn)
+			return err
 		}
+	}
 
-		// Format response
-		b := &bytes.Buffer{}
-		w := common.NewWriter(b)
-		if err := res.WriteTo(w); err != nil {
-			log.Println("WARN: cannot format unlateral update:", err)
-		}
+	if !s.endCommand(conn) {
+		return conn.bye("server shutting down")
+	}
+	return nil
+}
 
-		for _, conn := range s.conns {
-			if update.Username != "" && (conn.User == nil || conn.User.Username() != update.Username) {
-				continue
-			}
-			if update.Mailbox != "" && (conn.Mailbox == nil || conn.Mailbox.Name() != update.Mailbox) {
-				continue
-			}
-			if conn.silent {
-				// If silent is set, do not send message updates
-				if _, ok := res.(*responses.Fetch); ok {
-					continue
-				}
-			}
+// Get the name of a command, as reported to metrics. Unknown commands and UID
+// commands with an unknown sub-command are reported as "UNKNOWN", since clients
+// can send anything.
+func (s *Server) metricsName(cmd *common.Command) string {
+	if _, ok := s.commands[cmd.Name]; !ok {
+		return "UNKNOWN"
+	}
 
-			conn.locker.Lock()
-			if _, err := conn.Writer.Write(b.Bytes()); err != nil {
-				log.Println("WARN: error sending unilateral update:", err)
-			}
-			conn.Flush()
-			conn.locker.Unlock()
+	name := commandName(cmd)
+	if sub := strings.TrimPrefix(name, "UID "); sub != name {
+		if _, ok := s.commands[sub]; !ok {
+			return "UNKNOWN"
 		}
 	}
+	return name
+}
+
+func (s *Server) getCommandHandler(cmd *common.Command) (hdlr Handler, err error) {
+	newHandler, ok := s.commands[cmd.Name]
+	if !ok {
+		err = errors.New("Unknown command")
+		return
+	}
+
+	hdlr = newHandler()
+	err = hdlr.Parse(cmd.Arguments)
+	return
 }
 
 func (s *Server) getCaps(currentState common.ConnState) (caps []string) {
@@ -242,17 +560,74 @@ func (s *Server) getCaps(currentState common.ConnState) (caps []string) {
 	return
 }
 
+// Stop listening. Returns the connections that are not executing a command.
+func (s *Server) stopListening() (idle []*Conn, err error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.shuttingDown = true
+
+	for l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(s.listeners, l)
+	}
+
+	for _, conn := range s.conns.all() {
+		if conn.busy == 0 {
+			idle = append(idle, conn)
+		}
+	}
+	return
+}
+
 // Stops listening and closes all current connections.
 func (s *Server) Close() error {
-	if err := s.listener.Close(); err != nil {
-		return err
-	}
+	_, err := s.stopListening()
 
-	for _, conn := range s.conns {
+	for _, conn := range s.conns.all() {
 		conn.Close()
 	}
 
-	return nil
+	return err
+}
+
+// Gracefully shut down the server. Shutdown stops listening, sends a BYE
+// response to idle connections and closes them, and then waits for commands
+// in progress to complete. Connections are closed as soon as their current
+// command completes.
+//
+// If ctx expires before all connections have been closed, remaining
+// connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	idle, err := s.stopListening()
+
+	for _, conn := range idle {
+		conn.bye("server shutting down")
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.locker.Lock()
+		active := s.active
+		s.locker.Unlock()
+
+		if active == 0 {
+			return err
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, conn := range s.conns.all() {
+				conn.Close()
+			}
+			return ctx.Err()
+		}
+	}
 }
 
 // Register a new capability that will be advertised by this server.
@@ -279,12 +654,26 @@ func (s *Server) RegisterCommand(name string, f HandlerFactory) {
 	s.commands[name] = f
 }
 
-// Create a new IMAP server from an existing listener.
-func NewServer(l net.Listener, bkd backend.Backend) *Server {
+// Create a new IMAP server. Use Serve to accept connections.
+//
+// The server's timeouts and limits are set to safe defaults, see the README
+// for a list. Set a field to zero to disable a limit.
+func New(bkd backend.Backend) *Server {
 	s := &Server{
-		listener: l,
+		listeners: map[net.Listener]struct{}{},
+		conns: newConnRegistry(),
+		updatesSync: make(chan chan struct{}),
 		caps: map[string]common.ConnState{},
 		Backend: bkd,
+		PreAuthTimeout: time.Minute,
+		AutoLogout: 30 * time.Minute,
+		WriteTimeout: time.Minute,
+		MaxLiteralSize: 64 * 1024 * 1024,
+		MaxLineLength: 8192,
+		MaxDepth: 64,
+		MaxAuthFailures: 3,
+		MaxConcurrentCommands: 8,
+		MaxQueuedUpdates: 1024,
 	}
 
 	s.auths = map[string]SaslServerFactory{
@@ -294,17 +683,26 @@ func NewServer(l net.Listener, bkd backend.Backend) *Server {
 					return errors.New("Identities not supported")
 				}
 
-				user, err := bkd.Login(username, password)
-				if err != nil {
-					return err
-				}
-
-				conn.State = common.AuthenticatedState
-				conn.User = user
-				return nil
+				return conn.authenticate("PLAIN", username, func() (backend.User, error) {
+					return conn.login("PLAIN", username, password)
+				})
 			})
 		},
+		sasl.Login: func(conn *Conn) sasl.Server {
+			return sasl.NewLoginServer(func(username, password string) error {
+				return conn.authenticate(sasl.Login, username, func() (backend.User, error) {
+					return conn.login(sasl.Login, username, password)
+				})
+			})
+		},
+		sasl.External: newExternalServer,
+	}
+	s.RegisterAuth(sasl.OAuthBearer, newOAuthServerFactory(sasl.OAuthBearer))
+	s.RegisterAuth("XOAUTH2", newOAuthServerFactory("XOAUTH2"))
+	for _, mech := range []string{scram.SHA1, scram.SHA1Plus, scram.SHA256, scram.SHA256Plus} {
+		s.RegisterAuth(mech, newScramServerFactory(mech))
 	}
+	s.RegisterAuth("CRAM-MD5", newCramMD5Server)
 
 	s.commands = map[string]HandlerFactory{
 		common.Noop: func() Handler { return &Noop{} },
@@ -345,8 +743,24 @@ func NewServer(l net.Listener, bkd backend.Backend) *Server {
 		common.Uid: func() Handler { return &Uid{} },
 	}
 
-	go s.listen()
-	go s.listenUpdates()
+	if updater, ok := bkd.(backend.Updater); ok {
+		// Set the updates right now, so that they can be read by connections
+		// without synchronization
+		s.Updates = updater.Updates()
+		go s.listenUpdates()
+	}
+	return s
+}
+
+// Create a new IMAP server from an existing listener.
+func NewServer(l net.Listener, bkd backend.Backend) *Server {
+	s := New(bkd)
+
+	// Set the listener right now, so that Addr can be used as soon as this
+	// function returns
+	s.listener = l
+
+	go s.Serve(l)
 	return s
 }
 
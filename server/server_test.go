@@ -2,10 +2,18 @@ package server_test
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"io"
 	"net"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/common"
 	"github.com/emersion/go-imap/server"
 )
 
@@ -37,7 +45,716 @@ func TestServer_greeting(t *testing.T) {
 	scanner.Scan() // Wait for greeting
 	greeting := scanner.Text()
 
-	if greeting != "* OK [CAPABILITY IMAP4rev1 AUTH=PLAIN] IMAP4rev1 Service Ready" {
+	if greeting != "* OK [CAPABILITY IMAP4rev1 AUTH=LOGIN AUTH=PLAIN SASL-IR] IMAP4rev1 Service Ready" {
 		t.Fatal("Bad greeting:", greeting)
 	}
 }
+
+func TestServer_Shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(memory.New())
+
+	done := make(chan error, 1)
+	go (func() {
+		done <- s.Serve(l)
+	})()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Wait for greeting
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal("Cannot shut down server:", err)
+	}
+
+	scanner.Scan()
+	if scanner.Text() != "* BYE server shutting down" {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+
+	if scanner.Scan() {
+		t.Fatal("Connection not closed after BYE:", scanner.Text())
+	}
+
+	if err := <-done; err != server.ErrServerClosed {
+		t.Fatal("Bad error returned by Serve:", err)
+	}
+}
+
+// A backend blocking logins until release is closed.
+type blockingBackend struct {
+	backend.Backend
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bkd *blockingBackend) Login(username, password string) (backend.User, error) {
+	close(bkd.started)
+	<-bkd.release
+	return bkd.Backend.Login(username, password)
+}
+
+func TestServer_Shutdown_inFlight(t *testing.T) {
+	bkd := &blockingBackend{
+		Backend: memory.New(),
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	s, err := server.Listen("127.0.0.1:0", bkd)
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	s.AllowInsecureAuth = true
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Wait for greeting
+
+	io.WriteString(conn, "a001 LOGIN username password\r\n")
+	<-bkd.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go (func() {
+		done <- s.Shutdown(ctx)
+	})()
+
+	select {
+	case err := <-done:
+		t.Fatal("Server shut down while a command was in progress:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(bkd.release)
+
+	if err := <-done; err != nil {
+		t.Fatal("Cannot shut down server:", err)
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	scanner.Scan()
+	if scanner.Text() != "* BYE server shutting down" {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+}
+
+type logoutBackend struct {
+	backend.Backend
+	logouts chan struct{}
+}
+
+func (bkd *logoutBackend) Login(username, password string) (backend.User, error) {
+	u, err := bkd.Backend.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &logoutUser{u, bkd.logouts}, nil
+}
+
+type logoutUser struct {
+	backend.User
+	logouts chan struct{}
+}
+
+func (u *logoutUser) Logout() error {
+	u.logouts <- struct{}{}
+	return nil
+}
+
+func TestServer_Close_logout(t *testing.T) {
+	bkd := &logoutBackend{memory.New(), make(chan struct{}, 10)}
+
+	s := server.New(bkd)
+	s.AllowInsecureAuth = true
+	defer s.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Wait for greeting
+
+	io.WriteString(conn, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	// Connections can be closed from other goroutines, more than once
+	conns := s.Conns()
+	if len(conns) != 1 {
+		t.Fatal("Expected exactly one connection, got:", len(conns))
+	}
+	conns[0].Close()
+	conns[0].Close()
+
+	select {
+	case <-bkd.logouts:
+	case <-time.After(5 * time.Second):
+		t.Fatal("User not logged out")
+	}
+
+	for i := 0; i < 100 && len(s.Conns()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(bkd.logouts) != 0 {
+		t.Error("User logged out more than once")
+	}
+}
+
+func TestServer_Conns(t *testing.T) {
+	s, conn := testServer(t)
+	defer s.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Wait for greeting
+
+	io.WriteString(conn, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	io.WriteString(conn, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+
+	conns := s.Conns()
+	if len(conns) != 1 {
+		t.Fatal("Expected exactly one connection, got:", len(conns))
+	}
+	if username := conns[0].Username(); username != "username" {
+		t.Fatal("Bad username:", username)
+	}
+	if mailbox := conns[0].SelectedMailbox(); mailbox != "INBOX" {
+		t.Fatal("Bad selected mailbox:", mailbox)
+	}
+
+	conn.Close()
+
+	// Closed connections are removed
+	for i := 0; i < 100; i++ {
+		if len(s.Conns()) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Closed connection not removed")
+}
+
+func TestServer_PreAuthTimeout(t *testing.T) {
+	s, conn := testServer(t)
+	defer conn.Close()
+	defer s.Close()
+
+	s.PreAuthTimeout = 100 * time.Millisecond
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Wait for greeting
+
+	// The timeout is set before reading each command
+	io.WriteString(conn, "a001 NOOP\r\n")
+	scanner.Scan()
+
+	scanner.Scan()
+	if scanner.Text() != "* BYE Autologout" {
+		t.Fatal("Bad BYE response:", scanner.Text())
+	}
+
+	if scanner.Scan() {
+		t.Fatal("Connection not closed after BYE:", scanner.Text())
+	}
+}
+
+func TestServer_limits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.MaxConnsPerIP = 1
+	s.MaxLiteralSize = 16
+	defer s.Close()
+
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan() // Wait for greeting
+
+	// A second connection from the same IP address is rejected
+	conn2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer conn2.Close()
+
+	scanner2 := bufio.NewScanner(conn2)
+	scanner2.Scan()
+	if scanner2.Text() != "* BYE Too many connections" {
+		t.Fatal("Bad BYE response:", scanner2.Text())
+	}
+
+	// Too big literals are rejected before the continuation request
+	io.WriteString(conn, "a001 LOGIN {17}\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a001 BAD [TOOBIG] ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// The connection can still be used
+	io.WriteString(conn, "a002 LOGIN username password\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a002 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a001 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a001 ") {
+			break
+		}
+	}
+
+	// STORE must be executed after all previous commands, and before all next
+	// ones
+	const n = 50
+	const storeIndex = 25
+	cmds := []string{
+		"FETCH 1 (FLAGS)",
+		"STATUS INBOX (MESSAGES)",
+		"UID FETCH 1:* (FLAGS)",
+		"SEARCH ALL",
+		"NOOP",
+	}
+
+	pipelined := ""
+	for i := 0; i < n; i++ {
+		cmd := cmds[i % len(cmds)]
+		if i == storeIndex {
+			cmd = "STORE 1 +FLAGS.SILENT (\\Flagged)"
+		}
+		pipelined += "p" + strconv.Itoa(i) + " " + cmd + "\r\n"
+	}
+	io.WriteString(c, pipelined)
+
+	got := map[string]bool{}
+	stored := false
+	for len(got) < n && scanner.Scan() {
+		res := scanner.Text()
+
+		if strings.HasPrefix(res, "* 1 FETCH ") {
+			if flagged := strings.Contains(res, "\\Flagged"); flagged != stored {
+				t.Fatal("FETCH response not ordered with STORE:", res)
+			}
+			continue
+		}
+		if strings.HasPrefix(res, "* ") {
+			continue
+		}
+
+		fields := strings.SplitN(res, " ", 3)
+		if len(fields) < 2 || fields[1] != "OK" {
+			t.Fatal("Bad status response:", res)
+		}
+
+		tag := fields[0]
+		if got[tag] {
+			t.Fatal("Received two status responses for", tag)
+		}
+		got[tag] = true
+
+		i, _ := strconv.Atoi(strings.TrimPrefix(tag, "p"))
+		if i == storeIndex {
+			if len(got) != storeIndex + 1 {
+				t.Fatal("STORE completed before previous commands")
+			}
+			stored = true
+		}
+	}
+
+	if len(got) != n {
+		t.Fatal("Expected status responses for all commands, got:", len(got))
+	}
+}
+
+// A backend whose mailboxes block ListMessages until release is closed.
+type slowFetchBackend struct {
+	backend.Backend
+	release chan struct{}
+}
+
+func (bkd *slowFetchBackend) Login(username, password string) (backend.User, error) {
+	u, err := bkd.Backend.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFetchUser{u, bkd.release}, nil
+}
+
+type slowFetchUser struct {
+	backend.User
+	release chan struct{}
+}
+
+func (u *slowFetchUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFetchMailbox{mbox, u.release}, nil
+}
+
+type slowFetchMailbox struct {
+	backend.Mailbox
+	release chan struct{}
+}
+
+func (mbox *slowFetchMailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	<-mbox.release
+	return mbox.Mailbox.ListMessages(uid, seqset, items, ch)
+}
+
+func TestServer_ConcurrentCommands(t *testing.T) {
+	bkd := &slowFetchBackend{
+		Backend: memory.New(),
+		release: make(chan struct{}),
+	}
+
+	s, err := server.Listen("127.0.0.1:0", bkd)
+	if err != nil {
+		t.Fatal("Cannot start server:", err)
+	}
+	defer s.Close()
+	s.AllowInsecureAuth = true
+
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Wait for greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+
+	// STATUS completes while FETCH is still in progress
+	io.WriteString(c, "a003 FETCH 1 (FLAGS)\r\na004 STATUS INBOX (MESSAGES)\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "* STATUS INBOX (MESSAGES 1)" {
+		t.Fatal("Bad STATUS response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a004 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	close(bkd.release)
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* 1 FETCH ") {
+		t.Fatal("Bad FETCH response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "a003 OK ") {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+}
+
+// A backend whose mailboxes list three messages slowly, and then fail with err
+// if not nil.
+type stepFetchBackend struct {
+	backend.Backend
+	err error
+}
+
+func (bkd *stepFetchBackend) Login(username, password string) (backend.User, error) {
+	u, err := bkd.Backend.Login(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &stepFetchUser{u, bkd.err}, nil
+}
+
+type stepFetchUser struct {
+	backend.User
+	err error
+}
+
+func (u *stepFetchUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &stepFetchMailbox{mbox, u.err}, nil
+}
+
+type stepFetchMailbox struct {
+	backend.Mailbox
+	err error
+}
+
+func (mbox *stepFetchMailbox) ListMessages(uid bool, seqset *common.SeqSet, items []string, ch chan<- *common.Message) error {
+	defer close(ch)
+
+	for i := uint32(1); i <= 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ch <- &common.Message{SeqNum: i, Items: []string{"FLAGS"}}
+	}
+	return mbox.err
+}
+
+func testServerStepFetch(t *testing.T, err error) (s *server.Server, c net.Conn, scanner *bufio.Scanner) {
+	s = server.New(&stepFetchBackend{memory.New(), err})
+	s.AllowInsecureAuth = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+
+	scanner = bufio.NewScanner(c)
+	scanner.Scan() // Wait for greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "a002 SELECT INBOX\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "a002 ") {
+			break
+		}
+	}
+	return
+}
+
+func TestServer_ConcurrentFetch(t *testing.T) {
+	s, c, scanner := testServerStepFetch(t, nil)
+	defer c.Close()
+	defer s.Close()
+
+	// Responses of concurrent FETCH commands aren't interleaved
+	io.WriteString(c, "a003 FETCH 1:3 (FLAGS)\r\na004 FETCH 1:3 (FLAGS)\r\n")
+
+	var seqNums []string
+	completed := 0
+	for completed < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "* ") {
+			seqNums = append(seqNums, strings.Fields(line)[1])
+			continue
+		}
+		if !strings.HasPrefix(line, "a003 OK ") && !strings.HasPrefix(line, "a004 OK ") {
+			t.Fatal("Bad status response:", line)
+		}
+		completed++
+	}
+
+	if got := strings.Join(seqNums, " "); got != "1 2 3 1 2 3" {
+		t.Errorf("FETCH responses interleaved: got %v", got)
+	}
+}
+
+func TestServer_ConcurrentFetch_error(t *testing.T) {
+	s, c, scanner := testServerStepFetch(t, errors.New("Cannot list messages"))
+	defer c.Close()
+	defer s.Close()
+
+	io.WriteString(c, "a003 FETCH 1:3 (FLAGS)\r\n")
+	for i := 0; i < 3; i++ {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "* ") {
+			t.Fatal("Bad FETCH response:", scanner.Text())
+		}
+	}
+	scanner.Scan()
+	if scanner.Text() != "a003 NO Cannot list messages" {
+		t.Fatal("Bad status response:", scanner.Text())
+	}
+
+	// Responses of other commands can still be written
+	io.WriteString(c, "a004 STATUS INBOX (MESSAGES)\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "* STATUS INBOX ") {
+		t.Fatal("Bad STATUS response:", scanner.Text())
+	}
+}
+
+func TestServer_Logger(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	events := make(chan *common.LogEvent, 16)
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Logger = common.LoggerFunc(func(ev *common.LogEvent) {
+		events <- ev
+	})
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	io.WriteString(c, "a001 LOGIN username password\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a002 UID SEARCH ALL\r\n")
+	scanner.Scan()
+	io.WriteString(c, "a003 FOO\r\n")
+	scanner.Scan()
+	c.Close()
+
+	var id uint64
+	expected := []string{"a001 LOGIN OK", "a002 UID SEARCH NO", "a003 FOO BAD"}
+	for ev := range events {
+		if id == 0 {
+			id = ev.ConnID
+		}
+		if ev.ConnID != id || id == 0 {
+			t.Fatalf("Bad connection ID for event %v: %v", ev, ev.ConnID)
+		}
+		if ev.Time.IsZero() {
+			t.Fatalf("No time for event %v", ev)
+		}
+
+		if ev.Message == "connection closed" {
+			break
+		}
+		if ev.Command == "" {
+			continue
+		}
+
+		if len(expected) == 0 {
+			t.Fatalf("Unexpected command event %v", ev)
+		}
+		if got := ev.Tag + " " + ev.Command + " " + string(ev.Result); got != expected[0] {
+			t.Fatalf("Bad command event: expected %q, got %q", expected[0], got)
+		}
+		expected = expected[1:]
+	}
+
+	if len(expected) > 0 {
+		t.Fatal("Missing command events:", expected)
+	}
+}
+
+// Metrics recording the names of completed commands.
+type commandMetrics struct {
+	common.NopMetrics
+	names chan string
+}
+
+func (m *commandMetrics) CommandCompleted(name string, result common.StatusRespType, d time.Duration) {
+	m.names <- name
+}
+
+func TestServer_Metrics_commandNames(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Cannot listen:", err)
+	}
+
+	m := &commandMetrics{names: make(chan string, 16)}
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Metrics = m
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Cannot connect to server:", err)
+	}
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan() // Greeting
+
+	commands := []string{
+		"LOGIN username password",
+		"SELECT INBOX",
+		"UID FETCH 1:* FLAGS",
+		"UID FOO 1",
+		"UID",
+		"FOO",
+	}
+	for i, cmd := range commands {
+		tag := "a" + strconv.Itoa(i)
+		io.WriteString(c, tag + " " + cmd + "\r\n")
+		for scanner.Scan() && !strings.HasPrefix(scanner.Text(), tag + " ") {}
+	}
+
+	expected := []string{"LOGIN", "SELECT", "UID FETCH", "UNKNOWN", "UID", "UNKNOWN"}
+	for _, name := range expected {
+		if got := <-m.names; got != name {
+			t.Errorf("Expected command name %q, got %q", name, got)
+		}
+	}
+}
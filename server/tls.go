@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync"
+)
+
+type certFiles struct {
+	certFile, keyFile string
+}
+
+// A CertStore holds TLS certificates loaded from files. The certificate sent
+// to a client is selected with the hostname it requested via SNI.
+// Certificates can be reloaded without restarting the server, e.g. after they
+// have been renewed.
+//
+// To use it, set the server's TLSConfig.GetCertificate to GetCertificate.
+type CertStore struct {
+	locker sync.RWMutex
+	files map[string]certFiles
+	certs map[string]*tls.Certificate
+}
+
+// Create a new empty CertStore.
+func NewCertStore() *CertStore {
+	return &CertStore{
+		files: map[string]certFiles{},
+		certs: map[string]*tls.Certificate{},
+	}
+}
+
+func loadCert(files certFiles) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(files.certFile, files.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Load a certificate and its key from PEM files, and use it for hostname.
+// hostname can be a wildcard, e.g. "*.example.org". If hostname is empty, the
+// certificate is used when no other one matches.
+func (s *CertStore) Add(hostname, certFile, keyFile string) error {
+	files := certFiles{certFile, keyFile}
+	cert, err := loadCert(files)
+	if err != nil {
+		return err
+	}
+
+	hostname = strings.ToLower(hostname)
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.files[hostname] = files
+	s.certs[hostname] = cert
+	return nil
+}
+
+// Reload all certificates from their files. If a certificate cannot be
+// loaded, an error is returned and no certificate is replaced.
+func (s *CertStore) Reload() error {
+	s.locker.RLock()
+	files := make(map[string]certFiles, len(s.files))
+	for hostname, f := range s.files {
+		files[hostname] = f
+	}
+	s.locker.RUnlock()
+
+	certs := make(map[string]*tls.Certificate, len(files))
+	for hostname, f := range files {
+		cert, err := loadCert(f)
+		if err != nil {
+			return err
+		}
+		certs[hostname] = cert
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for hostname, cert := range certs {
+		s.certs[hostname] = cert
+	}
+	return nil
+}
+
+// Get the certificate for a TLS handshake. It's compatible with
+// tls.Config.GetCertificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+
+	if name != "" {
+		if cert, ok := s.certs[name]; ok {
+			return cert, nil
+		}
+
+		// Try a wildcard certificate
+		if i := strings.IndexByte(name, '.'); i >= 0 {
+			if cert, ok := s.certs["*" + name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if cert, ok := s.certs[""]; ok {
+		return cert, nil
+	}
+	return nil, errors.New("No certificate available for " + hello.ServerName)
+}
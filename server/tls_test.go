@@ -0,0 +1,95 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-imap/server"
+)
+
+// Write a certificate and its key to PEM files.
+func writeCert(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name + ".crt")
+	keyFile = filepath.Join(dir, name + ".key")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func getCertName(t *testing.T, store *server.CertStore, serverName string) string {
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal("Cannot get certificate:", err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-imap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := server.NewCertStore()
+	for _, name := range []string{"default", "mail.example.org", "*.example.org"} {
+		certFile, keyFile := writeCert(t, dir, name, testCert(t, nil, name))
+
+		hostname := name
+		if name == "default" {
+			hostname = ""
+		}
+		if err := store.Add(hostname, certFile, keyFile); err != nil {
+			t.Fatal("Cannot add certificate:", err)
+		}
+	}
+
+	tests := map[string]string{
+		"": "default",
+		"mail.example.org": "mail.example.org",
+		"MAIL.example.org.": "mail.example.org",
+		"imap.example.org": "*.example.org",
+		"example.com": "default",
+	}
+	for serverName, want := range tests {
+		if got := getCertName(t, store, serverName); got != want {
+			t.Errorf("Bad certificate for %q: got %q, want %q", serverName, got, want)
+		}
+	}
+
+	// Replace a certificate file and reload it
+	writeCert(t, dir, "mail.example.org", testCert(t, nil, "renewed"))
+	if err := store.Reload(); err != nil {
+		t.Fatal("Cannot reload certificates:", err)
+	}
+	if got := getCertName(t, store, "mail.example.org"); got != "renewed" {
+		t.Error("Certificate not reloaded, got:", got)
+	}
+
+	// Certificates are kept if they cannot be reloaded
+	os.Remove(filepath.Join(dir, "default.crt"))
+	if err := store.Reload(); err == nil {
+		t.Error("Expected an error when reloading a missing certificate")
+	}
+	if got := getCertName(t, store, ""); got != "default" {
+		t.Error("Bad certificate after failed reload:", got)
+	}
+}
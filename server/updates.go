@@ -0,0 +1,286 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/common"
+	"github.com/emersion/go-imap/responses"
+)
+
+// A function writing a unilateral update to a connection. Responses are
+// rendered when they're written, so that they reflect the connection's state
+// at this time.
+type queuedUpdate func() error
+
+// A queue of unilateral updates waiting to be written to a connection.
+type updateQueue struct {
+	locker sync.Mutex
+	updates []queuedUpdate
+	max int
+
+	// Receives a value when updates are pushed.
+	notify chan struct{}
+	// Held while updates are written, so that they aren't interleaved with
+	// EXPUNGE responses.
+	writing sync.Mutex
+}
+
+func newUpdateQueue(max int) *updateQueue {
+	return &updateQueue{
+		max: max,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Push an update. Returns false if the queue is full.
+func (q *updateQueue) push(update queuedUpdate) bool {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	if q.max > 0 && len(q.updates) >= q.max {
+		return false
+	}
+	q.updates = append(q.updates, update)
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Pop an update. Returns nil if the queue is empty.
+func (q *updateQueue) pop() queuedUpdate {
+	q.locker.Lock()
+	defer q.locker.Unlock()
+
+	if len(q.updates) == 0 {
+		return nil
+	}
+
+	update := q.updates[0]
+	q.updates[0] = nil
+	q.updates = q.updates[1:]
+	return update
+}
+
+// Write queued updates. Must be called with q.writing held.
+func (q *updateQueue) write() error {
+	for update := q.pop(); update != nil; update = q.pop() {
+		if err := update(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue an update for this connection. If the client doesn't read its
+// responses fast enough and too many updates are queued, the connection is
+// closed.
+func (c *Conn) queueUpdate(update queuedUpdate) {
+	if !c.updates.push(update) && !c.isCloseRequested() {
+		c.log(common.LogWarn, "too many queued unilateral updates, closing connection", nil)
+		c.requestClose()
+	}
+}
+
+// Queue a BYE response, the connection is closed once it has been sent.
+func (c *Conn) queueBye(res *common.StatusResp) {
+	c.queueUpdate(func() error {
+		c.WriteRes(res)
+		c.Metrics().UnilateralUpdate("bye")
+		c.requestClose()
+		return nil
+	})
+}
+
+// Write queued updates as they arrive, until the connection is closed.
+func (c *Conn) sendUpdates() {
+	for {
+		select {
+		case <-c.updates.notify:
+		case <-c.closed:
+			return
+		}
+
+		c.updates.writing.Lock()
+		err := c.updates.write()
+		c.updates.writing.Unlock()
+
+		if err != nil {
+			c.log(common.LogWarn, "cannot send unilateral update", err)
+			c.requestClose()
+			return
+		}
+	}
+}
+
+func (s *Server) listenUpdates() {
+	for {
+		select {
+		case status := <-s.Updates.Statuses:
+			if status.StatusResp != nil && status.Type == common.BYE {
+				for _, conn := range s.conns.lookupUpdate(&status.Update, false) {
+					conn.queueBye(status.StatusResp)
+				}
+				break
+			}
+
+			s.sendUpdate(&status.Update, "status", false, func(conn *Conn) func() common.WriterTo {
+				return func() common.WriterTo {
+					return status.StatusResp
+				}
+			})
+		case mailbox := <-s.Updates.Mailboxes:
+			s.sendUpdate(&mailbox.Update, "mailbox", false, func(conn *Conn) func() common.WriterTo {
+				gen := conn.seqNums.gen()
+
+				status := mailbox.MailboxStatus
+				hasMessages := false
+				for _, item := range status.Items {
+					if item == common.MailboxMessages {
+						hasMessages = true
+						if _, ok := conn.seqNums.exists(status.Messages); !ok {
+							return nil
+						}
+						break
+					}
+				}
+
+				return func() common.WriterTo {
+					if !hasMessages {
+						return &responses.Select{Mailbox: status}
+					}
+					if conn.seqNums.gen() != gen {
+						return nil
+					}
+
+					// The client may not know yet that some messages have been
+					// expunged
+					copied := *status
+					copied.Messages = conn.seqNums.count()
+					return &responses.Select{Mailbox: &copied}
+				}
+			})
+		case message := <-s.Updates.Messages:
+			s.sendUpdate(&message.Update, "message", true, func(conn *Conn) func() common.WriterTo {
+				return conn.renderMessage(conn.seqNums.message(message.SeqNum), message.Message)
+			})
+		case expunge := <-s.Updates.Expunges:
+			// EXPUNGE responses are sent when the current command completes
+			for _, conn := range s.conns.lookupUpdate(&expunge.Update, false) {
+				conn.seqNums.expunge(expunge.SeqNum)
+			}
+		case flags := <-s.Updates.Flags:
+			s.sendUpdate(&flags.Update, "message", true, func(conn *Conn) func() common.WriterTo {
+				msg := &common.Message{
+					Items: []string{"FLAGS", "UID"},
+					Flags: flags.Flags,
+					Uid: flags.Uid,
+				}
+				return conn.renderMessage(conn.seqNums.messageUid(flags.Uid), msg)
+			})
+		case added := <-s.Updates.Added:
+			s.sendUpdate(&added.Update, "mailbox", false, func(conn *Conn) func() common.WriterTo {
+				gen := conn.seqNums.gen()
+				if !conn.seqNums.add(added.Uids) {
+					return nil
+				}
+
+				return func() common.WriterTo {
+					if conn.seqNums.gen() != gen {
+						return nil
+					}
+
+					status := &common.MailboxStatus{
+						Name: added.Mailbox,
+						Items: []string{common.MailboxMessages},
+						Messages: conn.seqNums.count(),
+					}
+					return &responses.Select{Mailbox: status}
+				}
+			})
+		case expunge := <-s.Updates.UidExpunges:
+			for _, conn := range s.conns.lookupUpdate(&expunge.Update, false) {
+				for _, uid := range expunge.Uids {
+					conn.seqNums.expungeUid(uid)
+				}
+			}
+		case rename := <-s.Updates.Renames:
+			s.conns.renameMailbox(rename.Username, rename.Mailbox, rename.NewName)
+		case del := <-s.Updates.Deletes:
+			if del.Mailbox == "" {
+				break
+			}
+
+			// The selected mailbox doesn't exist anymore, the client cannot
+			// continue
+			for _, conn := range s.conns.lookupUpdate(&del.Update, false) {
+				conn.queueBye(&common.StatusResp{
+					Tag: "*",
+					Type: common.BYE,
+					Info: "Selected mailbox has been deleted",
+				})
+			}
+		case done := <-s.updatesSync:
+			close(done)
+		}
+	}
+}
+
+// Render a message update. msg is the message as seen by the client, nil if
+// unknown.
+func (c *Conn) renderMessage(msg *seqMessage, update *common.Message) func() common.WriterTo {
+	if msg == nil {
+		return nil
+	}
+
+	return func() common.WriterTo {
+		seqNum := c.seqNums.seqNum(msg)
+		if seqNum == 0 {
+			return nil
+		}
+		return common.NewUntaggedResp([]interface{}{seqNum, common.Fetch, update.Format()})
+	}
+}
+
+// Queue an update for all connections it targets. kind is the kind of update
+// reported to metrics. If silent is set, connections in silent mode are
+// skipped. prepare is called for each connection when the update is received,
+// it updates the connection's state if necessary and returns a function
+// rendering the response, or nil if no response needs to be sent. The response
+// is rendered just before being written, and isn't written if nil.
+func (s *Server) sendUpdate(update *backend.Update, kind string, silent bool, prepare func(conn *Conn) func() common.WriterTo) {
+	for _, conn := range s.conns.lookupUpdate(update, silent) {
+		render := prepare(conn)
+		if render == nil {
+			continue
+		}
+
+		conn := conn
+		conn.queueUpdate(func() error {
+			res := render()
+			if res == nil {
+				return nil
+			}
+			if err := conn.WriteRes(res); err != nil {
+				return err
+			}
+
+			conn.Metrics().UnilateralUpdate(kind)
+			return nil
+		})
+	}
+}
+
+// Wait for all updates sent by the backend so far to be processed.
+func (s *Server) syncUpdates() {
+	if s.Updates == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	s.updatesSync <- done
+	<-done
+}